@@ -197,10 +197,21 @@ func main() {
 
 		client.RouteUDP(acceptor, localConfig.Timeout, remoteConfig.Singleplex, seshMaker)
 	} else {
+		if len(localConfig.ExtraLocalAddrs) > 0 && !remoteConfig.Singleplex {
+			seshMaker = client.SharedSession(seshMaker)
+		}
+		for addr, weight := range localConfig.ExtraLocalAddrs {
+			listener, err := net.Listen("tcp", addr)
+			if err != nil {
+				log.Fatal(err)
+			}
+			log.Infof("Also listening on TCP %v", addr)
+			go client.RouteTCP(listener, localConfig.Timeout, weight, remoteConfig.Singleplex, seshMaker)
+		}
 		listener, err := net.Listen("tcp", localConfig.LocalAddr)
 		if err != nil {
 			log.Fatal(err)
 		}
-		client.RouteTCP(listener, localConfig.Timeout, remoteConfig.Singleplex, seshMaker)
+		client.RouteTCP(listener, localConfig.Timeout, localConfig.StreamWeight, remoteConfig.Singleplex, seshMaker)
 	}
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"net"
@@ -12,21 +13,57 @@ import (
 
 	"github.com/cbeuw/Cloak/internal/common"
 	"github.com/cbeuw/Cloak/internal/server"
+	"github.com/cbeuw/Cloak/internal/server/usermanager"
 	log "github.com/sirupsen/logrus"
 )
 
 var version string
 
-func resolveBindAddr(bindAddrs []string) ([]net.Addr, error) {
+// resolveBindAddr resolves the addresses in BindAddr. An address is a TCP address, "unix:" followed by the path of a
+// unix socket, or "systemd" for the sockets passed by systemd, optionally followed by ":" and their
+// FileDescriptorName. A TCP or systemd address can be followed by a slash and the transports accepted on it, e.g.
+// ":80/websocket". As a path has slashes of its own, a unix socket has them after "unix" instead, e.g.
+// "unix/websocket:/run/ck.sock". The transports are returned keyed by the resolved address
+func resolveBindAddr(bindAddrs []string) ([]net.Addr, map[string][]server.Transport, error) {
 	var addrs []net.Addr
-	for _, addr := range bindAddrs {
-		bindAddr, err := net.ResolveTCPAddr("tcp", addr)
-		if err != nil {
-			return nil, err
+	transportsOf := make(map[string][]server.Transport)
+	for _, entry := range bindAddrs {
+		var bindAddr net.Addr
+		var transports []server.Transport
+		if scheme, path, ok := strings.Cut(entry, ":"); ok && (scheme == "unix" || strings.HasPrefix(scheme, "unix/")) {
+			if transportNames, restricted := strings.CutPrefix(scheme, "unix/"); restricted {
+				var err error
+				transports, err = server.ParseTransports(transportNames)
+				if err != nil {
+					return nil, nil, fmt.Errorf("%v: %v", entry, err)
+				}
+			}
+			bindAddr = &net.UnixAddr{Name: path, Net: "unix"}
+		} else {
+			addr, transportNames, restricted := strings.Cut(entry, "/")
+			if restricted {
+				var err error
+				transports, err = server.ParseTransports(transportNames)
+				if err != nil {
+					return nil, nil, fmt.Errorf("%v: %v", addr, err)
+				}
+			}
+			if name, ok := strings.CutPrefix(addr, "systemd"); ok && (name == "" || name[0] == ':') {
+				bindAddr = systemdAddr{strings.TrimPrefix(name, ":")}
+			} else {
+				tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+				if err != nil {
+					return nil, nil, err
+				}
+				bindAddr = tcpAddr
+			}
 		}
 		addrs = append(addrs, bindAddr)
+		if transports != nil {
+			transportsOf[bindAddr.String()] = transports
+		}
 	}
-	return addrs, nil
+	return addrs, transportsOf, nil
 }
 
 // parse what shadowsocks server wants us to bind and harmonise it with what's already in bindAddr from
@@ -68,8 +105,30 @@ func parseSSBindAddr(ssRemoteHost string, ssRemotePort string, ckBindAddr *[]net
 	return nil
 }
 
+// migrateUsers copies the users in a bbolt userinfo.db into the SQL database at dsn
+func migrateUsers(boltPath string, dsn string) (int, error) {
+	if dsn == "" {
+		return 0, errors.New("DatabaseDSN must be set to migrate users")
+	}
+	if _, err := os.Stat(boltPath); err != nil {
+		return 0, err
+	}
+	src, err := usermanager.MakeLocalManager(boltPath, common.RealWorldState)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+	dst, err := usermanager.MakeSQLManager(dsn, common.RealWorldState)
+	if err != nil {
+		return 0, err
+	}
+	defer dst.Close()
+	return usermanager.CopyUsers(dst, src)
+}
+
 func main() {
 	var config string
+	var migrateDB string
 
 	var pluginMode bool
 
@@ -93,6 +152,7 @@ func main() {
 
 		pprofAddr := flag.String("d", "", "debug use: ip:port to be listened by pprof profiler")
 		verbosity := flag.String("verbosity", "info", "verbosity level")
+		flag.StringVar(&migrateDB, "migratedb", "", "Copy the users in a userinfo.db file into the database set in DatabaseDSN, then exit")
 
 		flag.Parse()
 
@@ -147,7 +207,16 @@ func main() {
 		log.Fatalf("Configuration file error: %v", err)
 	}
 
-	bindAddr, err := resolveBindAddr(raw.BindAddr)
+	if migrateDB != "" {
+		n, err := migrateUsers(migrateDB, raw.DatabaseDSN)
+		if err != nil {
+			log.Fatalf("Failed to migrate users: %v", err)
+		}
+		log.Infof("Migrated %v users from %v", n, migrateDB)
+		return
+	}
+
+	bindAddr, transportsOf, err := resolveBindAddr(raw.BindAddr)
 	if err != nil {
 		log.Fatalf("unable to parse BindAddr: %v", err)
 	}
@@ -179,13 +248,27 @@ func main() {
 		log.Fatalf("unable to initialise server state: %v", err)
 	}
 
+	if sta.AdminAPI != nil {
+		go func() {
+			log.Infof("Admin API listening on %v", sta.AdminAPI.Addr)
+			log.Fatal(sta.AdminAPI.ListenAndServeTLS("", ""))
+		}()
+	}
+
 	listen := func(bindAddr net.Addr) {
-		listener, err := net.Listen("tcp", bindAddr.String())
-		log.Infof("Listening on %v", bindAddr)
+		listeners, err := listenOn(bindAddr)
 		if err != nil {
 			log.Fatal(err)
 		}
-		server.Serve(listener, sta)
+		transports := transportsOf[bindAddr.String()]
+		for i, listener := range listeners {
+			log.Infof("Listening on %v", listener.Addr())
+			if i != len(listeners)-1 {
+				go server.Serve(listener, sta, transports...)
+			} else {
+				server.Serve(listener, sta, transports...)
+			}
+		}
 	}
 
 	for i, addr := range bindAddr {
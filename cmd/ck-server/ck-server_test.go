@@ -4,34 +4,73 @@ import (
 	"net"
 	"testing"
 
+	"github.com/cbeuw/Cloak/internal/server"
 	"github.com/stretchr/testify/assert"
 )
 
 func TestParseBindAddr(t *testing.T) {
 	t.Run("port only", func(t *testing.T) {
-		addrs, err := resolveBindAddr([]string{":443"})
+		addrs, _, err := resolveBindAddr([]string{":443"})
 		assert.NoError(t, err)
 		assert.Equal(t, ":443", addrs[0].String())
 	})
 
 	t.Run("specific address", func(t *testing.T) {
-		addrs, err := resolveBindAddr([]string{"192.168.1.123:443"})
+		addrs, _, err := resolveBindAddr([]string{"192.168.1.123:443"})
 		assert.NoError(t, err)
 		assert.Equal(t, "192.168.1.123:443", addrs[0].String())
 	})
 
 	t.Run("ipv6", func(t *testing.T) {
-		addrs, err := resolveBindAddr([]string{"[::]:443"})
+		addrs, _, err := resolveBindAddr([]string{"[::]:443"})
 		assert.NoError(t, err)
 		assert.Equal(t, "[::]:443", addrs[0].String())
 	})
 
 	t.Run("mixed", func(t *testing.T) {
-		addrs, err := resolveBindAddr([]string{":80", "[::]:443"})
+		addrs, _, err := resolveBindAddr([]string{":80", "[::]:443"})
 		assert.NoError(t, err)
 		assert.Equal(t, ":80", addrs[0].String())
 		assert.Equal(t, "[::]:443", addrs[1].String())
 	})
+
+	t.Run("transports", func(t *testing.T) {
+		addrs, transportsOf, err := resolveBindAddr([]string{":80/websocket", ":443/tls", ":8443/tls,websocket", ":8080"})
+		assert.NoError(t, err)
+		assert.Equal(t, ":80", addrs[0].String())
+		assert.Equal(t, []server.Transport{server.WebSocket{}}, transportsOf[addrs[0].String()])
+		assert.Equal(t, []server.Transport{server.TLS{}}, transportsOf[addrs[1].String()])
+		assert.Equal(t, []server.Transport{server.TLS{}, server.WebSocket{}}, transportsOf[addrs[2].String()])
+		assert.Empty(t, transportsOf[addrs[3].String()])
+
+		_, _, err = resolveBindAddr([]string{":443/quic"})
+		assert.Error(t, err)
+	})
+
+	t.Run("unix", func(t *testing.T) {
+		addrs, transportsOf, err := resolveBindAddr([]string{"unix:/run/ck.sock", "unix/websocket:/run/ck-ws.sock",
+			"unix/tls,websocket:/run/cloak/both.sock", "unix:/run/cloak/tls"})
+		assert.NoError(t, err)
+		assert.Equal(t, &net.UnixAddr{Name: "/run/ck.sock", Net: "unix"}, addrs[0])
+		assert.Equal(t, &net.UnixAddr{Name: "/run/ck-ws.sock", Net: "unix"}, addrs[1])
+		assert.Equal(t, &net.UnixAddr{Name: "/run/cloak/both.sock", Net: "unix"}, addrs[2])
+		assert.Equal(t, &net.UnixAddr{Name: "/run/cloak/tls", Net: "unix"}, addrs[3], "a path is a path")
+		assert.Empty(t, transportsOf[addrs[0].String()])
+		assert.Equal(t, []server.Transport{server.WebSocket{}}, transportsOf[addrs[1].String()])
+		assert.Equal(t, []server.Transport{server.TLS{}, server.WebSocket{}}, transportsOf[addrs[2].String()])
+		assert.Empty(t, transportsOf[addrs[3].String()])
+
+		_, _, err = resolveBindAddr([]string{"unix/quic:/run/ck.sock"})
+		assert.Error(t, err)
+	})
+
+	t.Run("systemd", func(t *testing.T) {
+		addrs, transportsOf, err := resolveBindAddr([]string{"systemd", "systemd:https/tls"})
+		assert.NoError(t, err)
+		assert.Equal(t, systemdAddr{}, addrs[0])
+		assert.Equal(t, systemdAddr{"https"}, addrs[1])
+		assert.Equal(t, []server.Transport{server.TLS{}}, transportsOf[addrs[1].String()])
+	})
 }
 
 func assertSetEqual(t *testing.T, list1, list2 interface{}, msgAndArgs ...interface{}) (ok bool) {
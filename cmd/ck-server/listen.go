@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// listenFdsStart is the first file descriptor systemd passes sockets from
+const listenFdsStart = 3
+
+// systemdAddr stands for the sockets passed by systemd socket activation under name, or all of them if name is empty
+type systemdAddr struct {
+	name string
+}
+
+func (a systemdAddr) Network() string { return "systemd" }
+func (a systemdAddr) String() string {
+	if a.name == "" {
+		return "systemd"
+	}
+	return "systemd:" + a.name
+}
+
+// systemdSocket is a socket passed by systemd socket activation, along with its FileDescriptorName
+type systemdSocket struct {
+	fd   uintptr
+	name string
+}
+
+// systemdSockets returns the sockets systemd passed to the process with pid, as told by the LISTEN_PID, LISTEN_FDS and
+// LISTEN_FDNAMES environment variables
+func systemdSockets(getenv func(string) string, pid int) ([]systemdSocket, error) {
+	listenPid, err := strconv.Atoi(getenv("LISTEN_PID"))
+	if err != nil || listenPid != pid {
+		return nil, errors.New("no sockets passed by systemd")
+	}
+	n, err := strconv.Atoi(getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, errors.New("no sockets passed by systemd")
+	}
+	names := strings.Split(getenv("LISTEN_FDNAMES"), ":")
+	sockets := make([]systemdSocket, n)
+	for i := range sockets {
+		sockets[i].fd = uintptr(listenFdsStart + i)
+		if i < len(names) {
+			sockets[i].name = names[i]
+		}
+	}
+	return sockets, nil
+}
+
+// listenOn makes the listeners for an address in BindAddr. There can be more than one if the address is systemd's
+func listenOn(bindAddr net.Addr) ([]net.Listener, error) {
+	switch addr := bindAddr.(type) {
+	case systemdAddr:
+		sockets, err := systemdSockets(os.Getenv, os.Getpid())
+		if err != nil {
+			return nil, err
+		}
+		var listeners []net.Listener
+		for _, socket := range sockets {
+			if addr.name != "" && socket.name != addr.name {
+				continue
+			}
+			f := os.NewFile(socket.fd, socket.name)
+			listener, err := net.FileListener(f)
+			f.Close()
+			if err != nil {
+				return nil, fmt.Errorf("unable to use socket %v passed by systemd: %v", socket.fd, err)
+			}
+			listeners = append(listeners, listener)
+		}
+		if len(listeners) == 0 {
+			return nil, fmt.Errorf("no sockets named %v passed by systemd", addr.name)
+		}
+		return listeners, nil
+	case *net.UnixAddr:
+		// a socket file left behind by a previous run would stop us from binding
+		if info, err := os.Stat(addr.Name); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(addr.Name)
+		}
+		listener, err := net.Listen("unix", addr.Name)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{listener}, nil
+	default:
+		listener, err := net.Listen("tcp", bindAddr.String())
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{listener}, nil
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSystemdSockets(t *testing.T) {
+	env := func(vars map[string]string) func(string) string {
+		return func(key string) string { return vars[key] }
+	}
+
+	sockets, err := systemdSockets(env(map[string]string{
+		"LISTEN_PID":     "42",
+		"LISTEN_FDS":     "2",
+		"LISTEN_FDNAMES": "https:http",
+	}), 42)
+	assert.NoError(t, err)
+	assert.Equal(t, []systemdSocket{{3, "https"}, {4, "http"}}, sockets)
+
+	_, err = systemdSockets(env(map[string]string{"LISTEN_PID": "41", "LISTEN_FDS": "2"}), 42)
+	assert.Error(t, err, "sockets passed to another process shouldn't be used")
+
+	_, err = systemdSockets(env(map[string]string{}), 42)
+	assert.Error(t, err)
+}
+
+func TestListenOn_Unix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ck.sock")
+	addr := &net.UnixAddr{Name: path, Net: "unix"}
+
+	listeners, err := listenOn(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, listeners, 1)
+	// leave the socket file behind like a crashed process would
+	listeners[0].(*net.UnixListener).SetUnlinkOnClose(false)
+	listeners[0].Close()
+
+	listeners, err = listenOn(addr)
+	assert.NoError(t, err, "a stale socket file should be replaced")
+	defer listeners[0].Close()
+
+	go func() {
+		conn, err := listeners[0].Accept()
+		if err == nil {
+			conn.Write([]byte("hi"))
+			conn.Close()
+		}
+	}()
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	buf := make([]byte, 2)
+	_, err = conn.Read(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "hi", string(buf))
+}
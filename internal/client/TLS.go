@@ -1,11 +1,14 @@
 package client
 
 import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+
 	"github.com/cbeuw/Cloak/internal/common"
 	utls "github.com/refraction-networking/utls"
 	log "github.com/sirupsen/logrus"
-	"net"
-	"strings"
 )
 
 const appDataMaxLength = 16401
@@ -111,6 +114,42 @@ func buildClientHello(browser browser, fields clientHelloFields) ([]byte, error)
 	return uclient.HandshakeState.Hello.Raw, nil
 }
 
+// serverKeyExchange returns the first 32 bytes of the key exchange in the key_share extension of a ServerHello, which
+// carry the rest of the encrypted session key. The server puts key_share wherever its redirection target does
+func serverKeyExchange(sh []byte) (keyExchange []byte, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.New("malformed ServerHello")
+		}
+	}()
+	// handshake type, length, version and random
+	pointer := 38
+	sessionIdLen := int(sh[pointer])
+	pointer += 1 + sessionIdLen
+	// cipher suite and compression method
+	pointer += 3
+	extensionsEnd := pointer + 2 + int(binary.BigEndian.Uint16(sh[pointer:pointer+2]))
+	pointer += 2
+	for pointer < extensionsEnd {
+		typ := binary.BigEndian.Uint16(sh[pointer : pointer+2])
+		length := int(binary.BigEndian.Uint16(sh[pointer+2 : pointer+4]))
+		if pointer+4+length > len(sh) {
+			// sh is part of a larger buffer, which slicing beyond its length wouldn't stop at
+			return nil, errors.New("truncated ServerHello")
+		}
+		extension := sh[pointer+4 : pointer+4+length]
+		pointer += 4 + length
+		if typ == 0x0033 {
+			// group and key exchange length
+			if len(extension) < 36 {
+				return nil, errors.New("key_share is too short")
+			}
+			return extension[4:36], nil
+		}
+	}
+	return nil, errors.New("no key_share in ServerHello")
+}
+
 // Handshake handles the TLS handshake for a given conn and returns the sessionKey
 // if the server proceed with Cloak authentication
 func (tls *DirectTLS) Handshake(rawConn net.Conn, authInfo AuthInfo) (sessionKey [32]byte, err error) {
@@ -140,14 +179,18 @@ func (tls *DirectTLS) Handshake(rawConn net.Conn, authInfo AuthInfo) (sessionKey
 	log.Trace("client hello sent successfully")
 	tls.TLSConn = common.NewTLSConn(rawConn)
 
-	buf := make([]byte, 1024)
+	buf := make([]byte, appDataMaxLength)
 	log.Trace("waiting for ServerHello")
-	_, err = tls.Read(buf)
+	n, err := tls.Read(buf)
 	if err != nil {
 		return
 	}
 
-	encrypted := append(buf[6:38], buf[84:116]...)
+	keyExchange, err := serverKeyExchange(buf[:n])
+	if err != nil {
+		return
+	}
+	encrypted := append(buf[6:38], keyExchange...)
 	nonce := encrypted[0:12]
 	ciphertextWithTag := encrypted[12:60]
 	sessionKeySlice, err := common.AESGCMDecrypt(nonce, sharedSecret[:], ciphertextWithTag)
@@ -0,0 +1,40 @@
+package client
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerKeyExchange(t *testing.T) {
+	keyExchange := bytes.Repeat([]byte{0xab}, 32)
+	keyShare := append([]byte{0x00, 0x33, 0x00, 0x24, 0x00, 0x1d, 0x00, 0x20}, keyExchange...)
+	supportedVersions := []byte{0x00, 0x2b, 0x00, 0x02, 0x03, 0x04}
+
+	serverHello := func(extensions ...[]byte) []byte {
+		sh := append([]byte{0x02, 0x00, 0x00, 0x00, 0x03, 0x03}, make([]byte, 32)...)
+		sh = append(sh, 0x20)
+		sh = append(sh, make([]byte, 32)...)
+		sh = append(sh, 0x13, 0x01, 0x00)
+		var joined []byte
+		for _, extension := range extensions {
+			joined = append(joined, extension...)
+		}
+		sh = append(sh, byte(len(joined)>>8), byte(len(joined)))
+		return append(sh, joined...)
+	}
+
+	got, err := serverKeyExchange(serverHello(keyShare, supportedVersions))
+	assert.NoError(t, err)
+	assert.Equal(t, keyExchange, got)
+
+	got, err = serverKeyExchange(serverHello(supportedVersions, keyShare))
+	assert.NoError(t, err, "key_share should be found wherever it is")
+	assert.Equal(t, keyExchange, got)
+
+	_, err = serverKeyExchange(serverHello(supportedVersions))
+	assert.Error(t, err)
+	_, err = serverKeyExchange(serverHello(keyShare)[:100])
+	assert.Error(t, err)
+}
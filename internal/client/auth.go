@@ -9,7 +9,10 @@ import (
 )
 
 const (
-	UNORDERED_FLAG = 0x01 // 0000 0001
+	UNORDERED_FLAG       = 0x01 // 0000 0001
+	STREAM_OPEN_ACK_FLAG = 0x02 // 0000 0010
+	EXACT_MIMIC_FLAG     = 0x04 // 0000 0100
+	PING_FLAG            = 0x08 // 0000 1000
 )
 
 type authenticationPayload struct {
@@ -44,6 +47,15 @@ func makeAuthenticationPayload(authInfo AuthInfo) (ret authenticationPayload, sh
 	if authInfo.Unordered {
 		plaintext[41] |= UNORDERED_FLAG
 	}
+	if authInfo.StreamOpenAck {
+		plaintext[41] |= STREAM_OPEN_ACK_FLAG
+	}
+	if authInfo.Pings {
+		plaintext[41] |= PING_FLAG
+	}
+	// we find the key_share of the ServerHello wherever it is and read records of any length, so the server can
+	// imitate its redirection target's reply exactly
+	plaintext[41] |= EXACT_MIMIC_FLAG
 
 	secret, err := ecdh.GenerateSharedSecret(ephPv, authInfo.ServerPubKey)
 	if err != nil {
@@ -52,9 +52,9 @@ func TestMakeAuthenticationPayload(t *testing.T) {
 					0x5a, 0x53, 0xc5, 0xed, 0xaf, 0xdb, 0x10, 0x98,
 					0x83, 0x96, 0x81, 0xa6, 0xfc, 0xa2, 0x1e, 0xb0,
 					0x89, 0xb2, 0x29, 0x71, 0x7e, 0x45, 0x97, 0x54,
-					0x11, 0x7d, 0x9b, 0x92, 0xbb, 0xd6, 0xce, 0x37,
-					0x3b, 0xb8, 0x8b, 0xfb, 0xb6, 0x40, 0xf0, 0x2c,
-					0x6c, 0x55, 0xb9, 0xfc, 0x5d, 0x34, 0x89, 0x41},
+					0x11, 0x79, 0x9b, 0x92, 0xbb, 0xd6, 0xce, 0x37,
+					0x31, 0xdf, 0xe6, 0x40, 0x42, 0x7f, 0x8d, 0x53,
+					0x34, 0x0a, 0x41, 0xf0, 0x6b, 0x30, 0x74, 0x7a},
 			},
 			[32]byte{
 				0xc7, 0xc6, 0x9b, 0xbe, 0xec, 0xf8, 0x35, 0x55,
@@ -70,6 +70,8 @@ func MakeSession(connConfig RemoteConnConfig, authInfo AuthInfo, dialer common.D
 		Valve:              nil,
 		Unordered:          authInfo.Unordered,
 		MsgOnWireSizeLimit: appDataMaxLength,
+		KeepAliveInterval:  connConfig.PingInterval,
+		KeepAliveTimeout:   connConfig.PingTimeout,
 	}
 	sesh := mux.MakeSession(authInfo.SessionId, seshConfig)
 
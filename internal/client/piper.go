@@ -1,6 +1,7 @@
 package client
 
 import (
+	"errors"
 	"io"
 	"net"
 	"sync"
@@ -12,6 +13,21 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+// SharedSession returns a function that hands out the same session made by newSeshFunc to all its callers, making a
+// new one only once it's closed. It lets the streams of several listeners share a session
+func SharedSession(newSeshFunc func() *mux.Session) func() *mux.Session {
+	var seshM sync.Mutex
+	var sesh *mux.Session
+	return func() *mux.Session {
+		seshM.Lock()
+		defer seshM.Unlock()
+		if sesh == nil || sesh.IsClosed() {
+			sesh = newSeshFunc()
+		}
+		return sesh
+	}
+}
+
 func RouteUDP(bindFunc func() (*net.UDPConn, error), streamTimeout time.Duration, singleplex bool, newSeshFunc func() *mux.Session) {
 	var sesh *mux.Session
 	localConn, err := bindFunc()
@@ -95,7 +111,9 @@ func RouteUDP(bindFunc func() (*net.UDPConn, error), streamTimeout time.Duration
 	}
 }
 
-func RouteTCP(listener net.Listener, streamTimeout time.Duration, singleplex bool, newSeshFunc func() *mux.Session) {
+// RouteTCP accepts connections from listener and pipes each of them through a new stream. Streams are given
+// streamWeight, so that the traffic of different listeners sharing a session can be prioritised against each other
+func RouteTCP(listener net.Listener, streamTimeout time.Duration, streamWeight uint8, singleplex bool, newSeshFunc func() *mux.Session) {
 	var sesh *mux.Session
 	for {
 		localConn, err := listener.Accept()
@@ -131,6 +149,7 @@ func RouteTCP(listener net.Listener, streamTimeout time.Duration, singleplex boo
 				}
 				return
 			}
+			stream.SetWeight(streamWeight)
 
 			_, err = stream.Write(data[:i])
 			if err != nil {
@@ -140,13 +159,15 @@ func RouteTCP(listener net.Listener, streamTimeout time.Duration, singleplex boo
 				return
 			}
 
-			go func() {
-				if _, err := common.Copy(localConn, stream); err != nil {
-					log.Tracef("copying stream to proxy client: %v", err)
-				}
-			}()
-			if _, err = common.Copy(stream, localConn); err != nil {
-				log.Tracef("copying proxy client to stream: %v", err)
+			errToStream, errFromStream := common.CopyBidirectional(localConn, stream, streamTimeout)
+			if errToStream != nil {
+				log.Tracef("copying proxy client to stream: %v", errToStream)
+			}
+			var openErr mux.StreamOpenError
+			if errors.As(errFromStream, &openErr) {
+				log.Warnf("Server failed to connect to proxy server: %v", openErr)
+			} else if errFromStream != nil {
+				log.Tracef("copying stream to proxy client: %v", errFromStream)
 			}
 		}(sesh, localConn, streamTimeout)
 	}
@@ -0,0 +1,25 @@
+package client
+
+import (
+	"testing"
+
+	mux "github.com/cbeuw/Cloak/internal/multiplex"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSharedSession(t *testing.T) {
+	obfuscator, _ := mux.MakeObfuscator(mux.EncryptionMethodPlain, [32]byte{})
+	made := 0
+	shared := SharedSession(func() *mux.Session {
+		made++
+		return mux.MakeSession(uint32(made), mux.SessionConfig{Obfuscator: obfuscator})
+	})
+
+	sesh := shared()
+	assert.Same(t, sesh, shared(), "callers should get the same session")
+	assert.Equal(t, 1, made)
+
+	sesh.Close()
+	assert.NotSame(t, sesh, shared(), "a closed session should be replaced")
+	assert.Equal(t, 2, made)
+}
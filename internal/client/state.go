@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net"
+	"strconv"
 	"strings"
 	"time"
 
@@ -40,6 +41,13 @@ type RawConfig struct {
 	CDNWsUrlPath  string // nullable
 	StreamTimeout int    // nullable
 	KeepAlive     int    // nullable
+	PingInterval  int    // nullable
+	PingTimeout   int    // nullable
+	StreamWeight  int    // nullable
+	// ExtraLocalPorts are more ports to listen on alongside LocalPort, each with the StreamWeight of the connections
+	// made to it. Connections on all the ports share the same session, where weights prioritise them against each
+	// other. In plugin options it's written as port:weight pairs separated by commas
+	ExtraLocalPorts map[string]int // nullable
 }
 
 type RemoteConnConfig struct {
@@ -48,12 +56,19 @@ type RemoteConnConfig struct {
 	KeepAlive  time.Duration
 	RemoteAddr string
 	Transport  TransportConfig
+	// PingInterval and PingTimeout are passed to the session's KeepAliveInterval and KeepAliveTimeout
+	PingInterval time.Duration
+	PingTimeout  time.Duration
 }
 
 type LocalConnConfig struct {
 	LocalAddr      string
 	Timeout        time.Duration
 	MockDomainList []string
+	// StreamWeight is the weight of the streams of connections to LocalAddr
+	StreamWeight uint8
+	// ExtraLocalAddrs are more addresses to listen on, mapped to the weight of the streams of connections to them
+	ExtraLocalAddrs map[string]uint8
 }
 
 type AuthInfo struct {
@@ -62,6 +77,8 @@ type AuthInfo struct {
 	ProxyMethod      string
 	EncryptionMethod byte
 	Unordered        bool
+	StreamOpenAck    bool
+	Pings            bool
 	ServerPubKey     crypto.PublicKey
 	MockDomain       string
 	WorldState       common.WorldState
@@ -83,7 +100,7 @@ func ssvToJson(ssv string) (ret []byte) {
 		r = strings.Replace(r, `\;`, `;`, -1)
 		return r
 	}
-	unquoted := []string{"NumConn", "StreamTimeout", "KeepAlive", "UDP"}
+	unquoted := []string{"NumConn", "StreamTimeout", "KeepAlive", "PingInterval", "PingTimeout", "StreamWeight", "UDP"}
 	lines := strings.Split(unescape(ssv), ";")
 	ret = []byte("{")
 	for _, ln := range lines {
@@ -111,6 +128,24 @@ func ssvToJson(ssv string) (ret []byte) {
 			}
 			continue
 		}
+		if key == "ExtraLocalPorts" {
+			var pairs []string
+			for _, pair := range strings.Split(value, ",") {
+				sp := strings.SplitN(pair, ":", 2)
+				if len(sp) < 2 {
+					log.Errorf("Malformed ExtraLocalPorts entry: %v", pair)
+					continue
+				}
+				weight, err := strconv.Atoi(sp[1])
+				if err != nil {
+					log.Errorf("Malformed ExtraLocalPorts entry: %v", pair)
+					continue
+				}
+				pairs = append(pairs, `"`+sp[0]+`":`+strconv.Itoa(weight))
+			}
+			ret = append(ret, []byte(`"`+key+`":{`+strings.Join(pairs, ",")+`},`)...)
+			continue
+		}
 		// JSON doesn't like quotation marks around int and bool
 		// This is extremely ugly but it's still better than writing a tokeniser
 		if elem(key, unquoted) {
@@ -152,6 +187,8 @@ func (raw *RawConfig) ProcessRawConfig(worldState common.WorldState) (local Loca
 
 	auth.UID = raw.UID
 	auth.Unordered = raw.UDP
+	// we always understand the server telling us that it failed to open a stream
+	auth.StreamOpenAck = true
 	if raw.ServerName == "" {
 		return nullErr("ServerName")
 	}
@@ -261,6 +298,15 @@ func (raw *RawConfig) ProcessRawConfig(worldState common.WorldState) (local Loca
 		remote.KeepAlive = remote.KeepAlive * time.Second
 	}
 
+	// Pings through the multiplexing layer. PingTimeout defaults to a multiple of PingInterval in mux.MakeSession
+	if raw.PingInterval > 0 {
+		auth.Pings = true
+		remote.PingInterval = time.Duration(raw.PingInterval) * time.Second
+		if raw.PingTimeout > 0 {
+			remote.PingTimeout = time.Duration(raw.PingTimeout) * time.Second
+		}
+	}
+
 	if raw.LocalHost == "" {
 		return nullErr("LocalHost")
 	}
@@ -268,6 +314,27 @@ func (raw *RawConfig) ProcessRawConfig(worldState common.WorldState) (local Loca
 		return nullErr("LocalPort")
 	}
 	local.LocalAddr = net.JoinHostPort(raw.LocalHost, raw.LocalPort)
+	local.StreamWeight, err = parseStreamWeight(raw.StreamWeight)
+	if err != nil {
+		return
+	}
+	if len(raw.ExtraLocalPorts) > 0 {
+		if raw.UDP {
+			err = fmt.Errorf("ExtraLocalPorts cannot be used with UDP")
+			return
+		}
+		local.ExtraLocalAddrs = make(map[string]uint8)
+		for port, weight := range raw.ExtraLocalPorts {
+			if port == "" || port == raw.LocalPort {
+				err = fmt.Errorf("invalid extra local port %q", port)
+				return
+			}
+			local.ExtraLocalAddrs[net.JoinHostPort(raw.LocalHost, port)], err = parseStreamWeight(weight)
+			if err != nil {
+				return
+			}
+		}
+	}
 	// stream no write timeout
 	if raw.StreamTimeout == 0 {
 		local.Timeout = 300 * time.Second
@@ -277,3 +344,12 @@ func (raw *RawConfig) ProcessRawConfig(worldState common.WorldState) (local Loca
 
 	return
 }
+
+// parseStreamWeight checks a stream weight from the config. Zero is left as it is, which mux.Stream.SetWeight takes
+// as mux.DefaultStreamWeight
+func parseStreamWeight(weight int) (uint8, error) {
+	if weight < 0 || weight > 255 {
+		return 0, fmt.Errorf("stream weight %v is out of range 1-255", weight)
+	}
+	return uint8(weight), nil
+}
@@ -3,7 +3,9 @@ package client
 import (
 	"io/ioutil"
 	"testing"
+	"time"
 
+	"github.com/cbeuw/Cloak/internal/common"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -28,6 +30,17 @@ func TestParseConfig(t *testing.T) {
 		assert.Equal(t, parsedFromJson, parsedFromSSV)
 	})
 
+	t.Run("ExtraLocalPorts", func(t *testing.T) {
+		parsed, err := ParseConfig(ssv + ";ExtraLocalPorts=1985:255,8080:8;StreamWeight=4")
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]int{"1985": 255, "8080": 8}, parsed.ExtraLocalPorts)
+		assert.Equal(t, 4, parsed.StreamWeight)
+
+		parsed, err = ParseConfig(ssv + ";ExtraLocalPorts=1985:255,8080;")
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]int{"1985": 255}, parsed.ExtraLocalPorts, "malformed entries should be left out")
+	})
+
 	t.Run("empty file", func(t *testing.T) {
 		tmpConfig, _ := ioutil.TempFile("", "ck_client_config")
 		_, err := ParseConfig(tmpConfig.Name())
@@ -35,3 +48,52 @@ func TestParseConfig(t *testing.T) {
 	})
 
 }
+
+func TestProcessRawConfig_StreamWeight(t *testing.T) {
+	raw := func() *RawConfig {
+		return &RawConfig{
+			ServerName:       "www.bing.com",
+			ProxyMethod:      "shadowsocks",
+			EncryptionMethod: "plain",
+			UID:              make([]byte, 16),
+			PublicKey:        make([]byte, 32),
+			RemoteHost:       "127.0.0.1",
+			RemotePort:       "443",
+			LocalHost:        "127.0.0.1",
+			LocalPort:        "1984",
+		}
+	}
+
+	local, _, _, err := raw().ProcessRawConfig(common.WorldOfTime(time.Now()))
+	assert.NoError(t, err)
+	assert.EqualValues(t, 0, local.StreamWeight, "zero should be left to the stream's default")
+	assert.Empty(t, local.ExtraLocalAddrs)
+
+	conf := raw()
+	conf.StreamWeight = 4
+	conf.ExtraLocalPorts = map[string]int{"1985": 255, "1986": 0}
+	local, _, _, err = conf.ProcessRawConfig(common.WorldOfTime(time.Now()))
+	assert.NoError(t, err)
+	assert.EqualValues(t, 4, local.StreamWeight)
+	assert.Equal(t, map[string]uint8{"127.0.0.1:1985": 255, "127.0.0.1:1986": 0}, local.ExtraLocalAddrs)
+
+	for name, modify := range map[string]func(*RawConfig){
+		"negative weight":         func(c *RawConfig) { c.StreamWeight = -1 },
+		"weight too large":        func(c *RawConfig) { c.StreamWeight = 256 },
+		"extra weight too large":  func(c *RawConfig) { c.ExtraLocalPorts = map[string]int{"1985": 256} },
+		"extra port is LocalPort": func(c *RawConfig) { c.ExtraLocalPorts = map[string]int{"1984": 32} },
+		"extra ports with UDP": func(c *RawConfig) {
+			c.UDP = true
+			c.ExtraLocalPorts = map[string]int{"1985": 32}
+		},
+	} {
+		conf := raw()
+		modify(conf)
+		_, _, _, err = conf.ProcessRawConfig(common.WorldOfTime(time.Now()))
+		assert.Error(t, err, name)
+	}
+
+	parsed, err := ParseConfig("ServerName=www.bing.com;StreamWeight=64")
+	assert.NoError(t, err)
+	assert.Equal(t, 64, parsed.StreamWeight)
+}
@@ -35,11 +35,86 @@ package common
 import (
 	"io"
 	"net"
+	"sync/atomic"
+	"time"
 )
 
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// Copy copies from src to dst until either EOF is reached on src or an error occurs. On EOF, if dst supports
+// half-closing (i.e. it has a CloseWrite method like *net.TCPConn and *multiplex.Stream do), only its writing side
+// is closed, so that the other direction can carry on. The caller is then responsible for closing both conns once
+// the other direction is done too. Otherwise both conns are closed before Copy returns.
 func Copy(dst net.Conn, src net.Conn) (written int64, err error) {
-	defer func() { src.Close(); dst.Close() }()
+	written, err = copyConn(dst, src)
+	if err == io.EOF {
+		err = nil
+	}
+	if err == nil {
+		if cw, ok := dst.(closeWriter); ok {
+			if cw.CloseWrite() == nil {
+				return
+			}
+		}
+	}
+	src.Close()
+	dst.Close()
+	return
+}
+
+// DefaultHalfCloseTimeout is how long a direction of CopyBidirectional is kept going without anything being read
+// once the other direction is done
+const DefaultHalfCloseTimeout = 300 * time.Second
+
+// CopyBidirectional copies between a and b in both directions, with half-closes propagated by Copy, and closes
+// both conns once both directions are done. Once either direction is done, the other one times out if nothing is read
+// for halfCloseTimeout, so that a peer that half-closes and then goes quiet doesn't keep the conns open forever. A
+// halfCloseTimeout of 0 leaves it going. It returns the errors from copying a to b and b to a respectively
+func CopyBidirectional(a net.Conn, b net.Conn, halfCloseTimeout time.Duration) (errAToB error, errBToA error) {
+	srcA, srcB := a, b
+	lingering := &atomic.Bool{}
+	if halfCloseTimeout > 0 {
+		srcA = &lingerConn{a, halfCloseTimeout, lingering}
+		srcB = &lingerConn{b, halfCloseTimeout, lingering}
+	}
+	linger := func(remaining net.Conn) {
+		if halfCloseTimeout > 0 && !lingering.Swap(true) {
+			// the remaining direction may already be blocked in a Read without a deadline
+			remaining.SetReadDeadline(time.Now().Add(halfCloseTimeout))
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		_, errBToA = Copy(a, srcB)
+		linger(a)
+		close(done)
+	}()
+	_, errAToB = Copy(b, srcA)
+	linger(b)
+	<-done
+	a.Close()
+	b.Close()
+	return
+}
+
+// lingerConn times out Reads after timeout of inactivity once lingering is set
+type lingerConn struct {
+	net.Conn
+	timeout   time.Duration
+	lingering *atomic.Bool
+}
+
+func (c *lingerConn) Read(b []byte) (int, error) {
+	if c.lingering.Load() {
+		c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+	}
+	return c.Conn.Read(b)
+}
 
+func copyConn(dst net.Conn, src net.Conn) (written int64, err error) {
 	// If the reader has a WriteTo method, use it to do the copy.
 	// Avoids an allocation and a copy.
 	if wt, ok := src.(io.WriterTo); ok {
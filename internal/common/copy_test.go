@@ -0,0 +1,86 @@
+package common
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn)
+	go func() {
+		conn, _ := l.Accept()
+		accepted <- conn
+	}()
+	dialed, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dialed, <-accepted
+}
+
+func TestCopyBidirectional_HalfClose(t *testing.T) {
+	// client <-> (clientSide, upstreamSide) <-> upstream
+	client, clientSide := tcpPair(t)
+	upstreamSide, upstream := tcpPair(t)
+
+	done := make(chan struct{})
+	go func() {
+		errAToB, errBToA := CopyBidirectional(clientSide, upstreamSide, 0)
+		assert.NoError(t, errAToB)
+		assert.NoError(t, errBToA)
+		close(done)
+	}()
+
+	_, err := client.Write([]byte("request"))
+	assert.NoError(t, err)
+	assert.NoError(t, client.(*net.TCPConn).CloseWrite())
+
+	// upstream sees EOF after the request, but can still reply
+	request, err := io.ReadAll(upstream)
+	assert.NoError(t, err)
+	assert.Equal(t, "request", string(request))
+	_, err = upstream.Write([]byte("response"))
+	assert.NoError(t, err)
+	upstream.Close()
+
+	response, err := io.ReadAll(client)
+	assert.NoError(t, err)
+	assert.Equal(t, "response", string(response))
+	<-done
+}
+
+func TestCopyBidirectional_HalfCloseTimeout(t *testing.T) {
+	client, clientSide := tcpPair(t)
+	upstreamSide, upstream := tcpPair(t)
+	defer upstream.Close()
+
+	done := make(chan error)
+	go func() {
+		_, errBToA := CopyBidirectional(clientSide, upstreamSide, 200*time.Millisecond)
+		done <- errBToA
+	}()
+
+	// the client half-closes, and upstream never replies nor closes
+	assert.NoError(t, client.(*net.TCPConn).CloseWrite())
+	_, err := io.ReadAll(upstream)
+	assert.NoError(t, err)
+
+	select {
+	case err := <-done:
+		assert.Error(t, err, "the remaining direction should time out")
+	case <-time.After(3 * time.Second):
+		t.Fatal("CopyBidirectional didn't return after the half-close timeout")
+	}
+	// the client sees its conn closed
+	_, err = io.ReadAll(client)
+	assert.NoError(t, err)
+}
@@ -66,12 +66,14 @@ func (d *datagramBufferedPipe) Read(target []byte) (int, error) {
 	return dataLen, nil
 }
 
-func (d *datagramBufferedPipe) Write(f *Frame) (toBeClosed bool, err error) {
+// Write takes a frame. As datagrams can arrive out of order, half-closing isn't supported and any closing frame
+// closes the stream entirely
+func (d *datagramBufferedPipe) Write(f *Frame) (closing uint8, err error) {
 	d.rwCond.L.Lock()
 	defer d.rwCond.L.Unlock()
 	for {
 		if d.closed {
-			return true, io.ErrClosedPipe
+			return closingStream, io.ErrClosedPipe
 		}
 		if d.buf.Len() <= recvBufferSizeLimit {
 			// if d.buf gets too large, write() will panic. We don't want this to happen
@@ -80,10 +82,15 @@ func (d *datagramBufferedPipe) Write(f *Frame) (toBeClosed bool, err error) {
 		d.rwCond.Wait()
 	}
 
+	if f.Closing == streamOpenAck {
+		// a successful open carries no data
+		return closingNothing, nil
+	}
+
 	if f.Closing != closingNothing {
 		d.closed = true
 		d.rwCond.Broadcast()
-		return true, nil
+		return closingStream, nil
 	}
 
 	dataLen := len(f.Payload)
@@ -91,7 +98,7 @@ func (d *datagramBufferedPipe) Write(f *Frame) (toBeClosed bool, err error) {
 	d.buf.Write(f.Payload)
 	// err will always be nil
 	d.rwCond.Broadcast()
-	return false, nil
+	return closingNothing, nil
 }
 
 func (d *datagramBufferedPipe) Close() error {
@@ -28,9 +28,9 @@ func TestDatagramBuffer_RW(t *testing.T) {
 
 	t.Run("writing closing frame", func(t *testing.T) {
 		pipe := NewDatagramBufferedPipe()
-		toBeClosed, err := pipe.Write(&Frame{Closing: closingStream})
+		closing, err := pipe.Write(&Frame{Closing: closingStream})
 		assert.NoError(t, err)
-		assert.True(t, toBeClosed, "should be to be closed")
+		assert.EqualValues(t, closingStream, closing, "should be to be closed")
 		assert.True(t, pipe.closed, "pipe should be closed")
 	})
 }
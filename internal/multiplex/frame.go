@@ -4,11 +4,48 @@ const (
 	closingNothing = iota
 	closingStream
 	closingSession
+	// ping and pong are control frames addressed to the session, they are never delivered to a stream
+	pingFrame
+	pongFrame
+	// closingStreamWrite tells the remote that no more data will be sent on a stream, while the stream can still
+	// receive data. It's sequenced like a data frame so that it arrives after all the data sent before it
+	closingStreamWrite
+	// streamOpenAck is sent by the accepting end of a stream, before any data, to tell the opening end whether the
+	// stream could be connected to its destination. The first byte of its payload is a StreamOpenError, or 0 on
+	// success
+	streamOpenAck
 )
 
+// controlStreamID is the stream id used by frames addressed to the session itself rather than to a stream.
+// No real stream will ever be assigned this id
+const controlStreamID = 0xffffffff
+
 type Frame struct {
 	StreamID uint32
 	Seq      uint64
 	Closing  uint8
 	Payload  []byte
 }
+
+// StreamOpenError is the reason the accepting end of a stream gives for failing to connect it to its destination
+type StreamOpenError uint8
+
+const (
+	StreamOpenErrGeneric StreamOpenError = iota + 1
+	StreamOpenErrRefused
+	StreamOpenErrUnreachable
+	StreamOpenErrTimeout
+)
+
+func (e StreamOpenError) Error() string {
+	switch e {
+	case StreamOpenErrRefused:
+		return "remote destination refused connection"
+	case StreamOpenErrUnreachable:
+		return "remote destination unreachable"
+	case StreamOpenErrTimeout:
+		return "timed out connecting to remote destination"
+	default:
+		return "remote failed to connect to destination"
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"net"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/cbeuw/Cloak/internal/common"
 	"github.com/cbeuw/connutil"
@@ -148,3 +149,71 @@ func TestMux_StreamClosing(t *testing.T) {
 	assert.NoError(t, err, "can't read residual data on stream")
 	assert.Equal(t, testData, recvBuf, "incorrect data read back")
 }
+
+func TestMux_StreamCloseWrite(t *testing.T) {
+	clientSession, serverSession, _ := makeSessionPair(1)
+
+	request := []byte("request")
+	response := []byte("response")
+
+	clientStream, _ := clientSession.OpenStream()
+	_, err := clientStream.Write(request)
+	assert.NoError(t, err)
+	assert.NoError(t, clientStream.CloseWrite())
+
+	_, err = clientStream.Write(request)
+	assert.Equal(t, ErrBrokenStream, err, "writing after CloseWrite")
+
+	serverStream, err := serverSession.Accept()
+	assert.NoError(t, err)
+	received, err := io.ReadAll(serverStream)
+	assert.NoError(t, err, "the remote should read a clean EOF")
+	assert.Equal(t, request, received)
+
+	// the other direction still works after the client has half-closed
+	_, err = serverStream.Write(response)
+	assert.NoError(t, err)
+	assert.NoError(t, serverStream.(*Stream).CloseWrite())
+
+	received, err = io.ReadAll(clientStream)
+	assert.NoError(t, err)
+	assert.Equal(t, response, received)
+
+	assert.Eventually(t, func() bool {
+		return clientSession.streamCount() == 0 && serverSession.streamCount() == 0
+	}, time.Second, 10*time.Millisecond, "streams not closed after both sides have half-closed")
+	assert.NoError(t, clientStream.Close(), "closing a stream that's already been closed by half-closes")
+}
+
+func TestMux_StreamOpenAck(t *testing.T) {
+	clientSession, serverSession, _ := makeSessionPair(1)
+	serverSession.StreamOpenAck = true
+
+	rejected, _ := clientSession.OpenStream()
+	_, err := rejected.Write([]byte("to be rejected"))
+	assert.NoError(t, err)
+	accepted, _ := clientSession.OpenStream()
+	_, err = accepted.Write([]byte("to be accepted"))
+	assert.NoError(t, err)
+
+	serverRejected, err := serverSession.Accept()
+	assert.NoError(t, err)
+	assert.NoError(t, serverRejected.(*Stream).AckOpen(StreamOpenErrRefused))
+	serverAccepted, err := serverSession.Accept()
+	assert.NoError(t, err)
+	assert.NoError(t, serverAccepted.(*Stream).AckOpen(nil))
+
+	_, err = rejected.Read(make([]byte, 16))
+	assert.Equal(t, StreamOpenErrRefused, err, "the reason for rejection should be passed on")
+
+	_, err = serverAccepted.Write([]byte("response"))
+	assert.NoError(t, err)
+	buf := make([]byte, 16)
+	n, err := accepted.Read(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("response"), buf[:n], "data after a successful ack")
+	assert.False(t, clientSession.IsClosed(), "a rejected stream shouldn't affect the session")
+	assert.Eventually(t, func() bool {
+		return clientSession.streamCount() == 1 && serverSession.streamCount() == 1
+	}, time.Second, 10*time.Millisecond, "only the rejected stream should be closed")
+}
@@ -1,7 +1,9 @@
 package multiplex
 
 import (
+	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/juju/ratelimit"
 )
@@ -13,8 +15,14 @@ type LimitedValve struct {
 	// rx is from client to server, tx is from server to client
 	// DO NOT use terms up or down as this is used in usermanager
 	// for bandwidth limiting
-	rxtb *ratelimit.Bucket
-	txtb *ratelimit.Bucket
+	// buckets are swapped rather than adjusted when rates change, as ratelimit.Bucket can't be adjusted
+	rxtb atomic.Pointer[ratelimit.Bucket]
+	txtb atomic.Pointer[ratelimit.Bucket]
+	// ratesM guards the rates the buckets were made with, which are kept as the buckets only have approximations of
+	// them
+	ratesM sync.Mutex
+	rxRate int64
+	txRate int64
 
 	rx *int64
 	tx *int64
@@ -25,18 +33,48 @@ type UnlimitedValve struct{}
 func MakeValve(rxRate, txRate int64) *LimitedValve {
 	var rx, tx int64
 	v := &LimitedValve{
-		rxtb: ratelimit.NewBucketWithRate(float64(rxRate), rxRate),
-		txtb: ratelimit.NewBucketWithRate(float64(txRate), txRate),
-		rx:   &rx,
-		tx:   &tx,
+		rx: &rx,
+		tx: &tx,
 	}
+	v.SetRates(rxRate, txRate)
 	return v
 }
 
+// SetRates changes the rate limits of a valve in use. Waits already started aren't affected
+func (v *LimitedValve) SetRates(rxRate, txRate int64) {
+	v.ratesM.Lock()
+	defer v.ratesM.Unlock()
+	if v.rxtb.Load() == nil || v.rxRate != rxRate {
+		v.rxtb.Store(ratelimit.NewBucketWithRate(float64(rxRate), rxRate))
+		v.rxRate = rxRate
+	}
+	if v.txtb.Load() == nil || v.txRate != txRate {
+		v.txtb.Store(ratelimit.NewBucketWithRate(float64(txRate), txRate))
+		v.txRate = txRate
+	}
+}
+
 var UNLIMITED_VALVE = &UnlimitedValve{}
 
-func (v *LimitedValve) rxWait(n int)  { v.rxtb.Wait(int64(n)) }
-func (v *LimitedValve) txWait(n int)  { v.txtb.Wait(int64(n)) }
+func (v *LimitedValve) rxWait(n int) { v.rxtb.Load().Wait(int64(n)) }
+
+// txWait waits until n bytes can be sent, or until cancel is closed, in which case ErrTimeout is returned.
+// The tokens of a cancelled wait are not returned to the bucket
+func (v *LimitedValve) txWait(n int, cancel <-chan struct{}) error {
+	d := v.txtb.Load().Take(int64(n))
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-cancel:
+		return ErrTimeout
+	}
+}
+
 func (v *LimitedValve) AddRx(n int64) { atomic.AddInt64(v.rx, n) }
 func (v *LimitedValve) AddTx(n int64) { atomic.AddInt64(v.tx, n) }
 func (v *LimitedValve) GetRx() int64  { return atomic.LoadInt64(v.rx) }
@@ -48,19 +86,22 @@ func (v *LimitedValve) Nullify() (int64, int64) {
 }
 
 func (v *UnlimitedValve) rxWait(n int)            {}
-func (v *UnlimitedValve) txWait(n int)            {}
 func (v *UnlimitedValve) AddRx(n int64)           {}
 func (v *UnlimitedValve) AddTx(n int64)           {}
 func (v *UnlimitedValve) GetRx() int64            { return 0 }
 func (v *UnlimitedValve) GetTx() int64            { return 0 }
 func (v *UnlimitedValve) Nullify() (int64, int64) { return 0, 0 }
+func (v *UnlimitedValve) SetRates(int64, int64)   {}
+
+func (v *UnlimitedValve) txWait(n int, cancel <-chan struct{}) error { return nil }
 
 type Valve interface {
 	rxWait(n int)
-	txWait(n int)
+	txWait(n int, cancel <-chan struct{}) error
 	AddRx(n int64)
 	AddTx(n int64)
 	GetRx() int64
 	GetTx() int64
 	Nullify() (int64, int64)
+	SetRates(rxRate, txRate int64)
 }
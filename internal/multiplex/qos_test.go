@@ -0,0 +1,28 @@
+package multiplex
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLimitedValve_SetRates(t *testing.T) {
+	v := MakeValve(10, 100)
+	rxtb := v.rxtb.Load()
+	v.AddRx(5)
+
+	v.SetRates(10, 200)
+	assert.Same(t, rxtb, v.rxtb.Load(), "an unchanged rate should keep its bucket")
+	assert.EqualValues(t, 200, v.txtb.Load().Rate())
+	assert.EqualValues(t, 200, v.txtb.Load().Capacity())
+	assert.EqualValues(t, 5, v.GetRx(), "usage should be kept")
+
+	// the buckets only approximate these rates, which mustn't be taken for a change
+	for _, rate := range []int64{3000000, 12345678, 5 << 20} {
+		v.SetRates(rate, rate)
+		rxtb, txtb := v.rxtb.Load(), v.txtb.Load()
+		v.SetRates(rate, rate)
+		assert.Same(t, rxtb, v.rxtb.Load(), "rate %v shouldn't get a new bucket", rate)
+		assert.Same(t, txtb, v.txtb.Load(), "rate %v shouldn't get a new bucket", rate)
+	}
+}
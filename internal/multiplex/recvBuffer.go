@@ -1,12 +1,13 @@
 package multiplex
 
 import (
-	"errors"
 	"io"
+	"os"
 	"time"
 )
 
-var ErrTimeout = errors.New("deadline exceeded")
+// ErrTimeout is returned by Stream's Read and Write calls when their deadline is exceeded. It implements net.Error
+var ErrTimeout = os.ErrDeadlineExceeded
 
 type recvBuffer interface {
 	// Read calls' err must be nil | io.EOF | io.ErrShortBuffer
@@ -14,7 +15,10 @@ type recvBuffer interface {
 	// Instead, it should behave as if it hasn't been closed. Closure is only relevant
 	// when the buffer is empty.
 	io.ReadCloser
-	Write(*Frame) (toBeClosed bool, err error)
+	// Write takes a frame received from remote. If this results in a closing frame being delivered (i.e. it is
+	// next in sequence), it returns the type of that closing frame, otherwise closingNothing. Once a
+	// closingStreamWrite is delivered, Read returns io.EOF after the remaining data is read
+	Write(*Frame) (closing uint8, err error)
 	SetReadDeadline(time time.Time)
 }
 
@@ -0,0 +1,153 @@
+package multiplex
+
+import (
+	"container/heap"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// DefaultStreamWeight is the weight a stream starts with
+	DefaultStreamWeight = 16
+	// the cost of a frame in virtual time is its length scaled by maxStreamWeight/weight
+	maxStreamWeight = 256
+)
+
+// flow is the scheduling state of a stream
+type flow struct {
+	// atomic
+	weight uint32
+	// virtual finish time of the last frame of this flow. Guarded by scheduler.mu
+	finish uint64
+}
+
+func (f *flow) setWeight(weight uint8) {
+	if weight == 0 {
+		weight = DefaultStreamWeight
+	}
+	atomic.StoreUint32(&f.weight, uint32(weight))
+}
+
+type sendRequest struct {
+	start  uint64
+	finish uint64
+	// arrival order, to break ties between requests with the same finish time
+	order uint64
+	ready chan struct{}
+	// index in the heap, or -1 once it's been granted
+	index int
+}
+
+type requestHeap []*sendRequest
+
+func (h requestHeap) Len() int { return len(h) }
+func (h requestHeap) Less(i, j int) bool {
+	if h[i].finish == h[j].finish {
+		return h[i].order < h[j].order
+	}
+	return h[i].finish < h[j].finish
+}
+func (h requestHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *requestHeap) Push(x interface{}) {
+	req := x.(*sendRequest)
+	req.index = len(*h)
+	*h = append(*h, req)
+}
+
+func (h *requestHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	req := old[n-1]
+	old[n-1] = nil
+	req.index = -1
+	*h = old[0 : n-1]
+	return req
+}
+
+// scheduler decides which stream gets to send next when several streams of a session are sending at the same time.
+// It does weighted fair queueing: each frame is tagged with the virtual time at which it would finish if every
+// waiting stream were served at the same time in proportion to their weights, and frames are sent in the order of
+// their tags. A stream that has been quiet (e.g. interactive traffic) therefore gets its next frame out ahead of
+// the backlog of a bulk stream.
+//
+// Up to slots() frames can be in flight at once, so that sends through different underlying connections can still
+// happen in parallel. A frame holds its slot while waiting for the Valve, so the Valve's rate limit is shared
+// between streams in the same fair order.
+type scheduler struct {
+	mu       sync.Mutex
+	slots    func() int
+	inFlight int
+	vtime    uint64
+	arrivals uint64
+	waiting  requestHeap
+}
+
+func makeScheduler(slots func() int) *scheduler {
+	return &scheduler{slots: slots}
+}
+
+// acquire blocks until a frame of length n from f can be sent. If cancel is closed before then, ErrTimeout is
+// returned. Otherwise release must be called once the frame has been sent
+func (sc *scheduler) acquire(f *flow, n int, cancel <-chan struct{}) error {
+	sc.mu.Lock()
+	prevFinish := f.finish
+	start := sc.vtime
+	if f.finish > start {
+		start = f.finish
+	}
+	weight := uint64(atomic.LoadUint32(&f.weight))
+	f.finish = start + uint64(n)*maxStreamWeight/weight
+
+	if len(sc.waiting) == 0 && sc.inFlight < sc.slots() {
+		sc.inFlight++
+		sc.vtime = start
+		sc.mu.Unlock()
+		return nil
+	}
+
+	req := &sendRequest{
+		start:  start,
+		finish: f.finish,
+		order:  sc.arrivals,
+		ready:  make(chan struct{}),
+	}
+	sc.arrivals++
+	heap.Push(&sc.waiting, req)
+	sc.mu.Unlock()
+
+	select {
+	case <-req.ready:
+		return nil
+	case <-cancel:
+		sc.mu.Lock()
+		defer sc.mu.Unlock()
+		if req.index == -1 {
+			// we've been handed a slot just as we were cancelled, so we might as well use it
+			return nil
+		}
+		heap.Remove(&sc.waiting, req.index)
+		// the frame will never be sent, so the flow shouldn't be charged for it
+		f.finish = prevFinish
+		return ErrTimeout
+	}
+}
+
+// release hands the slot of a sent frame over to the waiting frame with the earliest finish time
+func (sc *scheduler) release() {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if len(sc.waiting) == 0 {
+		sc.inFlight--
+		return
+	}
+	req := heap.Pop(&sc.waiting).(*sendRequest)
+	if req.start > sc.vtime {
+		sc.vtime = req.start
+	}
+	close(req.ready)
+}
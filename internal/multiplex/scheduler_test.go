@@ -0,0 +1,91 @@
+package multiplex
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func waitingCount(sc *scheduler) int {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return len(sc.waiting)
+}
+
+func TestScheduler_FairOrder(t *testing.T) {
+	sc := makeScheduler(func() int { return 1 })
+	bulk := &flow{weight: DefaultStreamWeight}
+	interactive := &flow{weight: DefaultStreamWeight}
+
+	// bulk is sending and has another frame waiting
+	assert.NoError(t, sc.acquire(bulk, 16384, nil))
+	order := make(chan *flow, 2)
+	go func() {
+		sc.acquire(bulk, 16384, nil)
+		order <- bulk
+	}()
+	assert.Eventually(t, func() bool { return waitingCount(sc) == 1 }, time.Second, time.Millisecond)
+
+	go func() {
+		sc.acquire(interactive, 64, nil)
+		order <- interactive
+	}()
+	assert.Eventually(t, func() bool { return waitingCount(sc) == 2 }, time.Second, time.Millisecond)
+
+	sc.release()
+	assert.Equal(t, interactive, <-order, "a stream that has been quiet should go before the bulk backlog")
+	sc.release()
+	assert.Equal(t, bulk, <-order)
+	sc.release()
+	assert.Equal(t, 0, sc.inFlight)
+}
+
+func TestScheduler_Weights(t *testing.T) {
+	sc := makeScheduler(func() int { return 1 })
+	light := &flow{}
+	light.setWeight(1)
+	heavy := &flow{}
+	heavy.setWeight(255)
+
+	assert.NoError(t, sc.acquire(light, 100, nil))
+	order := make(chan *flow, 2)
+	go func() {
+		sc.acquire(light, 100, nil)
+		order <- light
+	}()
+	assert.Eventually(t, func() bool { return waitingCount(sc) == 1 }, time.Second, time.Millisecond)
+	go func() {
+		// much larger, but with a much larger weight
+		sc.acquire(heavy, 10000, nil)
+		order <- heavy
+	}()
+	assert.Eventually(t, func() bool { return waitingCount(sc) == 2 }, time.Second, time.Millisecond)
+
+	sc.release()
+	assert.Equal(t, heavy, <-order)
+	sc.release()
+	assert.Equal(t, light, <-order)
+	sc.release()
+}
+
+func TestScheduler_Cancel(t *testing.T) {
+	sc := makeScheduler(func() int { return 1 })
+	f := &flow{weight: DefaultStreamWeight}
+	assert.NoError(t, sc.acquire(f, 100, nil))
+	finish := f.finish
+
+	cancel := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- sc.acquire(f, 100, cancel)
+	}()
+	assert.Eventually(t, func() bool { return waitingCount(sc) == 1 }, time.Second, time.Millisecond)
+	close(cancel)
+	assert.Equal(t, ErrTimeout, <-done)
+	assert.Equal(t, 0, waitingCount(sc))
+	assert.Equal(t, finish, f.finish, "a cancelled frame shouldn't be charged")
+
+	sc.release()
+	assert.Equal(t, 0, sc.inFlight)
+}
@@ -1,6 +1,7 @@
 package multiplex
 
 import (
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"net"
@@ -17,6 +18,8 @@ const (
 	acceptBacklog            = 1024
 	defaultInactivityTimeout = 30 * time.Second
 	defaultMaxOnWireSize     = 1<<14 + 256 // https://tools.ietf.org/html/rfc8446#section-5.2
+
+	defaultKeepAliveTimeoutMultiplier = 3
 )
 
 var ErrBrokenSession = errors.New("broken session")
@@ -40,6 +43,25 @@ type SessionConfig struct {
 
 	// InactivityTimeout sets the duration a Session waits while it has no active streams before it closes itself
 	InactivityTimeout time.Duration
+
+	// KeepAliveInterval sets how long an underlying connection can stay silent before a ping is sent through it.
+	// Zero disables pings. The remote end will always answer pings regardless of its own KeepAliveInterval, but
+	// pings are only sent once a pong has come from the remote, as a remote that doesn't understand them would take
+	// a ping for a new stream. A remote that does sends one unprompted if it has AnnouncePings set. Until then
+	// connections aren't timed out either
+	KeepAliveInterval time.Duration
+
+	// KeepAliveTimeout sets how long an underlying connection can go without receiving anything, pongs included,
+	// before it is considered dead. It has no effect if KeepAliveInterval is zero
+	KeepAliveTimeout time.Duration
+
+	// StreamOpenAck is set if the remote understands stream open acknowledgements, in which case Stream.AckOpen
+	// tells the remote whether an accepted stream has been connected to its destination
+	StreamOpenAck bool
+
+	// AnnouncePings is set if the remote wants to send pings, in which case a pong is sent through every
+	// connection as it's added to tell the remote that its pings will be answered
+	AnnouncePings bool
 }
 
 // A Session represents a self-contained communication chain between local and remote. It manages its streams,
@@ -69,6 +91,9 @@ type Session struct {
 	// Switchboard manages all connections to remote
 	sb *switchboard
 
+	// sched orders frames from streams sending at the same time
+	sched *scheduler
+
 	// Used for LocalAddr() and RemoteAddr() etc.
 	addrs atomic.Value
 
@@ -77,6 +102,15 @@ type Session struct {
 	terminalMsgSetter sync.Once
 	terminalMsg       string
 
+	// atomic. Sequence number of the next frame sent with controlStreamID
+	nextControlSeq uint64
+
+	// atomic. Smoothed round trip time in nanoseconds, measured through pings
+	srtt int64
+
+	// atomic. Set to 1 once a pong has been received, after which the remote is known to answer pings
+	pongReceived uint32
+
 	// the max size passed to Write calls before it splits it into multiple frames
 	// i.e. the max size a piece of data can fit into a Frame.Payload
 	maxStreamUnitWrite int
@@ -107,6 +141,9 @@ func MakeSession(id uint32, config SessionConfig) *Session {
 	if config.InactivityTimeout == 0 {
 		sesh.InactivityTimeout = defaultInactivityTimeout
 	}
+	if config.KeepAliveInterval > 0 && config.KeepAliveTimeout <= 0 {
+		sesh.KeepAliveTimeout = defaultKeepAliveTimeoutMultiplier * config.KeepAliveInterval
+	}
 
 	sesh.maxStreamUnitWrite = sesh.MsgOnWireSizeLimit - frameHeaderLength - maxExtraLen
 	sesh.streamSendBufferSize = sesh.MsgOnWireSizeLimit
@@ -118,6 +155,13 @@ func MakeSession(id uint32, config SessionConfig) *Session {
 	}}
 
 	sesh.sb = makeSwitchboard(sesh)
+	// one frame in flight per connection
+	sesh.sched = makeScheduler(func() int {
+		if n := int(atomic.LoadUint32(&sesh.sb.connsCount)); n > 1 {
+			return n
+		}
+		return 1
+	})
 	time.AfterFunc(sesh.InactivityTimeout, sesh.checkTimeout)
 	return sesh
 }
@@ -184,20 +228,9 @@ func (sesh *Session) closeStream(s *Stream, active bool) error {
 	_ = s.recvBuf.Close() // recvBuf.Close should not return error
 
 	if active {
-		tmpBuf := sesh.streamObfsBufPool.Get().(*[]byte)
-
 		// Notify remote that this stream is closed
-		common.CryptoRandRead((*tmpBuf)[:1])
-		padLen := int((*tmpBuf)[0]) + 1
-		payload := (*tmpBuf)[frameHeaderLength : padLen+frameHeaderLength]
-		common.CryptoRandRead(payload)
-
 		// must be holding s.wirtingM on entry
-		s.writingFrame.Closing = closingStream
-		s.writingFrame.Payload = payload
-
-		err := s.obfuscateAndSend(*tmpBuf, frameHeaderLength)
-		sesh.streamObfsBufPool.Put(tmpBuf)
+		err := s.sendClosingFrame(closingStream)
 		if err != nil {
 			return err
 		}
@@ -227,6 +260,13 @@ func (sesh *Session) closeStream(s *Stream, active bool) error {
 // to the stream buffer, otherwise it fetches the desired stream instance, or creates and stores one if it's a new
 // stream and then writes to the stream buffer
 func (sesh *Session) recvDataFromRemote(data []byte) error {
+	return sesh.recvDataFromConn(data, nil)
+}
+
+// recvDataFromConn is the same as recvDataFromRemote, but it also takes the underlying connection the data came
+// from so that control frames that expect a reply (i.e. pings) can be answered through the same connection.
+// If conn is nil, the reply is sent through a random connection.
+func (sesh *Session) recvDataFromConn(data []byte, conn net.Conn) error {
 	frame := sesh.recvFramePool.Get().(*Frame)
 	defer sesh.recvFramePool.Put(frame)
 
@@ -235,9 +275,17 @@ func (sesh *Session) recvDataFromRemote(data []byte) error {
 		return fmt.Errorf("Failed to decrypt a frame for session %v: %v", sesh.id, err)
 	}
 
-	if frame.Closing == closingSession {
+	switch frame.Closing {
+	case closingSession:
 		sesh.SetTerminalMsg("Received a closing notification frame")
 		return sesh.passiveClose()
+	case pingFrame:
+		// we echo the payload back so that the pinging side can calculate RTT
+		return sesh.sendControlFrame(pongFrame, frame.Payload, conn)
+	case pongFrame:
+		atomic.StoreUint32(&sesh.pongReceived, 1)
+		sesh.updateRTT(frame.Payload)
+		return nil
 	}
 
 	sesh.streamsM.Lock()
@@ -320,8 +368,8 @@ func (sesh *Session) Close() error {
 	common.CryptoRandRead(payload)
 
 	f := &Frame{
-		StreamID: 0xffffffff,
-		Seq:      0,
+		StreamID: controlStreamID,
+		Seq:      atomic.AddUint64(&sesh.nextControlSeq, 1) - 1,
 		Closing:  closingSession,
 		Payload:  payload,
 	}
@@ -329,7 +377,7 @@ func (sesh *Session) Close() error {
 	if err != nil {
 		return err
 	}
-	_, err = sesh.sb.send((*buf)[:i], new(net.Conn))
+	_, err = sesh.sb.send((*buf)[:i], new(net.Conn), nil)
 	if err != nil {
 		return err
 	}
@@ -349,4 +397,72 @@ func (sesh *Session) checkTimeout() {
 	}
 }
 
+// sendControlFrame sends a frame addressed to the remote session through conn, bypassing the Valve's rate limit.
+// If conn is nil, a random connection is used
+func (sesh *Session) sendControlFrame(typ uint8, payload []byte, conn net.Conn) error {
+	if conn == nil {
+		var err error
+		conn, err = sesh.sb.pickRandConn()
+		if err != nil {
+			return err
+		}
+	}
+	buf := sesh.streamObfsBufPool.Get().(*[]byte)
+	defer sesh.streamObfsBufPool.Put(buf)
+	f := &Frame{
+		StreamID: controlStreamID,
+		Seq:      atomic.AddUint64(&sesh.nextControlSeq, 1) - 1,
+		Closing:  typ,
+		Payload:  payload,
+	}
+	i, err := sesh.obfuscate(f, *buf, 0)
+	if err != nil {
+		return err
+	}
+	n, err := conn.Write((*buf)[:i])
+	sesh.sb.valve.AddTx(int64(n))
+	return err
+}
+
+// ping sends a ping carrying the current time through conn. The remote echoes it back in a pong
+func (sesh *Session) ping(conn net.Conn) error {
+	var payload [8]byte
+	binary.BigEndian.PutUint64(payload[:], uint64(time.Now().UnixNano()))
+	return sesh.sendControlFrame(pingFrame, payload[:], conn)
+}
+
+// updateRTT takes the echoed payload of a pong and folds the measured round trip time into srtt, the same way
+// TCP does it (RFC 6298)
+func (sesh *Session) updateRTT(pongPayload []byte) {
+	if len(pongPayload) < 8 {
+		return
+	}
+	sample := time.Now().UnixNano() - int64(binary.BigEndian.Uint64(pongPayload[:8]))
+	if sample < 0 {
+		return
+	}
+	for {
+		old := atomic.LoadInt64(&sesh.srtt)
+		var srtt int64
+		if old == 0 {
+			srtt = sample
+		} else {
+			srtt = old - old/8 + sample/8
+		}
+		if atomic.CompareAndSwapInt64(&sesh.srtt, old, srtt) {
+			return
+		}
+	}
+}
+
+// RTT returns the smoothed round trip time measured through pings. It returns 0 if no pong has been received yet,
+// which is always the case when KeepAliveInterval is zero
+func (sesh *Session) RTT() time.Duration { return time.Duration(atomic.LoadInt64(&sesh.srtt)) }
+
 func (sesh *Session) Addr() net.Addr { return sesh.addrs.Load().([]net.Addr)[0] }
+
+// RemoteAddrs returns the remote addresses of all underlying connections of the session
+func (sesh *Session) RemoteAddrs() []net.Addr { return sesh.sb.remoteAddrs() }
+
+// NumStreams returns the number of streams that haven't been closed
+func (sesh *Session) NumStreams() int { return int(sesh.streamCount()) }
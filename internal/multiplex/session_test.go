@@ -638,3 +638,60 @@ func BenchmarkLatency(b *testing.B) {
 		})
 	}
 }
+
+// BenchmarkLatency_UnderBulk measures the round trip of a small write on one stream while other streams keep a
+// rate limited session saturated
+func BenchmarkLatency_UnderBulk(b *testing.B) {
+	const bulkStreams = 4
+	var sessionKey [32]byte
+	rand.Read(sessionKey[:])
+
+	weights := map[string]uint8{
+		"default weight": DefaultStreamWeight,
+		"max weight":     255,
+	}
+	for name, weight := range weights {
+		b.Run(name, func(b *testing.B) {
+			obfuscator, _ := MakeObfuscator(EncryptionMethodPlain, sessionKey)
+			const txRate = 4 << 20
+			clientSesh := MakeSession(0, SessionConfig{Obfuscator: obfuscator, Valve: MakeValve(1<<30, txRate)})
+			serverSesh := MakeSession(0, SessionConfig{Obfuscator: obfuscator})
+			defer clientSesh.Close()
+
+			c, s := net.Pipe()
+			clientSesh.AddConnection(c)
+			serverSesh.AddConnection(s)
+
+			buf := make([]byte, 64)
+			smallStream, _ := clientSesh.OpenStream()
+			smallStream.SetWeight(weight)
+			smallStream.Write(buf)
+			serverSmall, _ := serverSesh.Accept()
+			io.ReadFull(serverSmall, buf)
+
+			bulk := make([]byte, 1<<20)
+			for i := 0; i < bulkStreams; i++ {
+				bulkStream, _ := clientSesh.OpenStream()
+				go func() {
+					for {
+						if _, err := bulkStream.Write(bulk); err != nil {
+							return
+						}
+					}
+				}()
+				serverBulk, _ := serverSesh.Accept()
+				go io.Copy(ioutil.Discard, serverBulk)
+			}
+			// let the bulk streams use up the Valve's initial burst
+			for clientSesh.Valve.GetTx() < txRate {
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				smallStream.Write(buf)
+				io.ReadFull(serverSmall, buf)
+			}
+		})
+	}
+}
@@ -2,6 +2,7 @@ package multiplex
 
 import (
 	"errors"
+	"fmt"
 	"io"
 	"net"
 	"time"
@@ -9,6 +10,7 @@ import (
 	"sync"
 	"sync/atomic"
 
+	"github.com/cbeuw/Cloak/internal/common"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -34,6 +36,23 @@ type Stream struct {
 	// atomic
 	closed uint32
 
+	// atomic. Set when Close is called on this end, as opposed to the stream being closed by the remote or the session
+	closedLocally uint32
+
+	// atomic. Set when the writing side of this end or of the remote end has been closed by CloseWrite. The stream
+	// is closed entirely once both are set
+	writeClosed       uint32
+	remoteWriteClosed uint32
+
+	// atomic. The StreamOpenError the remote reset this stream with, if it failed to connect it to its destination
+	openErr uint32
+
+	// scheduling state of the frames sent from this stream
+	sched flow
+
+	// writeDeadline interrupts Write and ReadFrom calls that are waiting to send
+	writeDeadline deadline
+
 	// When we want order guarantee (i.e. session.Unordered is false),
 	// we assign each stream a fixed underlying connection.
 	// If the underlying connections the session uses provide ordering guarantee (most likely TCP),
@@ -54,6 +73,8 @@ func makeStream(sesh *Session, id uint32) *Stream {
 			Seq:      0,
 			Closing:  closingNothing,
 		},
+		writeDeadline: makeDeadline(),
+		sched:         flow{weight: DefaultStreamWeight},
 	}
 
 	if sesh.Unordered {
@@ -67,21 +88,50 @@ func makeStream(sesh *Session, id uint32) *Stream {
 
 func (s *Stream) isClosed() bool { return atomic.LoadUint32(&s.closed) == 1 }
 
+// writeCancelledErr tells a write deadline apart from Close interrupting a pending write
+func (s *Stream) writeCancelledErr() error {
+	if atomic.LoadUint32(&s.closedLocally) == 1 {
+		return ErrBrokenStream
+	}
+	return ErrTimeout
+}
+
 // receive a readily deobfuscated Frame so its payload can later be Read
 func (s *Stream) recvFrame(frame *Frame) error {
-	toBeClosed, err := s.recvBuf.Write(frame)
-	if toBeClosed {
-		err = s.passiveClose()
-		if errors.Is(err, errRepeatStreamClosing) {
-			log.Debug(err)
-			return nil
+	if frame.Closing == streamOpenAck && len(frame.Payload) > 0 && frame.Payload[0] != 0 {
+		// The remote sends nothing else on a stream it failed to open, so this needn't wait for its turn in
+		// the sequence
+		atomic.StoreUint32(&s.openErr, uint32(frame.Payload[0]))
+		log.Debugf("stream %v reset by remote: %v", s.id, StreamOpenError(frame.Payload[0]))
+		return s.passiveCloseIgnoringRepeat()
+	}
+	closing, err := s.recvBuf.Write(frame)
+	switch closing {
+	case closingStream:
+		return s.passiveCloseIgnoringRepeat()
+	case closingStreamWrite:
+		atomic.StoreUint32(&s.remoteWriteClosed, 1)
+		if atomic.LoadUint32(&s.writeClosed) == 1 {
+			// both directions are done
+			return s.passiveCloseIgnoringRepeat()
 		}
-		return err
+		log.Tracef("stream %v half-closed by remote", s.id)
+	}
+	return err
+}
+
+func (s *Stream) passiveCloseIgnoringRepeat() error {
+	err := s.passiveClose()
+	if errors.Is(err, errRepeatStreamClosing) {
+		log.Debug(err)
+		return nil
 	}
 	return err
 }
 
-// Read implements io.Read
+// Read implements io.Read. It returns io.EOF once all data has been read from a stream closed by the remote,
+// ErrBrokenStream if the stream has been closed locally, and a StreamOpenError if the remote failed to connect the
+// stream to its destination
 func (s *Stream) Read(buf []byte) (n int, err error) {
 	//log.Tracef("attempting to read from stream %v", s.id)
 	if len(buf) == 0 {
@@ -91,20 +141,37 @@ func (s *Stream) Read(buf []byte) (n int, err error) {
 	n, err = s.recvBuf.Read(buf)
 	log.Tracef("%v read from stream %v with err %v", n, s.id, err)
 	if err == io.EOF {
-		return n, ErrBrokenStream
+		if openErr := atomic.LoadUint32(&s.openErr); openErr != 0 {
+			return n, StreamOpenError(openErr)
+		}
+		if atomic.LoadUint32(&s.closedLocally) == 1 {
+			return n, ErrBrokenStream
+		}
 	}
 	return
 }
 
-func (s *Stream) obfuscateAndSend(buf []byte, payloadOffsetInBuf int) error {
+// obfuscateAndSend sends s.writingFrame once the session's scheduler lets it. Must be holding s.writingM on entry.
+// If cancel is closed before the frame is sent, ErrTimeout is returned.
+func (s *Stream) obfuscateAndSend(buf []byte, payloadOffsetInBuf int, cancel <-chan struct{}) error {
 	cipherTextLen, err := s.session.obfuscate(&s.writingFrame, buf, payloadOffsetInBuf)
 	s.writingFrame.Seq++
 	if err != nil {
 		return err
 	}
 
-	_, err = s.session.sb.send(buf[:cipherTextLen], &s.assignedConn)
+	err = s.session.sched.acquire(&s.sched, cipherTextLen, cancel)
+	if err == nil {
+		_, err = s.session.sb.send(buf[:cipherTextLen], &s.assignedConn, cancel)
+		s.session.sched.release()
+	}
 	if err != nil {
+		if err == ErrTimeout {
+			// The frame never left, so its sequence number has to be reused. Otherwise the remote would
+			// wait for it forever
+			s.writingFrame.Seq--
+			return err
+		}
 		if err == errBrokenSwitchboard {
 			s.session.SetTerminalMsg(err.Error())
 			s.session.passiveClose()
@@ -118,11 +185,18 @@ func (s *Stream) obfuscateAndSend(buf []byte, payloadOffsetInBuf int) error {
 func (s *Stream) Write(in []byte) (n int, err error) {
 	s.writingM.Lock()
 	defer s.writingM.Unlock()
-	if s.isClosed() {
+	if s.isClosed() || atomic.LoadUint32(&s.closedLocally) == 1 || atomic.LoadUint32(&s.writeClosed) == 1 {
 		return 0, ErrBrokenStream
 	}
 
+	cancel := s.writeDeadline.wait()
 	for n < len(in) {
+		select {
+		case <-cancel:
+			return n, s.writeCancelledErr()
+		default:
+		}
+
 		var framePayload []byte
 		if len(in)-n <= s.session.maxStreamUnitWrite {
 			// if we can fit remaining data of in into one frame
@@ -138,8 +212,11 @@ func (s *Stream) Write(in []byte) (n int, err error) {
 		}
 		s.writingFrame.Payload = framePayload
 		buf := s.session.streamObfsBufPool.Get().(*[]byte)
-		err = s.obfuscateAndSend(*buf, 0)
+		err = s.obfuscateAndSend(*buf, 0, cancel)
 		s.session.streamObfsBufPool.Put(buf)
+		if err == ErrTimeout {
+			return n, s.writeCancelledErr()
+		}
 		if err != nil {
 			return
 		}
@@ -149,7 +226,7 @@ func (s *Stream) Write(in []byte) (n int, err error) {
 }
 
 // ReadFrom continuously read data from r and send it off, until either r returns error or nothing has been read
-// for readFromTimeout amount of time
+// for readFromTimeout amount of time. The write deadline of the stream applies to sending the data read
 func (s *Stream) ReadFrom(r io.Reader) (n int64, err error) {
 	for {
 		if s.readFromTimeout != 0 {
@@ -162,21 +239,28 @@ func (s *Stream) ReadFrom(r io.Reader) (n int64, err error) {
 		buf := s.session.streamObfsBufPool.Get().(*[]byte)
 		read, er := r.Read((*buf)[frameHeaderLength : frameHeaderLength+s.session.maxStreamUnitWrite])
 		if er != nil {
+			if er == io.EOF {
+				// io.ReaderFrom doesn't treat EOF as an error
+				return n, nil
+			}
 			return n, er
 		}
 
 		// the above read may have been unblocked by another goroutine calling stream.Close(), so we need
 		// to check that here
-		if s.isClosed() {
+		if s.isClosed() || atomic.LoadUint32(&s.writeClosed) == 1 {
 			return n, ErrBrokenStream
 		}
 
 		s.writingM.Lock()
 		s.writingFrame.Payload = (*buf)[frameHeaderLength : frameHeaderLength+read]
-		err = s.obfuscateAndSend(*buf, frameHeaderLength)
+		err = s.obfuscateAndSend(*buf, frameHeaderLength, s.writeDeadline.wait())
 		s.writingM.Unlock()
 		s.session.streamObfsBufPool.Put(buf)
 
+		if err == ErrTimeout {
+			return n, s.writeCancelledErr()
+		}
 		if err != nil {
 			return
 		}
@@ -188,24 +272,126 @@ func (s *Stream) passiveClose() error {
 	return s.session.closeStream(s, false)
 }
 
-// active close. Close locally and tell the remote that this stream is being closed
+// sendClosingFrame sends a frame of type closing with a random payload. Must be holding s.writingM on entry
+func (s *Stream) sendClosingFrame(closing uint8) error {
+	return s.sendPaddedFrame(closing, nil)
+}
+
+// sendPaddedFrame sends a frame of type closing whose payload is info followed by random padding. Must be holding
+// s.writingM on entry
+func (s *Stream) sendPaddedFrame(closing uint8, info []byte) error {
+	tmpBuf := s.session.streamObfsBufPool.Get().(*[]byte)
+	defer s.session.streamObfsBufPool.Put(tmpBuf)
+
+	common.CryptoRandRead((*tmpBuf)[:1])
+	padLen := int((*tmpBuf)[0]) + 1
+	payload := (*tmpBuf)[frameHeaderLength : len(info)+padLen+frameHeaderLength]
+	common.CryptoRandRead(payload)
+	copy(payload, info)
+
+	s.writingFrame.Closing = closing
+	s.writingFrame.Payload = payload
+	return s.obfuscateAndSend(*tmpBuf, frameHeaderLength, nil)
+}
+
+// AckOpen tells the remote whether this end has managed to connect an accepted stream to its destination. It must
+// be called before anything is written to the stream. A nil reason lets the remote carry on, while a non-nil one
+// resets the stream on both ends and is passed on to the remote as a StreamOpenError. If the remote doesn't
+// understand acknowledgements (i.e. StreamOpenAck isn't set), a failure simply closes the stream.
+func (s *Stream) AckOpen(reason error) error {
+	if !s.session.StreamOpenAck {
+		if reason != nil {
+			return s.Close()
+		}
+		return nil
+	}
+
+	code := StreamOpenError(0)
+	if reason != nil && !errors.As(reason, &code) {
+		code = StreamOpenErrGeneric
+	}
+
+	s.writingM.Lock()
+	defer s.writingM.Unlock()
+	if s.isClosed() || atomic.LoadUint32(&s.closedLocally) == 1 {
+		return ErrBrokenStream
+	}
+
+	err := s.sendPaddedFrame(streamOpenAck, []byte{byte(code)})
+	s.writingFrame.Closing = closingNothing
+	if err != nil || code == 0 {
+		return err
+	}
+
+	// the ack has already told the remote to close the stream
+	atomic.StoreUint32(&s.closedLocally, 1)
+	return s.passiveCloseIgnoringRepeat()
+}
+
+// CloseWrite shuts down the writing side of the stream and tells the remote that no more data will be sent, which
+// the remote reads as io.EOF. The stream can still be read from, and it's closed entirely once the remote closes its
+// writing side as well. In unordered mode, the frame doing this could overtake data frames, so this is the same as
+// Close.
+func (s *Stream) CloseWrite() error {
+	if s.session.Unordered {
+		return s.Close()
+	}
+	s.writingM.Lock()
+	defer s.writingM.Unlock()
+	if s.isClosed() || atomic.LoadUint32(&s.closedLocally) == 1 {
+		return ErrBrokenStream
+	}
+	if !atomic.CompareAndSwapUint32(&s.writeClosed, 0, 1) {
+		return fmt.Errorf("closing writing side of stream %v: %w", s.id, errRepeatStreamClosing)
+	}
+
+	if err := s.sendClosingFrame(closingStreamWrite); err != nil {
+		return err
+	}
+	log.Tracef("stream %v half-closed", s.id)
+
+	if atomic.LoadUint32(&s.remoteWriteClosed) == 1 {
+		// both directions are done
+		return s.passiveCloseIgnoringRepeat()
+	}
+	return nil
+}
+
+// active close. Close locally and tell the remote that this stream is being closed. Closing a stream that has
+// already been closed by the remote or the session is not an error
 func (s *Stream) Close() error {
+	if !atomic.CompareAndSwapUint32(&s.closedLocally, 0, 1) {
+		return fmt.Errorf("closing stream %v: %w", s.id, errRepeatStreamClosing)
+	}
+	// interrupt pending writes so that we can get hold of writingM
+	s.writeDeadline.set(aLongTimeAgo)
+
 	s.writingM.Lock()
 	defer s.writingM.Unlock()
 
-	return s.session.closeStream(s, true)
+	err := s.session.closeStream(s, true)
+	if errors.Is(err, errRepeatStreamClosing) {
+		return nil
+	}
+	return err
 }
 
 func (s *Stream) LocalAddr() net.Addr  { return s.session.addrs.Load().([]net.Addr)[0] }
 func (s *Stream) RemoteAddr() net.Addr { return s.session.addrs.Load().([]net.Addr)[1] }
 
 func (s *Stream) SetReadDeadline(t time.Time) error  { s.recvBuf.SetReadDeadline(t); return nil }
+func (s *Stream) SetWriteDeadline(t time.Time) error { s.writeDeadline.set(t); return nil }
+func (s *Stream) SetDeadline(t time.Time) error {
+	s.recvBuf.SetReadDeadline(t)
+	s.writeDeadline.set(t)
+	return nil
+}
 func (s *Stream) SetReadFromTimeout(d time.Duration) { s.readFromTimeout = d }
 
-var errNotImplemented = errors.New("Not implemented")
+// SetWeight sets the share of the session's sending capacity this stream gets while other streams are sending too,
+// relative to their weights. Weights range from 1 to 255, and 0 resets it to DefaultStreamWeight. It only affects
+// what this end sends.
+func (s *Stream) SetWeight(weight uint8) { s.sched.setWeight(weight) }
 
-// the following functions are purely for implementing net.Conn interface.
-// they are not used
-// TODO: implement the following
-func (s *Stream) SetDeadline(t time.Time) error      { return errNotImplemented }
-func (s *Stream) SetWriteDeadline(t time.Time) error { return errNotImplemented }
+// aLongTimeAgo is a non-zero time, far in the past, used for immediate cancellation of writes
+var aLongTimeAgo = time.Unix(1, 0)
@@ -62,22 +62,16 @@ func NewStreamBuffer() *streamBuffer {
 	return sb
 }
 
-func (sb *streamBuffer) Write(f *Frame) (toBeClosed bool, err error) {
+func (sb *streamBuffer) Write(f *Frame) (closing uint8, err error) {
 	sb.recvM.Lock()
 	defer sb.recvM.Unlock()
 	// when there'fs no ooo packages in heap and we receive the next package in order
 	if len(sb.sh) == 0 && f.Seq == sb.nextRecvSeq {
-		if f.Closing != closingNothing {
-			return true, nil
-		} else {
-			sb.buf.Write(f.Payload)
-			sb.nextRecvSeq += 1
-		}
-		return false, nil
+		return sb.deliver(f), nil
 	}
 
 	if f.Seq < sb.nextRecvSeq {
-		return false, fmt.Errorf("seq %v is smaller than nextRecvSeq %v", f.Seq, sb.nextRecvSeq)
+		return closingNothing, fmt.Errorf("seq %v is smaller than nextRecvSeq %v", f.Seq, sb.nextRecvSeq)
 	}
 
 	saved := *f
@@ -85,16 +79,38 @@ func (sb *streamBuffer) Write(f *Frame) (toBeClosed bool, err error) {
 	copy(saved.Payload, f.Payload)
 	heap.Push(&sb.sh, &saved)
 	// Keep popping from the heap until empty or to the point that the wanted seq was not received
+	closing = closingNothing
 	for len(sb.sh) > 0 && sb.sh[0].Seq == sb.nextRecvSeq {
 		f = heap.Pop(&sb.sh).(*Frame)
-		if f.Closing != closingNothing {
-			return true, nil
-		} else {
-			sb.buf.Write(f.Payload)
-			sb.nextRecvSeq += 1
+		switch sb.deliver(f) {
+		case closingStream:
+			return closingStream, nil
+		case closingStreamWrite:
+			closing = closingStreamWrite
 		}
 	}
-	return false, nil
+	return closing, nil
+}
+
+// deliver writes the payload of an in-sequence frame into the buffered pipe, or closes the pipe if it's a
+// closingStreamWrite. Must be holding recvM
+func (sb *streamBuffer) deliver(f *Frame) (closing uint8) {
+	switch f.Closing {
+	case closingNothing:
+		sb.buf.Write(f.Payload)
+	case closingStreamWrite:
+		// the reader will get io.EOF once it has read everything before this frame
+		sb.buf.Close()
+	case streamOpenAck:
+		// a successful open carries no data. A failed one never gets here as it resets the stream straight away
+		sb.nextRecvSeq += 1
+		return closingNothing
+	default:
+		// any other closing frame closes the stream entirely
+		return closingStream
+	}
+	sb.nextRecvSeq += 1
+	return f.Closing
 }
 
 func (sb *streamBuffer) Read(buf []byte) (int, error) {
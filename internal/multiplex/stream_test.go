@@ -4,11 +4,14 @@ import (
 	"bytes"
 	"io"
 	"math/rand"
+	"net"
+	"os"
 	"testing"
 	"time"
 
 	"github.com/cbeuw/Cloak/internal/common"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/nettest"
 
 	"github.com/cbeuw/connutil"
 )
@@ -386,3 +389,58 @@ func TestStream_SetReadFromTimeout(t *testing.T) {
 		})
 	}
 }
+
+func TestStream_NetConn(t *testing.T) {
+	nettest.TestConn(t, func() (c1, c2 net.Conn, stop func(), err error) {
+		clientSession, serverSession, _ := makeSessionPair(1)
+		stream, err := clientSession.OpenStream()
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		// the remote only learns about a stream when data arrives
+		if _, err = stream.Write([]byte{0}); err != nil {
+			return nil, nil, nil, err
+		}
+		accepted, err := serverSession.Accept()
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if _, err = io.ReadFull(accepted, make([]byte, 1)); err != nil {
+			return nil, nil, nil, err
+		}
+		stop = func() {
+			clientSession.Close()
+			serverSession.Close()
+		}
+		return stream, accepted, stop, nil
+	})
+}
+
+func TestStream_SetWriteDeadline(t *testing.T) {
+	sesh := MakeSession(0, SessionConfig{Valve: MakeValve(1<<20, 1024)})
+	sesh.AddConnection(connutil.Discard())
+	stream, _ := sesh.OpenStream()
+
+	// the first write drains the bucket so the second one has to wait
+	_, err := stream.Write(make([]byte, 1000))
+	assert.NoError(t, err)
+
+	_ = stream.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+	done := make(chan error)
+	go func() {
+		_, err := stream.Write(make([]byte, 512))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	case <-time.After(500 * time.Millisecond):
+		t.Error("Write waiting for the valve was not interrupted by the deadline")
+	}
+
+	_ = stream.SetWriteDeadline(time.Time{})
+	seq := stream.writingFrame.Seq
+	_, err = stream.Write(make([]byte, 1))
+	assert.NoError(t, err)
+	assert.EqualValues(t, seq+1, stream.writingFrame.Seq, "sequence number of the cancelled frame wasn't reused")
+}
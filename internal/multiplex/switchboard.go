@@ -8,6 +8,7 @@ import (
 	"net"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 type switchboardStrategy int
@@ -34,6 +35,10 @@ type switchboard struct {
 	connsCount uint32
 	randPool   sync.Pool
 
+	// net.Conn -> *int64, the unix nano time at which something was last received from that conn.
+	// Only populated when keepalive is enabled
+	lastRecv sync.Map
+
 	broken uint32
 }
 
@@ -48,6 +53,9 @@ func makeSwitchboard(sesh *Session) *switchboard {
 			return rand.New(rand.NewChaCha8(state))
 		}},
 	}
+	if sesh.KeepAliveInterval > 0 {
+		go sb.keepAlive()
+	}
 	return sb
 }
 
@@ -56,12 +64,29 @@ var errBrokenSwitchboard = errors.New("the switchboard is broken")
 func (sb *switchboard) addConn(conn net.Conn) {
 	connId := atomic.AddUint32(&sb.connsCount, 1) - 1
 	sb.conns.Store(connId, conn)
+	if sb.session.KeepAliveInterval > 0 {
+		now := time.Now().UnixNano()
+		sb.lastRecv.Store(conn, &now)
+	}
+	if sb.session.AnnouncePings {
+		// a pong shorter than a ping's timestamp doesn't count towards the RTT
+		announcement := make([]byte, 4)
+		common.CryptoRandRead(announcement)
+		if err := sb.session.sendControlFrame(pongFrame, announcement, conn); err != nil {
+			log.Debugf("failed to announce pings to a connection for session %v: %v", sb.session.id, err)
+		}
+	}
 	go sb.deplex(conn)
 }
 
-// a pointer to assignedConn is passed here so that the switchboard can reassign it if that conn isn't usable
-func (sb *switchboard) send(data []byte, assignedConn *net.Conn) (n int, err error) {
-	sb.valve.txWait(len(data))
+// a pointer to assignedConn is passed here so that the switchboard can reassign it if that conn isn't usable.
+// If cancel is closed while waiting for the Valve, send returns ErrTimeout without having sent anything. Once the
+// data starts being written to a conn it can no longer be cancelled, as a partially written frame would corrupt the
+// conn for every other stream.
+func (sb *switchboard) send(data []byte, assignedConn *net.Conn, cancel <-chan struct{}) (n int, err error) {
+	if err = sb.valve.txWait(len(data), cancel); err != nil {
+		return 0, err
+	}
 	if atomic.LoadUint32(&sb.broken) == 1 {
 		return 0, errBrokenSwitchboard
 	}
@@ -130,6 +155,15 @@ func (sb *switchboard) pickRandConn() (net.Conn, error) {
 	return ret.(net.Conn), nil
 }
 
+func (sb *switchboard) remoteAddrs() []net.Addr {
+	var addrs []net.Addr
+	sb.conns.Range(func(_, conn interface{}) bool {
+		addrs = append(addrs, conn.(net.Conn).RemoteAddr())
+		return true
+	})
+	return addrs
+}
+
 // actively triggered by session.Close()
 func (sb *switchboard) closeAll() {
 	if !atomic.CompareAndSwapUint32(&sb.broken, 0, 1) {
@@ -158,9 +192,46 @@ func (sb *switchboard) deplex(conn net.Conn) {
 			return
 		}
 
-		err = sb.session.recvDataFromRemote(buf[:n])
+		if lastRecv, ok := sb.lastRecv.Load(conn); ok {
+			atomic.StoreInt64(lastRecv.(*int64), time.Now().UnixNano())
+		}
+
+		err = sb.session.recvDataFromConn(buf[:n], conn)
 		if err != nil {
 			log.Error(err)
 		}
 	}
 }
+
+// keepAlive periodically pings connections that have been silent for KeepAliveInterval, and closes those that
+// have been silent for KeepAliveTimeout. A closed connection will in turn bring down the whole session through
+// deplex, as does any connection that has dropped. Nothing is done until the remote is known to answer pings.
+func (sb *switchboard) keepAlive() {
+	ticker := time.NewTicker(sb.session.KeepAliveInterval / 2)
+	defer ticker.Stop()
+	for range ticker.C {
+		if atomic.LoadUint32(&sb.broken) == 1 {
+			return
+		}
+		if atomic.LoadUint32(&sb.session.pongReceived) == 0 {
+			continue
+		}
+		now := time.Now()
+		sb.lastRecv.Range(func(key, value interface{}) bool {
+			conn := key.(net.Conn)
+			silence := now.Sub(time.Unix(0, atomic.LoadInt64(value.(*int64))))
+			if silence >= sb.session.KeepAliveTimeout {
+				log.Debugf("a connection for session %v has received nothing for %v", sb.session.id, silence)
+				sb.session.SetTerminalMsg("keepalive timeout")
+				conn.Close()
+				return true
+			}
+			if silence >= sb.session.KeepAliveInterval {
+				if err := sb.session.ping(conn); err != nil {
+					log.Debugf("failed to ping a connection for session %v: %v", sb.session.id, err)
+				}
+			}
+			return true
+		})
+	}
+}
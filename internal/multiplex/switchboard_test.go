@@ -23,7 +23,7 @@ func TestSwitchboard_Send(t *testing.T) {
 		}
 		data := make([]byte, 1000)
 		rand.Read(data)
-		_, err = sesh.sb.send(data, &conn)
+		_, err = sesh.sb.send(data, &conn, nil)
 		if err != nil {
 			t.Error(err)
 			return
@@ -36,7 +36,7 @@ func TestSwitchboard_Send(t *testing.T) {
 			t.Error("failed to get a random conn", err)
 			return
 		}
-		_, err = sesh.sb.send(data, &conn)
+		_, err = sesh.sb.send(data, &conn, nil)
 		if err != nil {
 			t.Error(err)
 			return
@@ -47,7 +47,7 @@ func TestSwitchboard_Send(t *testing.T) {
 			t.Error("failed to get a random conn", err)
 			return
 		}
-		_, err = sesh.sb.send(data, &conn)
+		_, err = sesh.sb.send(data, &conn, nil)
 		if err != nil {
 			t.Error(err)
 			return
@@ -83,7 +83,7 @@ func BenchmarkSwitchboard_Send(b *testing.B) {
 	b.SetBytes(int64(len(data)))
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		sesh.sb.send(data, &conn)
+		sesh.sb.send(data, &conn, nil)
 	}
 }
 
@@ -105,7 +105,7 @@ func TestSwitchboard_TxCredit(t *testing.T) {
 	t.Run("fixed conn mapping", func(t *testing.T) {
 		*sesh.sb.valve.(*LimitedValve).tx = 0
 		sesh.sb.strategy = fixedConnMapping
-		n, err := sesh.sb.send(data[:10], &conn)
+		n, err := sesh.sb.send(data[:10], &conn, nil)
 		if err != nil {
 			t.Error(err)
 			return
@@ -121,7 +121,7 @@ func TestSwitchboard_TxCredit(t *testing.T) {
 	t.Run("uniform spread", func(t *testing.T) {
 		*sesh.sb.valve.(*LimitedValve).tx = 0
 		sesh.sb.strategy = uniformSpread
-		n, err := sesh.sb.send(data[:10], &conn)
+		n, err := sesh.sb.send(data[:10], &conn, nil)
 		if err != nil {
 			t.Error(err)
 			return
@@ -185,3 +185,66 @@ func TestSwitchboard_ConnsCount(t *testing.T) {
 		return atomic.LoadUint32(&sesh.sb.connsCount) == 0
 	}, time.Second, 10*time.Millisecond, "connsCount incorrect: %v", atomic.LoadUint32(&sesh.sb.connsCount))
 }
+
+func TestSwitchboard_KeepAlive(t *testing.T) {
+	var sessionKey [32]byte
+	rand.Read(sessionKey[:])
+	obfuscator, _ := MakeObfuscator(EncryptionMethodPlain, sessionKey)
+
+	t.Run("pong keeps connection alive", func(t *testing.T) {
+		clientSesh := MakeSession(0, SessionConfig{
+			Obfuscator:        obfuscator,
+			KeepAliveInterval: 20 * time.Millisecond,
+			KeepAliveTimeout:  100 * time.Millisecond,
+		})
+		// the server doesn't need keepalive enabled to answer pings
+		serverSesh := MakeSession(0, SessionConfig{Obfuscator: obfuscator, AnnouncePings: true})
+
+		c, s := connutil.AsyncPipe()
+		clientSesh.AddConnection(c)
+		serverSesh.AddConnection(s)
+
+		assert.Eventually(t, func() bool {
+			return clientSesh.RTT() > 0
+		}, time.Second, 10*time.Millisecond, "RTT not measured")
+
+		time.Sleep(300 * time.Millisecond)
+		assert.False(t, clientSesh.IsClosed(), "session closed while pongs are being received")
+		assert.False(t, serverSesh.IsClosed())
+	})
+
+	t.Run("remote that doesn't announce pings", func(t *testing.T) {
+		sesh := MakeSession(0, SessionConfig{
+			Obfuscator:        obfuscator,
+			KeepAliveInterval: 20 * time.Millisecond,
+			KeepAliveTimeout:  100 * time.Millisecond,
+		})
+		c, s := connutil.AsyncPipe()
+		sesh.AddConnection(c)
+
+		// a remote that doesn't understand pings would take one for a new stream
+		_ = s.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+		n, _ := s.Read(make([]byte, 1024))
+		assert.Zero(t, n, "pinged a remote that hasn't announced it answers pings")
+		assert.False(t, sesh.IsClosed(), "timed out a remote that isn't being pinged")
+	})
+
+	t.Run("black-holed connection", func(t *testing.T) {
+		sesh := MakeSession(0, SessionConfig{
+			Obfuscator:        obfuscator,
+			KeepAliveInterval: 20 * time.Millisecond,
+			KeepAliveTimeout:  100 * time.Millisecond,
+		})
+		sesh.AddConnection(connutil.Discard())
+		// the remote announced pings before going silent
+		buf := make([]byte, 512)
+		n, err := sesh.obfuscate(&Frame{StreamID: controlStreamID, Closing: pongFrame, Payload: []byte{1, 2, 3, 4}}, buf, 0)
+		assert.NoError(t, err)
+		assert.NoError(t, sesh.recvDataFromRemote(buf[:n]))
+
+		assert.Eventually(t, func() bool {
+			return sesh.IsClosed()
+		}, time.Second, 10*time.Millisecond, "session not closed after connection stopped responding")
+		assert.Equal(t, "keepalive timeout", sesh.TerminalMsg())
+	})
+}
@@ -21,7 +21,7 @@ var ErrBadClientHello = errors.New("non (or malformed) ClientHello")
 
 func (TLS) String() string { return "TLS" }
 
-func (TLS) processFirstPacket(clientHello []byte, privateKey crypto.PrivateKey) (fragments authFragments, respond Responder, err error) {
+func (TLS) processFirstPacket(clientHello []byte, privateKey crypto.PrivateKey, mimic *serverHelloMimic) (fragments authFragments, respond Responder, err error) {
 	ch, err := parseClientHello(clientHello)
 	if err != nil {
 		log.Debug(err)
@@ -35,18 +35,33 @@ func (TLS) processFirstPacket(clientHello []byte, privateKey crypto.PrivateKey)
 		return
 	}
 
-	respond = TLS{}.makeResponder(ch.sessionId, fragments.sharedSecret)
+	var serverName string
+	if sni, ok := ch.extensions[[2]byte{0x00, 0x00}]; ok {
+		serverName, _ = parseSNI(sni)
+	}
+	respond = TLS{}.makeResponder(ch.sessionId, fragments.sharedSecret, mimic.profileOf(serverName))
 
 	return
 }
 
-func (TLS) makeResponder(clientHelloSessionId []byte, sharedSecret [32]byte) Responder {
-	respond := func(originalConn net.Conn, sessionKey [32]byte, randSource io.Reader) (preparedConn net.Conn, err error) {
+func (TLS) makeResponder(clientHelloSessionId []byte, sharedSecret [32]byte, profile *serverHelloProfile) Responder {
+	respond := func(originalConn net.Conn, info ClientInfo, sessionKey [32]byte, randSource io.Reader) (preparedConn net.Conn, err error) {
 		// the cert length needs to be the same for all handshakes belonging to the same session
 		// we can use sessionKey as a seed here to ensure consistency
 		possibleCertLengths := []int{42, 27, 68, 59, 36, 44, 46}
-		cert := make([]byte, possibleCertLengths[common.RandInt(len(possibleCertLengths))])
-		common.RandRead(randSource, cert)
+		randomLength := possibleCertLengths[common.RandInt(len(possibleCertLengths))]
+		// the client reads two records after the ServerHello, so a profile without ChangeCipherSpec gets two
+		// ApplicationData records in its place
+		nRecords := 1
+		if !profile.ccs {
+			nRecords = 2
+		}
+		var appData [][]byte
+		for _, length := range profile.replyRecordLengths(nRecords, randomLength, info.ExactMimic) {
+			record := make([]byte, length)
+			common.RandRead(randSource, record)
+			appData = append(appData, record)
+		}
 
 		var nonce [12]byte
 		common.RandRead(randSource, nonce[:])
@@ -57,7 +72,7 @@ func (TLS) makeResponder(clientHelloSessionId []byte, sharedSecret [32]byte) Res
 		var encryptedSessionKeyArr [48]byte
 		copy(encryptedSessionKeyArr[:], encryptedSessionKey)
 
-		reply := composeReply(clientHelloSessionId, nonce, encryptedSessionKeyArr, cert)
+		reply := composeReply(clientHelloSessionId, nonce, encryptedSessionKeyArr, appData, profile, info.ExactMimic)
 		_, err = originalConn.Write(reply)
 		if err != nil {
 			err = fmt.Errorf("failed to write TLS reply: %v", err)
@@ -79,6 +79,49 @@ func parseKeyShare(input []byte) (ret []byte, err error) {
 	return nil, errors.New("x25519 does not exist")
 }
 
+// parseSNI returns the host name in a server_name extension
+func parseSNI(input []byte) (ret string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.New("malformed server_name")
+		}
+	}()
+	totalLen := int(u16(input[0:2]))
+	// 2 bytes "server name list length"
+	pointer := 2
+	for pointer < totalLen+2 {
+		nameType := input[pointer]
+		pointer += 1
+		length := int(u16(input[pointer : pointer+2]))
+		pointer += 2
+		name := input[pointer : pointer+length]
+		pointer += length
+		if nameType == 0x00 {
+			return string(name), nil
+		}
+	}
+	return "", errors.New("host_name does not exist")
+}
+
+// parseALPN returns the protocol names in an application_layer_protocol_negotiation extension
+func parseALPN(input []byte) (ret []string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.New("malformed application_layer_protocol_negotiation")
+		}
+	}()
+	totalLen := int(u16(input[0:2]))
+	// 2 bytes "protocol name list length"
+	pointer := 2
+	for pointer < totalLen+2 {
+		length := int(input[pointer])
+		pointer += 1
+		ret = append(ret, string(input[pointer:pointer+length]))
+		pointer += length
+	}
+	return ret, nil
+}
+
 // addRecordLayer adds record layer to data
 func addRecordLayer(input []byte, typ []byte, ver []byte) []byte {
 	length := make([]byte, 2)
@@ -161,42 +204,64 @@ func parseClientHello(data []byte) (ret *ClientHello, err error) {
 	return
 }
 
-func composeServerHello(sessionId []byte, nonce [12]byte, encryptedSessionKeyWithTag [48]byte) []byte {
-	var serverHello [11][]byte
+// composeServerHello composes a ServerHello with the cipher suite and extensions of profile. The key_share extension
+// goes where profile has it with exactMimic, and comes first otherwise, as clients without ExactMimic look for the
+// encrypted session key at a fixed offset
+func composeServerHello(sessionId []byte, nonce [12]byte, encryptedSessionKeyWithTag [48]byte, profile *serverHelloProfile, exactMimic bool) []byte {
+	keyShare := []byte{0x00, 0x33, 0x00, 0x24, 0x00, 0x1d, 0x00, 0x20}
+	keyExchange := make([]byte, 32)
+	copy(keyExchange, encryptedSessionKeyWithTag[20:48])
+	common.CryptoRandRead(keyExchange[28:32])
+	keyShare = append(keyShare, keyExchange...)
+	keyShareIndex := 0
+	if exactMimic {
+		keyShareIndex = min(profile.keyShareIndex, len(profile.extensions))
+	}
+	var extensions []byte
+	for i, extension := range profile.extensions {
+		if i == keyShareIndex {
+			extensions = append(extensions, keyShare...)
+		}
+		extensions = append(extensions, extension...)
+	}
+	if keyShareIndex == len(profile.extensions) {
+		extensions = append(extensions, keyShare...)
+	}
+
+	var serverHello [9][]byte
 	serverHello[0] = []byte{0x02}                                             // handshake type
-	serverHello[1] = []byte{0x00, 0x00, 0x76}                                 // length 118
+	serverHello[1] = nil                                                      // length, filled in below
 	serverHello[2] = []byte{0x03, 0x03}                                       // server version
 	serverHello[3] = append(nonce[0:12], encryptedSessionKeyWithTag[0:20]...) // random 32 bytes
 	serverHello[4] = []byte{0x20}                                             // session id length 32
 	serverHello[5] = sessionId                                                // session id
-	serverHello[6] = []byte{0x13, 0x02}                                       // cipher suite TLS_AES_256_GCM_SHA384
+	serverHello[6] = profile.cipherSuite[:]                                   // cipher suite
 	serverHello[7] = []byte{0x00}                                             // compression method null
-	serverHello[8] = []byte{0x00, 0x2e}                                       // extensions length 46
+	serverHello[8] = binary.BigEndian.AppendUint16(nil, uint16(len(extensions)))
 
-	keyShare := []byte{0x00, 0x33, 0x00, 0x24, 0x00, 0x1d, 0x00, 0x20}
-	keyExchange := make([]byte, 32)
-	copy(keyExchange, encryptedSessionKeyWithTag[20:48])
-	common.CryptoRandRead(keyExchange[28:32])
-	serverHello[9] = append(keyShare, keyExchange...)
-
-	serverHello[10] = []byte{0x00, 0x2b, 0x00, 0x02, 0x03, 0x04} // supported versions
+	length := len(extensions)
+	for _, s := range serverHello[2:] {
+		length += len(s)
+	}
+	serverHello[1] = []byte{byte(length >> 16), byte(length >> 8), byte(length)}
 	var ret []byte
 	for _, s := range serverHello {
 		ret = append(ret, s...)
 	}
-	return ret
+	return append(ret, extensions...)
 }
 
-// composeReply composes the ServerHello, ChangeCipherSpec and an ApplicationData messages
-// together with their respective record layers into one byte slice.
-func composeReply(clientHelloSessionId []byte, nonce [12]byte, encryptedSessionKeyWithTag [48]byte, cert []byte) []byte {
+// composeReply composes the ServerHello, ChangeCipherSpec if profile has one, and ApplicationData messages carrying
+// appData together with their respective record layers into one byte slice.
+func composeReply(clientHelloSessionId []byte, nonce [12]byte, encryptedSessionKeyWithTag [48]byte, appData [][]byte, profile *serverHelloProfile, exactMimic bool) []byte {
 	TLS12 := []byte{0x03, 0x03}
-	sh := composeServerHello(clientHelloSessionId, nonce, encryptedSessionKeyWithTag)
-	shBytes := addRecordLayer(sh, []byte{0x16}, TLS12)
-	ccsBytes := addRecordLayer([]byte{0x01}, []byte{0x14}, TLS12)
-
-	encryptedCertBytes := addRecordLayer(cert, []byte{0x17}, TLS12)
-	ret := append(shBytes, ccsBytes...)
-	ret = append(ret, encryptedCertBytes...)
+	sh := composeServerHello(clientHelloSessionId, nonce, encryptedSessionKeyWithTag, profile, exactMimic)
+	ret := addRecordLayer(sh, []byte{0x16}, TLS12)
+	if profile.ccs {
+		ret = append(ret, addRecordLayer([]byte{0x01}, []byte{0x14}, TLS12)...)
+	}
+	for _, data := range appData {
+		ret = append(ret, addRecordLayer(data, []byte{0x17}, TLS12)...)
+	}
 	return ret
 }
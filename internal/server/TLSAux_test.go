@@ -52,3 +52,16 @@ func TestParseClientHello(t *testing.T) {
 		}
 	})
 }
+
+func TestParseALPN(t *testing.T) {
+	protos, err := parseALPN([]byte{0x00, 0x0c, 0x02, 'h', '2', 0x08, 'h', 't', 't', 'p', '/', '1', '.', '1'})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(protos) != 2 || protos[0] != "h2" || protos[1] != "http/1.1" {
+		t.Errorf("expecting [h2 http/1.1], got %v", protos)
+	}
+	if _, err := parseALPN([]byte{0x00, 0x0c, 0x02, 'h'}); err == nil {
+		t.Error("malformed extension, got no error")
+	}
+}
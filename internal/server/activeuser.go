@@ -1,11 +1,17 @@
 package server
 
 import (
+	"encoding/base64"
+	"errors"
+	"net"
+	"sort"
+	"strings"
 	"sync"
 
 	"github.com/cbeuw/Cloak/internal/server/usermanager"
 
 	mux "github.com/cbeuw/Cloak/internal/multiplex"
+	log "github.com/sirupsen/logrus"
 )
 
 type ActiveUser struct {
@@ -19,6 +25,100 @@ type ActiveUser struct {
 
 	sessionsM sync.RWMutex
 	sessions  map[uint32]*mux.Session
+
+	// ratesM protects upRate, downRate and quota
+	ratesM sync.Mutex
+	// the user's own rates from its UserInfo
+	upRate, downRate int64
+	// quota is the last WARN or THROTTLE StatusResponse the user got, or nil if its last status upload got neither.
+	// A THROTTLE overrides the user's own rates with its rates
+	quota *usermanager.StatusResponse
+
+	// proxyRulesM protects allowedProxyMethods and proxyBook, which come from the AllowedProxyMethods and
+	// ProxyEndpoints of the user's UserInfo
+	proxyRulesM sync.RWMutex
+	// nil if the user can use every proxy method
+	allowedProxyMethods map[string]bool
+	// the user's own entries, taking precedence over State.ProxyBook
+	proxyBook map[string]net.Addr
+}
+
+// setRates sets the user's own rates, which apply unless it's throttled
+func (u *ActiveUser) setRates(upRate, downRate int64) {
+	u.ratesM.Lock()
+	defer u.ratesM.Unlock()
+	u.upRate, u.downRate = upRate, downRate
+	u.applyRates()
+}
+
+// setQuotaStatus takes the WARN or THROTTLE response the user got from its last status upload, or nil if it got
+// neither
+func (u *ActiveUser) setQuotaStatus(resp *usermanager.StatusResponse) {
+	u.ratesM.Lock()
+	defer u.ratesM.Unlock()
+	if resp != nil && (u.quota == nil || u.quota.Action != resp.Action) {
+		fields := log.Fields{
+			"UID":    base64.StdEncoding.EncodeToString(u.arrUID[:]),
+			"reason": resp.Message,
+		}
+		if resp.Action == usermanager.THROTTLE {
+			log.WithFields(fields).Warn("Throttling user")
+		} else {
+			log.WithFields(fields).Warn("User is running out of quota")
+		}
+	}
+	u.quota = resp
+	u.applyRates()
+}
+
+// applyRates must be called with ratesM held
+func (u *ActiveUser) applyRates() {
+	if u.quota != nil && u.quota.Action == usermanager.THROTTLE {
+		u.valve.SetRates(u.quota.UpRate, u.quota.DownRate)
+		return
+	}
+	u.valve.SetRates(u.upRate, u.downRate)
+}
+
+var ErrProxyMethodNotAllowed = errors.New("proxy method not allowed for this user")
+
+// setProxyRules takes the proxy method allowlist and endpoints from uinfo. The existing rules are kept if the
+// endpoints can't be parsed
+func (u *ActiveUser) setProxyRules(uinfo usermanager.UserInfo) error {
+	proxyBook, err := parseProxyBook(uinfo.ProxyEndpoints)
+	if err != nil {
+		return err
+	}
+	var allowed map[string]bool
+	if len(uinfo.AllowedProxyMethods) != 0 {
+		allowed = make(map[string]bool)
+		for _, method := range uinfo.AllowedProxyMethods {
+			allowed[strings.ToLower(method)] = true
+		}
+	}
+	u.proxyRulesM.Lock()
+	u.allowedProxyMethods = allowed
+	u.proxyBook = proxyBook
+	u.proxyRulesM.Unlock()
+	return nil
+}
+
+// proxyAddr returns the address of the proxy server proxyMethod leads to for this user, looking in the user's own
+// endpoints before book
+func (u *ActiveUser) proxyAddr(proxyMethod string, book map[string]net.Addr) (net.Addr, error) {
+	proxyMethod = strings.ToLower(proxyMethod)
+	u.proxyRulesM.RLock()
+	defer u.proxyRulesM.RUnlock()
+	if u.allowedProxyMethods != nil && !u.allowedProxyMethods[proxyMethod] {
+		return nil, ErrProxyMethodNotAllowed
+	}
+	if addr, ok := u.proxyBook[proxyMethod]; ok {
+		return addr, nil
+	}
+	if addr, ok := book[proxyMethod]; ok {
+		return addr, nil
+	}
+	return nil, ErrBadProxyMethod
 }
 
 // CloseSession closes a session and removes its reference from the user
@@ -71,9 +171,59 @@ func (u *ActiveUser) closeAllSessions(reason string) {
 	u.sessionsM.Unlock()
 }
 
+// enforceSessionsCap closes the sessions over sessionsCap, those with the fewest streams first
+func (u *ActiveUser) enforceSessionsCap(sessionsCap int, reason string) {
+	u.sessionsM.RLock()
+	excess := len(u.sessions) - sessionsCap
+	if excess <= 0 {
+		u.sessionsM.RUnlock()
+		return
+	}
+	type seshStreams struct {
+		id         uint32
+		numStreams int
+	}
+	var sessions []seshStreams
+	for sessionID, sesh := range u.sessions {
+		sessions = append(sessions, seshStreams{sessionID, sesh.NumStreams()})
+	}
+	u.sessionsM.RUnlock()
+
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].numStreams < sessions[j].numStreams })
+	for _, sesh := range sessions[:excess] {
+		u.CloseSession(sesh.id, reason)
+	}
+}
+
 // NumSession returns the number of active sessions
 func (u *ActiveUser) NumSession() int {
 	u.sessionsM.RLock()
 	defer u.sessionsM.RUnlock()
 	return len(u.sessions)
 }
+
+// status describes the user and its sessions for the admin API
+func (u *ActiveUser) status() usermanager.ActiveUserStatus {
+	status := usermanager.ActiveUserStatus{
+		UID:      u.arrUID[:],
+		Bypass:   u.bypass,
+		RxBytes:  u.valve.GetRx(),
+		TxBytes:  u.valve.GetTx(),
+		Sessions: []usermanager.SessionStatus{},
+	}
+	u.sessionsM.RLock()
+	for sessionID, sesh := range u.sessions {
+		var remoteAddrs []string
+		for _, addr := range sesh.RemoteAddrs() {
+			remoteAddrs = append(remoteAddrs, addr.String())
+		}
+		status.Sessions = append(status.Sessions, usermanager.SessionStatus{
+			SessionID:   sessionID,
+			NumStreams:  sesh.NumStreams(),
+			RemoteAddrs: remoteAddrs,
+		})
+	}
+	u.sessionsM.RUnlock()
+	sort.Slice(status.Sessions, func(i, j int) bool { return status.Sessions[i].SessionID < status.Sessions[j].SessionID })
+	return status
+}
@@ -4,12 +4,14 @@ import (
 	"crypto/rand"
 	"encoding/base64"
 	"io/ioutil"
+	"net"
 	"os"
 	"testing"
 
 	"github.com/cbeuw/Cloak/internal/common"
 	mux "github.com/cbeuw/Cloak/internal/multiplex"
 	"github.com/cbeuw/Cloak/internal/server/usermanager"
+	"github.com/stretchr/testify/assert"
 )
 
 func getSeshConfig(unordered bool) mux.SessionConfig {
@@ -121,3 +123,40 @@ func TestActiveUser_Bypass(t *testing.T) {
 		t.Fatal("failed to close localmanager", err)
 	}
 }
+
+func TestActiveUser_ProxyAddr(t *testing.T) {
+	book := map[string]net.Addr{
+		"shadowsocks": &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8388},
+		"openvpn":     &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1194},
+	}
+	user := &ActiveUser{}
+
+	addr, err := user.proxyAddr("openvpn", book)
+	assert.NoError(t, err)
+	assert.Equal(t, book["openvpn"], addr)
+	_, err = user.proxyAddr("tor", book)
+	assert.Equal(t, ErrBadProxyMethod, err)
+
+	err = user.setProxyRules(usermanager.UserInfo{
+		AllowedProxyMethods: []string{"Shadowsocks", "tenant-a"},
+		ProxyEndpoints: map[string][]string{
+			"shadowsocks": {"tcp", "10.0.0.1:8388"},
+			"tenant-a":    {"tcp", "10.0.0.2:8388"},
+		},
+	})
+	assert.NoError(t, err)
+
+	addr, err = user.proxyAddr("shadowsocks", book)
+	assert.NoError(t, err)
+	assert.Equal(t, "10.0.0.1:8388", addr.String(), "the user's own endpoint should take precedence")
+	addr, err = user.proxyAddr("tenant-a", book)
+	assert.NoError(t, err)
+	assert.Equal(t, "10.0.0.2:8388", addr.String())
+	_, err = user.proxyAddr("openvpn", book)
+	assert.Equal(t, ErrProxyMethodNotAllowed, err)
+
+	err = user.setProxyRules(usermanager.UserInfo{ProxyEndpoints: map[string][]string{"bad": {"tcp"}}})
+	assert.Error(t, err)
+	_, err = user.proxyAddr("openvpn", book)
+	assert.Equal(t, ErrProxyMethodNotAllowed, err, "rules should be kept when the new ones are invalid")
+}
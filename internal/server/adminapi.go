@@ -0,0 +1,90 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/server/usermanager"
+)
+
+// AdminAPIConfig configures an HTTPS listener serving the user management API directly, without going through an
+// AdminUID session
+type AdminAPIConfig struct {
+	BindAddr string
+	CertFile string
+	KeyFile  string
+	// Tokens maps bearer tokens to their scopes, either "read" or "write"
+	Tokens map[string]string
+	// ClientCAFile enables authentication by client certificates signed by the CAs in it
+	ClientCAFile string
+	// ClientCertScopes maps the common names of client certificates to their scopes. The common name "*" matches
+	// any certificate signed by the CAs in ClientCAFile
+	ClientCertScopes map[string]string
+}
+
+func parseScopes(raw map[string]string) (map[string]usermanager.Scope, error) {
+	scopes := make(map[string]usermanager.Scope)
+	for k, v := range raw {
+		scope, err := usermanager.ParseScope(v)
+		if err != nil {
+			return nil, err
+		}
+		scopes[k] = scope
+	}
+	return scopes, nil
+}
+
+// makeAdminAPIServer makes the http.Server of the admin API. The certificate and key are read here, so ListenAndServeTLS
+// must be called with empty file names
+func makeAdminAPIServer(conf AdminAPIConfig, panel *userPanel) (*http.Server, error) {
+	if conf.BindAddr == "" {
+		return nil, errors.New("BindAddr cannot be empty")
+	}
+	if len(conf.Tokens) == 0 && conf.ClientCAFile == "" {
+		return nil, errors.New("either Tokens or ClientCAFile must be set, the admin API can't be left open")
+	}
+
+	cert, err := tls.LoadX509KeyPair(conf.CertFile, conf.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load certificate: %w", err)
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	tokens, err := parseScopes(conf.Tokens)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Tokens: %w", err)
+	}
+	clientCertScopes, err := parseScopes(conf.ClientCertScopes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ClientCertScopes: %w", err)
+	}
+	if conf.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(conf.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ClientCAFile: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificate found in ClientCAFile")
+		}
+		tlsConfig.ClientCAs = pool
+		// callers without a certificate can still use a token
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	auth := usermanager.MakeAPIAuth(tokens, clientCertScopes)
+	return &http.Server{
+		Addr:              conf.BindAddr,
+		Handler:           auth.Middleware(usermanager.APIRouterOf(panel.Manager, panel)),
+		TLSConfig:         tlsConfig,
+		ReadHeaderTimeout: 10 * time.Second,
+	}, nil
+}
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/server/usermanager"
+	"github.com/stretchr/testify/assert"
+)
+
+// makeCert makes a certificate signed by parent, or a self-signed CA if parent is nil
+func makeCert(t *testing.T, cn string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, tls.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return cert, key, tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func writePEM(t *testing.T, path string, typ string, der []byte) {
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAdminAPI(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey, _ := makeCert(t, "ca", nil, nil)
+	serverCert, serverKey, _ := makeCert(t, "server", ca, caKey)
+	_, _, clientCert := makeCert(t, "automation", ca, caKey)
+
+	writePEM(t, filepath.Join(dir, "ca.pem"), "CERTIFICATE", ca.Raw)
+	writePEM(t, filepath.Join(dir, "cert.pem"), "CERTIFICATE", serverCert.Raw)
+	keyDer, _ := x509.MarshalECPrivateKey(serverKey)
+	writePEM(t, filepath.Join(dir, "key.pem"), "EC PRIVATE KEY", keyDer)
+
+	conf := AdminAPIConfig{
+		BindAddr:         "127.0.0.1:0",
+		CertFile:         filepath.Join(dir, "cert.pem"),
+		KeyFile:          filepath.Join(dir, "key.pem"),
+		Tokens:           map[string]string{"reader": "read"},
+		ClientCAFile:     filepath.Join(dir, "ca.pem"),
+		ClientCertScopes: map[string]string{"automation": "write"},
+	}
+	manager, err := usermanager.MakeLocalManager(filepath.Join(dir, "userinfo.db"), mockWorldState)
+	if err != nil {
+		t.Fatal(err)
+	}
+	panel := MakeUserPanel(manager)
+	srv, err := makeAdminAPIServer(conf, panel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", conf.BindAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.ServeTLS(l, "", "")
+	defer srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	url := "https://" + l.Addr().String() + "/admin/users/" + "AAECAwQFBgcICQoLDA0ODw=="
+
+	t.Run("token", func(t *testing.T) {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+		req, _ := http.NewRequest("DELETE", url, nil)
+		req.Header.Set("Authorization", "Bearer reader")
+		resp, err := client.Do(req)
+		if assert.NoError(t, err) {
+			assert.Equal(t, http.StatusForbidden, resp.StatusCode, "a read token can't delete")
+			resp.Body.Close()
+		}
+
+		resp, err = client.Get("https://" + l.Addr().String() + "/admin/users")
+		if assert.NoError(t, err) {
+			assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+			resp.Body.Close()
+		}
+	})
+
+	t.Run("client certificate", func(t *testing.T) {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			RootCAs:      roots,
+			Certificates: []tls.Certificate{clientCert},
+		}}}
+		resp, err := client.Get("https://" + l.Addr().String() + "/admin/users")
+		if assert.NoError(t, err) {
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			resp.Body.Close()
+		}
+	})
+
+	t.Run("no authentication configured", func(t *testing.T) {
+		conf := conf
+		conf.Tokens = nil
+		conf.ClientCAFile = ""
+		_, err := makeAdminAPIServer(conf, panel)
+		assert.Error(t, err)
+	})
+}
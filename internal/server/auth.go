@@ -18,7 +18,13 @@ type ClientInfo struct {
 	ProxyMethod      string
 	EncryptionMethod byte
 	Unordered        bool
-	Transport        Transport
+	StreamOpenAck    bool
+	// ExactMimic is set by clients that find the key_share of a ServerHello wherever it is and read records of any
+	// length, so that the replies of the redirection targets can be imitated without being altered
+	ExactMimic bool
+	// Pings is set by clients that ping the server and wait for it to announce that it answers pings
+	Pings     bool
+	Transport Transport
 }
 
 type authFragments struct {
@@ -28,7 +34,10 @@ type authFragments struct {
 }
 
 const (
-	UNORDERED_FLAG = 0x01 // 0000 0001
+	UNORDERED_FLAG       = 0x01 // 0000 0001
+	STREAM_OPEN_ACK_FLAG = 0x02 // 0000 0010
+	EXACT_MIMIC_FLAG     = 0x04 // 0000 0100
+	PING_FLAG            = 0x08 // 0000 1000
 )
 
 var ErrTimestampOutOfWindow = errors.New("timestamp is outside of the accepting window")
@@ -47,6 +56,9 @@ func decryptClientInfo(fragments authFragments, serverTime time.Time) (info Clie
 		ProxyMethod:      string(bytes.Trim(plaintext[16:28], "\x00")),
 		EncryptionMethod: plaintext[28],
 		Unordered:        plaintext[41]&UNORDERED_FLAG != 0,
+		StreamOpenAck:    plaintext[41]&STREAM_OPEN_ACK_FLAG != 0,
+		ExactMimic:       plaintext[41]&EXACT_MIMIC_FLAG != 0,
+		Pings:            plaintext[41]&PING_FLAG != 0,
 	}
 
 	timestamp := int64(binary.BigEndian.Uint64(plaintext[29:37]))
@@ -68,7 +80,7 @@ var ErrBadDecryption = errors.New("decryption/authentication failure")
 // is authorised. It also returns a finisher callback function to be called when the caller wishes to proceed with
 // the handshake
 func AuthFirstPacket(firstPacket []byte, transport Transport, sta *State) (info ClientInfo, finisher Responder, err error) {
-	fragments, finisher, err := transport.processFirstPacket(firstPacket, sta.StaticPv)
+	fragments, finisher, err := transport.processFirstPacket(firstPacket, sta.StaticPv, sta.serverHelloMimic)
 	if err != nil {
 		return
 	}
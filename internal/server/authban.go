@@ -0,0 +1,214 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/server/usermanager"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	BanModeRedirect = "redirect"
+	BanModeDrop     = "drop"
+)
+
+// AuthBanConfig bans subnets that fail authentication too often
+type AuthBanConfig struct {
+	// MaxFailures is the number of failed authentications from a subnet within Window seconds after which the subnet
+	// is banned for BanDuration seconds. Zero disables banning
+	MaxFailures int
+	Window      int
+	BanDuration int
+	// IPv4PrefixLen and IPv6PrefixLen are the sizes of the subnets failures are counted over. They default to 32
+	// and 64
+	IPv4PrefixLen int
+	IPv6PrefixLen int
+	// Mode is what's done with connections from banned subnets. redirect, the default, forwards them to the
+	// redirection target without trying to authenticate them, and drop closes them straight away.
+	//
+	// Every ordinary visitor of the redirection target counts as a failure: a browser's ClientHello has a 32-byte
+	// session id and an x25519 key share like a Cloak client's, so it can only be told apart from a Cloak client with
+	// a wrong key by failing to decrypt it. With drop, a subnet of real visitors that reaches MaxFailures sees the
+	// site go offline, so MaxFailures has to be set well above how often a subnet visits within Window
+	Mode string
+}
+
+func (c *AuthBanConfig) validate() error {
+	if c.MaxFailures < 0 || c.Window < 0 || c.BanDuration < 0 {
+		return errors.New("MaxFailures, Window and BanDuration cannot be negative")
+	}
+	if c.MaxFailures > 0 && (c.Window == 0 || c.BanDuration == 0) {
+		return errors.New("Window and BanDuration must be set along with MaxFailures")
+	}
+	if c.IPv4PrefixLen == 0 {
+		c.IPv4PrefixLen = 32
+	}
+	if c.IPv6PrefixLen == 0 {
+		c.IPv6PrefixLen = 64
+	}
+	if c.IPv4PrefixLen < 0 || c.IPv4PrefixLen > 32 || c.IPv6PrefixLen < 0 || c.IPv6PrefixLen > 128 {
+		return errors.New("invalid prefix length")
+	}
+	switch c.Mode {
+	case "":
+		c.Mode = BanModeRedirect
+	case BanModeRedirect, BanModeDrop:
+	default:
+		return fmt.Errorf("unknown Mode %v, must be redirect or drop", c.Mode)
+	}
+	return nil
+}
+
+type authFailures struct {
+	count       int
+	windowStart time.Time
+	bannedUntil time.Time
+}
+
+// authBans counts the failed authentications from each subnet and bans the ones with too many of them
+type authBans struct {
+	conf AuthBanConfig
+	now  func() time.Time
+
+	failuresM sync.Mutex
+	failures  map[string]*authFailures
+}
+
+func makeAuthBans(conf AuthBanConfig, now func() time.Time) *authBans {
+	return &authBans{
+		conf:     conf,
+		now:      now,
+		failures: make(map[string]*authFailures),
+	}
+}
+
+func (b *authBans) enabled() bool {
+	return b != nil && b.conf.MaxFailures > 0
+}
+
+// subnetOf returns the subnet addr is counted under in CIDR notation, or an empty string if addr isn't an IP address
+func (b *authBans) subnetOf(addr net.Addr) string {
+	var ip net.IP
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		ip = addr.IP
+	case *net.UDPAddr:
+		ip = addr.IP
+	default:
+		host, _, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			return ""
+		}
+		ip = net.ParseIP(host)
+	}
+	if ip == nil {
+		return ""
+	}
+	mask := net.CIDRMask(b.conf.IPv6PrefixLen, 128)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, mask = ip4, net.CIDRMask(b.conf.IPv4PrefixLen, 32)
+	}
+	return (&net.IPNet{IP: ip.Mask(mask), Mask: mask}).String()
+}
+
+// recordFailure counts a failed authentication from addr, banning its subnet if it has failed too often
+func (b *authBans) recordFailure(addr net.Addr) {
+	if !b.enabled() {
+		return
+	}
+	subnet := b.subnetOf(addr)
+	if subnet == "" {
+		return
+	}
+	now := b.now()
+	b.failuresM.Lock()
+	defer b.failuresM.Unlock()
+	f, ok := b.failures[subnet]
+	if !ok {
+		f = &authFailures{windowStart: now}
+		b.failures[subnet] = f
+	} else if now.Sub(f.windowStart) > time.Duration(b.conf.Window)*time.Second {
+		f.count = 0
+		f.windowStart = now
+	}
+	f.count++
+	if f.count >= b.conf.MaxFailures && !now.Before(f.bannedUntil) {
+		banDuration := time.Duration(b.conf.BanDuration) * time.Second
+		f.bannedUntil = now.Add(banDuration)
+		log.WithField("subnet", subnet).Warnf("Banning for %v after %v failed authentications", banDuration, f.count)
+	}
+}
+
+// isBanned tells whether the subnet of addr is banned right now
+func (b *authBans) isBanned(addr net.Addr) bool {
+	if !b.enabled() {
+		return false
+	}
+	subnet := b.subnetOf(addr)
+	b.failuresM.Lock()
+	defer b.failuresM.Unlock()
+	f, ok := b.failures[subnet]
+	return ok && b.now().Before(f.bannedUntil)
+}
+
+// sweep forgets the subnets that are neither banned nor within a window of failures
+func (b *authBans) sweep() {
+	now := b.now()
+	b.failuresM.Lock()
+	defer b.failuresM.Unlock()
+	for subnet, f := range b.failures {
+		if !now.Before(f.bannedUntil) && now.Sub(f.windowStart) > time.Duration(b.conf.Window)*time.Second {
+			delete(b.failures, subnet)
+		}
+	}
+}
+
+// sweeper sweeps every minute
+func (b *authBans) sweeper() {
+	for {
+		time.Sleep(time.Minute)
+		b.sweep()
+	}
+}
+
+func (b *authBans) list() []usermanager.Ban {
+	now := b.now()
+	b.failuresM.Lock()
+	defer b.failuresM.Unlock()
+	bans := []usermanager.Ban{}
+	for subnet, f := range b.failures {
+		if now.Before(f.bannedUntil) {
+			bans = append(bans, usermanager.Ban{Subnet: subnet, Failures: f.count, Until: f.bannedUntil.Unix()})
+		}
+	}
+	sort.Slice(bans, func(i, j int) bool { return bans[i].Subnet < bans[j].Subnet })
+	return bans
+}
+
+// clear lifts the ban on subnet, given in CIDR notation
+func (b *authBans) clear(subnet string) error {
+	_, ipNet, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return usermanager.ErrBanNotFound
+	}
+	subnet = ipNet.String()
+	b.failuresM.Lock()
+	defer b.failuresM.Unlock()
+	f, ok := b.failures[subnet]
+	if !ok || !b.now().Before(f.bannedUntil) {
+		return usermanager.ErrBanNotFound
+	}
+	delete(b.failures, subnet)
+	return nil
+}
+
+func (b *authBans) clearAll() {
+	b.failuresM.Lock()
+	defer b.failuresM.Unlock()
+	b.failures = make(map[string]*authFailures)
+}
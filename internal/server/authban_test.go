@@ -0,0 +1,107 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/server/usermanager"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthBanConfig_Validate(t *testing.T) {
+	conf := AuthBanConfig{MaxFailures: 5, Window: 60, BanDuration: 600}
+	assert.NoError(t, conf.validate())
+	assert.Equal(t, 32, conf.IPv4PrefixLen)
+	assert.Equal(t, 64, conf.IPv6PrefixLen)
+	assert.Equal(t, BanModeRedirect, conf.Mode)
+
+	assert.NoError(t, (&AuthBanConfig{}).validate(), "banning is disabled by default")
+	assert.Error(t, (&AuthBanConfig{MaxFailures: 5}).validate())
+	assert.Error(t, (&AuthBanConfig{MaxFailures: 5, Window: 60, BanDuration: 600, Mode: "tarpit"}).validate())
+	assert.Error(t, (&AuthBanConfig{IPv4PrefixLen: 33}).validate())
+}
+
+func TestAuthBans(t *testing.T) {
+	now := time.Unix(1000, 0)
+	conf := AuthBanConfig{MaxFailures: 3, Window: 60, BanDuration: 600, IPv4PrefixLen: 24}
+	_ = conf.validate()
+	bans := makeAuthBans(conf, func() time.Time { return now })
+	addr := func(ip string) net.Addr { return &net.TCPAddr{IP: net.ParseIP(ip), Port: 12345} }
+
+	bans.recordFailure(addr("192.0.2.1"))
+	bans.recordFailure(addr("192.0.2.2"))
+	assert.False(t, bans.isBanned(addr("192.0.2.1")))
+	now = now.Add(61 * time.Second)
+	bans.recordFailure(addr("192.0.2.1"))
+	assert.False(t, bans.isBanned(addr("192.0.2.1")), "failures outside of the window don't count")
+
+	bans.recordFailure(addr("192.0.2.3"))
+	bans.recordFailure(addr("192.0.2.4"))
+	assert.True(t, bans.isBanned(addr("192.0.2.200")), "the whole /24 is banned")
+	assert.False(t, bans.isBanned(addr("198.51.100.1")))
+	assert.Equal(t, []usermanager.Ban{{Subnet: "192.0.2.0/24", Failures: 3, Until: now.Add(600 * time.Second).Unix()}},
+		bans.list())
+
+	now = now.Add(601 * time.Second)
+	assert.False(t, bans.isBanned(addr("192.0.2.1")), "bans expire")
+	bans.sweep()
+	assert.Empty(t, bans.failures)
+
+	bans.recordFailure(addr("2001:db8::1"))
+	bans.recordFailure(addr("2001:db8::2"))
+	bans.recordFailure(addr("2001:db8::3"))
+	assert.True(t, bans.isBanned(addr("2001:db8::ffff")))
+	assert.Equal(t, usermanager.ErrBanNotFound, bans.clear("192.0.2.0/24"))
+	assert.NoError(t, bans.clear("2001:db8::1/64"))
+	assert.False(t, bans.isBanned(addr("2001:db8::1")))
+
+	var disabled *authBans
+	disabled.recordFailure(addr("192.0.2.1"))
+	assert.False(t, disabled.isBanned(addr("192.0.2.1")))
+}
+
+func TestDispatchConnection_Banned(t *testing.T) {
+	conf := AuthBanConfig{MaxFailures: 1, Window: 60, BanDuration: 600, Mode: BanModeDrop}
+	_ = conf.validate()
+	sta := &State{authBans: makeAuthBans(conf, time.Now)}
+	sta.authBans.recordFailure(&net.TCPAddr{IP: net.ParseIP("127.0.0.1")})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			dispatchConnection(conn, sta)
+		}
+	}()
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = client.Read(make([]byte, 1))
+	assert.Error(t, err)
+	if netErr, ok := err.(net.Error); ok {
+		assert.False(t, netErr.Timeout(), "a banned connection should be closed straight away")
+	}
+}
+
+func TestUserPanel_BanPanel(t *testing.T) {
+	conf := AuthBanConfig{MaxFailures: 1, Window: 60, BanDuration: 600}
+	_ = conf.validate()
+	panel := &userPanel{bans: makeAuthBans(conf, time.Now)}
+	var bans usermanager.BanPanel = panel
+	panel.bans.recordFailure(&net.TCPAddr{IP: net.ParseIP("192.0.2.1")})
+	if assert.Len(t, bans.ListBans(), 1) {
+		assert.Equal(t, "192.0.2.1/32", bans.ListBans()[0].Subnet)
+	}
+	assert.NoError(t, bans.ClearBan("192.0.2.1/32"))
+	assert.Empty(t, bans.ListBans())
+
+	assert.Empty(t, (&userPanel{}).ListBans())
+}
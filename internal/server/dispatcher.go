@@ -9,6 +9,7 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"syscall"
 	"time"
 
 	"github.com/cbeuw/Cloak/internal/common"
@@ -22,7 +23,9 @@ var b64 = base64.StdEncoding.EncodeToString
 
 const firstPacketSize = 3000
 
-func Serve(l net.Listener, sta *State) {
+// Serve dispatches the connections accepted by l. Connections using transports other than the given ones are sent to
+// the redirection target. No transports means all of them are accepted
+func Serve(l net.Listener, sta *State, transports ...Transport) {
 	waitDur := [10]time.Duration{
 		50 * time.Millisecond, 100 * time.Millisecond, 300 * time.Millisecond, 500 * time.Millisecond, 1 * time.Second,
 		3 * time.Second, 5 * time.Second, 10 * time.Second, 15 * time.Second, 30 * time.Second}
@@ -39,7 +42,7 @@ func Serve(l net.Listener, sta *State) {
 			continue
 		}
 		fails = 0
-		go dispatchConnection(conn, sta)
+		go dispatchConnection(conn, sta, transports...)
 	}
 }
 
@@ -70,7 +73,6 @@ func readFirstPacket(conn net.Conn, buf []byte, timeout time.Duration) (int, Tra
 		return 0, nil, false, err
 	}
 
-	// TODO: give the option to match the protocol with port
 	bufOffset := 1
 	var transport Transport
 	switch buf[0] {
@@ -124,7 +126,24 @@ func readFirstPacket(conn net.Conn, buf []byte, timeout time.Duration) (int, Tra
 	return bufOffset, transport, true, nil
 }
 
-func dispatchConnection(conn net.Conn, sta *State) {
+func dispatchConnection(conn net.Conn, sta *State, transports ...Transport) {
+	if sta.proxyProtocol.trusts(conn.RemoteAddr()) {
+		proxied, err := readProxyProtoHeader(conn, 15*time.Second)
+		if err != nil {
+			log.WithField("remoteAddr", conn.RemoteAddr()).
+				Warnf("error reading PROXY protocol header: %v", err)
+			conn.Close()
+			return
+		}
+		conn = proxied
+	}
+
+	banned := sta.authBans.isBanned(conn.RemoteAddr())
+	if banned && sta.authBans.conf.Mode == BanModeDrop {
+		conn.Close()
+		return
+	}
+
 	var err error
 	buf := make([]byte, firstPacketSize)
 
@@ -132,22 +151,7 @@ func dispatchConnection(conn net.Conn, sta *State) {
 	data := buf[:i]
 
 	goWeb := func() {
-		redirPort := sta.RedirPort
-		if redirPort == "" {
-			_, redirPort, _ = net.SplitHostPort(conn.LocalAddr().String())
-		}
-		webConn, err := sta.RedirDialer.Dial("tcp", net.JoinHostPort(sta.RedirHost.String(), redirPort))
-		if err != nil {
-			log.Errorf("Making connection to redirection server: %v", err)
-			return
-		}
-		_, err = webConn.Write(data)
-		if err != nil {
-			log.Error("Failed to send first packet to redirection server", err)
-			return
-		}
-		go common.Copy(webConn, conn)
-		go common.Copy(conn, webConn)
+		sta.redirect(conn, data, transport)
 	}
 
 	if err != nil {
@@ -161,6 +165,24 @@ func dispatchConnection(conn net.Conn, sta *State) {
 		return
 	}
 
+	if banned {
+		goWeb()
+		return
+	}
+
+	if sta.site != nil && isACMEChallenge(data, transport) {
+		// it can't be a Cloak client, and failing it as one could ban the CA
+		goWeb()
+		return
+	}
+
+	if !acceptsTransport(transports, transport) {
+		log.WithField("remoteAddr", conn.RemoteAddr()).
+			Debugf("%v is not accepted on %v, redirecting", transport, conn.LocalAddr())
+		goWeb()
+		return
+	}
+
 	ci, finishHandshake, err := AuthFirstPacket(data, transport, sta)
 	if err != nil {
 		log.WithFields(log.Fields{
@@ -170,6 +192,9 @@ func dispatchConnection(conn net.Conn, sta *State) {
 			"proxyMethod":      ci.ProxyMethod,
 			"encryptionMethod": ci.EncryptionMethod,
 		}).Warn(err)
+		if errors.Is(err, ErrBadDecryption) || errors.Is(err, ErrReplay) {
+			sta.authBans.recordFailure(conn.RemoteAddr())
+		}
 		goWeb()
 		return
 	}
@@ -193,6 +218,8 @@ func dispatchConnection(conn net.Conn, sta *State) {
 		Obfuscator:         obfuscator,
 		Valve:              nil,
 		Unordered:          ci.Unordered,
+		StreamOpenAck:      ci.StreamOpenAck,
+		AnnouncePings:      ci.Pings,
 		MsgOnWireSizeLimit: appDataMaxLength,
 	}
 
@@ -201,7 +228,7 @@ func dispatchConnection(conn net.Conn, sta *State) {
 	// and normal proxy mode is that sessionID needs == 0 for admin mode
 	if len(sta.AdminUID) != 0 && bytes.Equal(ci.UID, sta.AdminUID) && ci.SessionId == 0 {
 		sesh := mux.MakeSession(0, seshConfig)
-		preparedConn, err := finishHandshake(conn, sessionKey, sta.WorldState.Rand)
+		preparedConn, err := finishHandshake(conn, ci, sessionKey, sta.WorldState.Rand)
 		if err != nil {
 			log.Error(err)
 			return
@@ -210,24 +237,12 @@ func dispatchConnection(conn net.Conn, sta *State) {
 		sesh.AddConnection(preparedConn)
 		//TODO: Router could be nil in cnc mode
 		log.WithField("remoteAddr", preparedConn.RemoteAddr()).Info("New admin session")
-		err = http.Serve(sesh, usermanager.APIRouterOf(sta.Panel.Manager))
+		err = http.Serve(sesh, usermanager.APIRouterOf(sta.Panel.Manager, sta.Panel))
 		// http.Serve never returns with non-nil error
 		log.Error(err)
 		return
 	}
 
-	if _, ok := sta.ProxyBook[ci.ProxyMethod]; !ok {
-		log.WithFields(log.Fields{
-			"remoteAddr":       conn.RemoteAddr(),
-			"UID":              b64(ci.UID),
-			"sessionId":        ci.SessionId,
-			"proxyMethod":      ci.ProxyMethod,
-			"encryptionMethod": ci.EncryptionMethod,
-		}).Error(ErrBadProxyMethod)
-		goWeb()
-		return
-	}
-
 	var user *ActiveUser
 	if sta.IsBypass(ci.UID) {
 		user, err = sta.Panel.GetBypassUser(ci.UID)
@@ -240,6 +255,24 @@ func dispatchConnection(conn net.Conn, sta *State) {
 			"remoteAddr": conn.RemoteAddr(),
 			"error":      err,
 		}).Warn("+1 unauthorised UID")
+		if err == usermanager.ErrUserNotFound || err == usermanager.ErrMangerIsVoid {
+			sta.authBans.recordFailure(conn.RemoteAddr())
+		}
+		goWeb()
+		return
+	}
+
+	if _, err := user.proxyAddr(ci.ProxyMethod, sta.ProxyBook); err != nil {
+		log.WithFields(log.Fields{
+			"remoteAddr":       conn.RemoteAddr(),
+			"UID":              b64(ci.UID),
+			"sessionId":        ci.SessionId,
+			"proxyMethod":      ci.ProxyMethod,
+			"encryptionMethod": ci.EncryptionMethod,
+		}).Error(err)
+		if user.NumSession() == 0 {
+			sta.Panel.TerminateActiveUser(user, "")
+		}
 		goWeb()
 		return
 	}
@@ -251,7 +284,7 @@ func dispatchConnection(conn net.Conn, sta *State) {
 		return
 	}
 
-	preparedConn, err := finishHandshake(conn, sesh.GetSessionKey(), sta.WorldState.Rand)
+	preparedConn, err := finishHandshake(conn, ci, sesh.GetSessionKey(), sta.WorldState.Rand)
 	if err != nil {
 		log.Error(err)
 		return
@@ -287,25 +320,69 @@ func serveSession(sesh *mux.Session, ci ClientInfo, user *ActiveUser, sta *State
 				continue
 			}
 		}
-		proxyAddr := sta.ProxyBook[ci.ProxyMethod]
-		localConn, err := sta.ProxyDialer.Dial(proxyAddr.Network(), proxyAddr.String())
-		if err != nil {
-			log.Errorf("Failed to connect to %v: %v", ci.ProxyMethod, err)
-			user.CloseSession(ci.SessionId, "Failed to connect to proxy server")
-			return err
-		}
-		log.Tracef("%v endpoint has been successfully connected", ci.ProxyMethod)
-
-		go func() {
-			if _, err := common.Copy(localConn, newStream); err != nil {
-				log.Tracef("copying stream to proxy server: %v", err)
+		go func(newStream *mux.Stream) {
+			// looked up for every stream so that changes to the user's proxy rules apply to its existing sessions
+			proxyAddr, err := user.proxyAddr(ci.ProxyMethod, sta.ProxyBook)
+			if err != nil {
+				log.WithField("UID", b64(ci.UID)).Warnf("rejecting stream for %v: %v", ci.ProxyMethod, err)
+				if err := newStream.AckOpen(mux.StreamOpenErrRefused); err != nil {
+					log.Debugf("rejecting stream: %v", err)
+				}
+				return
+			}
+			localConn, err := sta.ProxyDialer.Dial(proxyAddr.Network(), proxyAddr.String())
+			if err != nil {
+				log.Errorf("Failed to connect to %v: %v", ci.ProxyMethod, err)
+				// only this stream is affected. The client is told why so that it can close its local connection
+				if err := newStream.AckOpen(streamOpenErrorOf(err)); err != nil {
+					log.Debugf("rejecting stream: %v", err)
+				}
+				return
+			}
+			if _, ok := proxyAddr.(proxyProtoAddr); ok {
+				var sessionId [4]byte
+				binary.BigEndian.PutUint32(sessionId[:], ci.SessionId)
+				header := proxyProtoV2Header(newStream.RemoteAddr(), newStream.LocalAddr(),
+					proxyProtoTLV{proxyProtoTLVUID, ci.UID},
+					proxyProtoTLV{proxyProtoTLVSessionID, sessionId[:]})
+				if _, err := localConn.Write(header); err != nil {
+					log.Errorf("Failed to send PROXY protocol header to %v: %v", ci.ProxyMethod, err)
+					if err := newStream.AckOpen(mux.StreamOpenErrGeneric); err != nil {
+						log.Debugf("rejecting stream: %v", err)
+					}
+					localConn.Close()
+					return
+				}
+			}
+			log.Tracef("%v endpoint has been successfully connected", ci.ProxyMethod)
+			if err := newStream.AckOpen(nil); err != nil {
+				log.Debugf("acknowledging stream: %v", err)
+				localConn.Close()
+				return
 			}
-		}()
 
-		go func() {
-			if _, err := common.Copy(newStream, localConn); err != nil {
-				log.Tracef("copying proxy server to stream: %v", err)
+			errToProxy, errFromProxy := common.CopyBidirectional(newStream, localConn, common.DefaultHalfCloseTimeout)
+			if errToProxy != nil {
+				log.Tracef("copying stream to proxy server: %v", errToProxy)
+			}
+			if errFromProxy != nil {
+				log.Tracef("copying proxy server to stream: %v", errFromProxy)
 			}
-		}()
+		}(newStream.(*mux.Stream))
+	}
+}
+
+// streamOpenErrorOf works out the reason to give the client for a failed dial to the proxy server
+func streamOpenErrorOf(err error) mux.StreamOpenError {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return mux.StreamOpenErrRefused
+	case errors.Is(err, syscall.ENETUNREACH), errors.Is(err, syscall.EHOSTUNREACH):
+		return mux.StreamOpenErrUnreachable
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return mux.StreamOpenErrTimeout
+	default:
+		return mux.StreamOpenErrGeneric
 	}
 }
@@ -209,3 +209,50 @@ func TestReadFirstPacket(t *testing.T) {
 		assert.NoError(t, ret.err)
 	})
 }
+
+func TestParseTransports(t *testing.T) {
+	transports, err := ParseTransports("tls, WebSocket")
+	assert.NoError(t, err)
+	assert.Equal(t, []Transport{TLS{}, WebSocket{}}, transports)
+
+	_, err = ParseTransports("tls,quic")
+	assert.Error(t, err)
+
+	assert.True(t, acceptsTransport(nil, TLS{}))
+	assert.True(t, acceptsTransport([]Transport{WebSocket{}}, WebSocket{}))
+	assert.False(t, acceptsTransport([]Transport{WebSocket{}}, TLS{}))
+}
+
+func TestDispatchConnection_UnacceptedTransport(t *testing.T) {
+	web, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer web.Close()
+	go func() {
+		conn, err := web.Accept()
+		if err == nil {
+			io.Copy(conn, conn)
+		}
+	}()
+	host, port, _ := net.SplitHostPort(web.Addr().String())
+	sta := &State{
+		RedirHost:     host,
+		RedirPort:     port,
+		RedirDialer:   &net.Dialer{},
+		redirResolver: makeRedirResolver(time.Now),
+		redirLimiter:  makeRedirLimiter(RedirLimitsConfig{}),
+	}
+
+	conn, client := connutil.AsyncPipe()
+	defer client.Close()
+	go dispatchConnection(conn, sta, TLS{})
+
+	req := []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	client.Write(req)
+	buf := make([]byte, len(req))
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = io.ReadFull(client, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, req, buf, "a WebSocket request on a TLS only listener should be redirected")
+}
@@ -0,0 +1,277 @@
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// MimicConfig makes the replies to Cloak clients imitate those of the redirection targets: the cipher suite and
+// extensions of their ServerHello, whether they send a ChangeCipherSpec, and the sizes of their first encrypted
+// records. The targets are probed at start and every Interval seconds after that
+type MimicConfig struct {
+	// Interval defaults to an hour
+	Interval int
+}
+
+const (
+	defaultMimicInterval = time.Hour
+	mimicProbeTimeout    = 10 * time.Second
+	// maxReplyRecordLength is the longest record clients without ExactMimic accept in a reply, as they read them into
+	// a buffer of this size
+	maxReplyRecordLength = 1024
+	// minReplyRecordLength leaves room for the AEAD tag of a real encrypted record
+	minReplyRecordLength = 17
+
+	tlsRecordHeaderLength = 5
+)
+
+// serverHelloProfile is what a server's reply to a TLS 1.3 ClientHello looks like
+type serverHelloProfile struct {
+	cipherSuite [2]byte
+	// extensions are the ServerHello's extensions other than key_share, in their order, each including its type and
+	// length
+	extensions [][]byte
+	// keyShareIndex is where key_share goes among extensions
+	keyShareIndex int
+	ccs           bool
+	// appDataLengths are the lengths of the first encrypted records, up to two of them
+	appDataLengths []int
+}
+
+// defaultServerHelloProfile is used when no redirection target has been probed
+var defaultServerHelloProfile = &serverHelloProfile{
+	cipherSuite: [2]byte{0x13, 0x02}, // TLS_AES_256_GCM_SHA384
+	extensions:  [][]byte{{0x00, 0x2b, 0x00, 0x02, 0x03, 0x04}},
+	ccs:         true,
+}
+
+// serverHelloMimic keeps the profiles of the redirection targets
+type serverHelloMimic struct {
+	interval time.Duration
+	// targetOf returns the redirection target of a server name
+	targetOf func(serverName string) redirTarget
+	// dial connects to a redirection target
+	dial func(target redirTarget, port string) (net.Conn, error)
+
+	profilesM sync.RWMutex
+	profiles  map[redirTarget]*serverHelloProfile
+}
+
+func makeServerHelloMimic(conf MimicConfig, targetOf func(string) redirTarget, dial func(redirTarget, string) (net.Conn, error)) (*serverHelloMimic, error) {
+	if conf.Interval < 0 {
+		return nil, errors.New("Interval cannot be negative")
+	}
+	interval := time.Duration(conf.Interval) * time.Second
+	if interval == 0 {
+		interval = defaultMimicInterval
+	}
+	return &serverHelloMimic{
+		interval: interval,
+		targetOf: targetOf,
+		dial:     dial,
+		profiles: make(map[redirTarget]*serverHelloProfile),
+	}, nil
+}
+
+// profileOf returns the profile of the redirection target of serverName, or the default profile if it hasn't been
+// probed
+func (m *serverHelloMimic) profileOf(serverName string) *serverHelloProfile {
+	if m == nil {
+		return defaultServerHelloProfile
+	}
+	m.profilesM.RLock()
+	defer m.profilesM.RUnlock()
+	if profile, ok := m.profiles[m.targetOf(serverName)]; ok {
+		return profile
+	}
+	return defaultServerHelloProfile
+}
+
+// refresh probes targets, keeping the previous profile of a target that can't be probed
+func (m *serverHelloMimic) refresh(targets []redirTarget) {
+	probed := make(map[redirTarget]bool)
+	for _, target := range targets {
+		if probed[target] {
+			continue
+		}
+		probed[target] = true
+		profile, err := m.probe(target)
+		if err != nil {
+			log.Warnf("unable to probe the ServerHello of redirection target %v: %v", target.host, err)
+			continue
+		}
+		for _, alteration := range profile.legacyAlterations() {
+			log.Warnf("replies to clients without ExactMimic can't imitate redirection target %v exactly: %v",
+				target.host, alteration)
+		}
+		m.profilesM.Lock()
+		m.profiles[target] = profile
+		m.profilesM.Unlock()
+	}
+}
+
+// refresher refreshes the profiles of targets every interval
+func (m *serverHelloMimic) refresher(targets []redirTarget) {
+	for {
+		m.refresh(targets)
+		time.Sleep(m.interval)
+	}
+}
+
+func (m *serverHelloMimic) probe(target redirTarget) (*serverHelloProfile, error) {
+	port := target.port
+	if port == "" {
+		// targets are mostly reached on the port Cloak listens on, which is 443 for TLS
+		port = "443"
+	}
+	conn, err := m.dial(target, port)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return probeServerHello(conn, target.host)
+}
+
+// recordingConn keeps everything read from it
+type recordingConn struct {
+	net.Conn
+	read bytes.Buffer
+}
+
+func (c *recordingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.read.Write(b[:n])
+	return n, err
+}
+
+// probeServerHello does a TLS 1.3 handshake over conn with a ClientHello offering x25519 only like Cloak clients do,
+// and profiles the server's reply
+func probeServerHello(conn net.Conn, host string) (*serverHelloProfile, error) {
+	rec := &recordingConn{Conn: conn}
+	conf := &tls.Config{
+		// the certificate doesn't matter, only what the reply looks like
+		InsecureSkipVerify: true,
+		MinVersion:         tls.VersionTLS13,
+		CurvePreferences:   []tls.CurveID{tls.X25519},
+	}
+	if net.ParseIP(host) == nil {
+		conf.ServerName = host
+	}
+	tlsConn := tls.Client(rec, conf)
+	tlsConn.SetDeadline(time.Now().Add(mimicProbeTimeout))
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, err
+	}
+	return parseServerReply(rec.read.Bytes())
+}
+
+// parseServerReply profiles the records a server sent in reply to a ClientHello
+func parseServerReply(reply []byte) (*serverHelloProfile, error) {
+	profile := &serverHelloProfile{}
+	for i := 0; len(reply) >= tlsRecordHeaderLength && len(profile.appDataLengths) < 2; i++ {
+		typ := reply[0]
+		length := int(binary.BigEndian.Uint16(reply[3:5]))
+		if len(reply) < tlsRecordHeaderLength+length {
+			break
+		}
+		record := reply[tlsRecordHeaderLength : tlsRecordHeaderLength+length]
+		reply = reply[tlsRecordHeaderLength+length:]
+		switch {
+		case i == 0:
+			if typ != 0x16 {
+				return nil, fmt.Errorf("expecting a handshake record, got type %v", typ)
+			}
+			if err := parseServerHello(record, profile); err != nil {
+				return nil, err
+			}
+		case typ == 0x14:
+			profile.ccs = true
+		case typ == 0x17:
+			profile.appDataLengths = append(profile.appDataLengths, length)
+		}
+	}
+	return profile, nil
+}
+
+// helloRetryRequestRandom is the random of a ServerHello that is actually a HelloRetryRequest
+var helloRetryRequestRandom = []byte{
+	0xcf, 0x21, 0xad, 0x74, 0xe5, 0x9a, 0x61, 0x11, 0xbe, 0x1d, 0x8c, 0x02, 0x1e, 0x65, 0xb8, 0x91,
+	0xc2, 0xa2, 0x11, 0x16, 0x7a, 0xbb, 0x8c, 0x5e, 0x07, 0x9e, 0x09, 0xe2, 0xc8, 0xa8, 0x33, 0x9c,
+}
+
+func parseServerHello(sh []byte, profile *serverHelloProfile) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.New("malformed ServerHello")
+		}
+	}()
+	if sh[0] != 0x02 {
+		return errors.New("not a ServerHello")
+	}
+	if bytes.Equal(sh[6:38], helloRetryRequestRandom) {
+		return errors.New("got a HelloRetryRequest")
+	}
+	pointer := 38
+	sessionIdLen := int(sh[pointer])
+	pointer += 1 + sessionIdLen
+	copy(profile.cipherSuite[:], sh[pointer:pointer+2])
+	// cipher suite and compression method
+	pointer += 3
+	extensionsEnd := pointer + 2 + int(u16(sh[pointer:pointer+2]))
+	pointer += 2
+	for pointer < extensionsEnd {
+		length := int(u16(sh[pointer+2 : pointer+4]))
+		extension := sh[pointer : pointer+4+length]
+		pointer += 4 + length
+		if bytes.Equal(extension[0:2], []byte{0x00, 0x33}) {
+			// key_share carries Cloak's data
+			profile.keyShareIndex = len(profile.extensions)
+			continue
+		}
+		profile.extensions = append(profile.extensions, append([]byte{}, extension...))
+	}
+	return nil
+}
+
+// legacyAlterations describes how replies following p are altered for clients without ExactMimic
+func (p *serverHelloProfile) legacyAlterations() []string {
+	var alterations []string
+	if p.keyShareIndex != 0 {
+		alterations = append(alterations, fmt.Sprintf("key_share is moved to the front from position %v among "+
+			"the ServerHello's extensions", p.keyShareIndex))
+	}
+	for i, length := range p.appDataLengths {
+		if length > maxReplyRecordLength {
+			alterations = append(alterations, fmt.Sprintf("encrypted record %v is shortened to %v bytes from %v",
+				i+1, maxReplyRecordLength, length))
+		}
+	}
+	return alterations
+}
+
+// replyRecordLengths returns the lengths of the n records after the ServerHello and ChangeCipherSpec in a reply,
+// following the profile where it has them and using fallback otherwise. Records are kept within what the client can
+// read, which is less without exactMimic
+func (p *serverHelloProfile) replyRecordLengths(n int, fallback int, exactMimic bool) []int {
+	maxLength := maxReplyRecordLength
+	if exactMimic {
+		maxLength = appDataMaxLength
+	}
+	lengths := make([]int, n)
+	for i := range lengths {
+		if i < len(p.appDataLengths) {
+			lengths[i] = min(max(p.appDataLengths[i], minReplyRecordLength), maxLength)
+		} else {
+			lengths[i] = fallback
+		}
+	}
+	return lengths
+}
@@ -0,0 +1,170 @@
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"net"
+	"testing"
+
+	"github.com/cbeuw/Cloak/internal/common"
+	"github.com/stretchr/testify/assert"
+)
+
+// localTLSServer serves TLS 1.3 handshakes with a self-signed certificate until the test ends
+func localTLSServer(t *testing.T) net.Listener {
+	certFile, keyFile, _ := writeTestCert(t, t.TempDir())
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				conn.(*tls.Conn).Handshake()
+				conn.Close()
+			}()
+		}
+	}()
+	return l
+}
+
+func TestComposeReply_Default(t *testing.T) {
+	sessionId := bytes.Repeat([]byte{0x01}, 32)
+	reply := composeReply(sessionId, [12]byte{}, [48]byte{}, [][]byte{make([]byte, 42)}, defaultServerHelloProfile, false)
+
+	// ServerHello of 118 bytes with 46 bytes of extensions, ChangeCipherSpec, then the fake certificate
+	assert.Equal(t, []byte{0x16, 0x03, 0x03, 0x00, 0x7a, 0x02, 0x00, 0x00, 0x76}, reply[:9])
+	assert.Equal(t, []byte{0x13, 0x02, 0x00, 0x00, 0x2e, 0x00, 0x33}, reply[76:83])
+	assert.Equal(t, []byte{0x00, 0x2b, 0x00, 0x02, 0x03, 0x04}, reply[121:127])
+	assert.Equal(t, []byte{0x14, 0x03, 0x03, 0x00, 0x01, 0x01}, reply[127:133])
+	assert.Equal(t, []byte{0x17, 0x03, 0x03, 0x00, 42}, reply[133:138])
+	assert.Len(t, reply, 138+42)
+}
+
+func TestComposeReply_Profile(t *testing.T) {
+	profile := &serverHelloProfile{
+		cipherSuite:    [2]byte{0x13, 0x01},
+		extensions:     [][]byte{{0x00, 0x2b, 0x00, 0x02, 0x03, 0x04}, {0x00, 0x29, 0x00, 0x02, 0x00, 0x00}},
+		keyShareIndex:  1,
+		ccs:            false,
+		appDataLengths: []int{4000, 53},
+	}
+	sharedSecret := [32]byte{1}
+	sessionKey := [32]byte{2}
+	sessionId := bytes.Repeat([]byte{0x01}, 32)
+	respond := TLS{}.makeResponder(sessionId, sharedSecret, profile)
+
+	serverConn, clientConn := net.Pipe()
+	go respond(serverConn, ClientInfo{}, sessionKey, common.RealWorldState.Rand)
+
+	// read the reply the way ck-client does without ExactMimic
+	client := common.NewTLSConn(clientConn)
+	buf := make([]byte, 1024)
+	_, err := client.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []byte{0x13, 0x01}, buf[71:73])
+	encrypted := append(buf[6:38], buf[84:116]...)
+	decrypted, err := common.AESGCMDecrypt(encrypted[0:12], sharedSecret[:], encrypted[12:60])
+	assert.NoError(t, err)
+	assert.Equal(t, sessionKey[:], decrypted)
+
+	n, err := client.Read(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, maxReplyRecordLength, n, "records should be no longer than clients can read")
+	n, err = client.Read(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, 53, n, "ApplicationData should take the place of the missing ChangeCipherSpec")
+
+	serverConn, clientConn = net.Pipe()
+	go respond(serverConn, ClientInfo{ExactMimic: true}, sessionKey, common.RealWorldState.Rand)
+
+	client = common.NewTLSConn(clientConn)
+	buf = make([]byte, appDataMaxLength)
+	n, err = client.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// supported_versions, key_share, then pre_shared_key, as the profile has them
+	assert.Equal(t, []byte{0x00, 0x2b, 0x00, 0x02, 0x03, 0x04, 0x00, 0x33, 0x00, 0x24, 0x00, 0x1d, 0x00, 0x20}, buf[76:90])
+	assert.Equal(t, []byte{0x00, 0x29, 0x00, 0x02, 0x00, 0x00}, buf[n-6:n])
+	encrypted = append(buf[6:38], buf[90:122]...)
+	decrypted, err = common.AESGCMDecrypt(encrypted[0:12], sharedSecret[:], encrypted[12:60])
+	assert.NoError(t, err)
+	assert.Equal(t, sessionKey[:], decrypted)
+
+	n, err = client.Read(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, 4000, n, "records shouldn't be shortened for clients with ExactMimic")
+	n, err = client.Read(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, 53, n)
+}
+
+func TestServerHelloProfile_legacyAlterations(t *testing.T) {
+	assert.Empty(t, defaultServerHelloProfile.legacyAlterations())
+	assert.Empty(t, (&serverHelloProfile{appDataLengths: []int{maxReplyRecordLength, 53}}).legacyAlterations())
+
+	alterations := (&serverHelloProfile{keyShareIndex: 1, appDataLengths: []int{53, 4000}}).legacyAlterations()
+	assert.Len(t, alterations, 2)
+	assert.Contains(t, alterations[0], "key_share")
+	assert.Contains(t, alterations[1], "4000")
+}
+
+func TestProbeServerHello(t *testing.T) {
+	l := localTLSServer(t)
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	profile, err := probeServerHello(conn, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, byte(0x13), profile.cipherSuite[0])
+	// Go sends supported_versions before key_share, which is left out
+	assert.Equal(t, [][]byte{{0x00, 0x2b, 0x00, 0x02, 0x03, 0x04}}, profile.extensions)
+	assert.Equal(t, 1, profile.keyShareIndex)
+	assert.True(t, profile.ccs)
+	assert.Len(t, profile.appDataLengths, 2)
+}
+
+func TestServerHelloMimic(t *testing.T) {
+	l := localTLSServer(t)
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	site := redirTarget{"example.com", port}
+	unreachable := redirTarget{"example.org", "1"}
+	sta := &State{
+		RedirHost:     "example.org",
+		RedirPort:     "1",
+		RedirDialer:   &net.Dialer{},
+		redirResolver: makeRedirResolver(common.RealWorldState.Now),
+		redirTable:    map[string]redirTarget{"example.com": site},
+	}
+
+	var disabled *serverHelloMimic
+	assert.Equal(t, defaultServerHelloProfile, disabled.profileOf("example.com"))
+
+	mimic, err := makeServerHelloMimic(MimicConfig{}, sta.redirTargetOf, sta.dialRedir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mimic.refresh([]redirTarget{site, unreachable})
+	assert.NotEqual(t, defaultServerHelloProfile, mimic.profileOf("example.com"))
+	assert.Equal(t, defaultServerHelloProfile, mimic.profileOf("example.org"), "unprobed targets should get the default")
+
+	_, err = makeServerHelloMimic(MimicConfig{Interval: -1}, sta.redirTargetOf, sta.dialRedir)
+	assert.Error(t, err)
+}
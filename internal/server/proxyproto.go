@@ -0,0 +1,248 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ProxyProtocolConfig enables the PROXY protocol (https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt) for
+// when ck-server is behind a load balancer
+type ProxyProtocolConfig struct {
+	// TrustedSources are the IP addresses or CIDR subnets of the load balancers, or "unix" for connections over unix
+	// sockets. Connections from them must start with a PROXY protocol v1 or v2 header, and the client address in it
+	// is used in place of theirs. Connections from anywhere else are taken as they are
+	TrustedSources []string
+	// SendToRedir makes connections forwarded to redirection targets start with a PROXY protocol v2 header carrying
+	// the client's address
+	SendToRedir bool
+}
+
+type proxyProtocol struct {
+	trusted     []*net.IPNet
+	trustedUnix bool
+	sendToRedir bool
+}
+
+func parseProxyProtocol(conf ProxyProtocolConfig) (*proxyProtocol, error) {
+	pp := &proxyProtocol{sendToRedir: conf.SendToRedir}
+	for _, source := range conf.TrustedSources {
+		if source == "unix" {
+			pp.trustedUnix = true
+			continue
+		}
+		if !strings.Contains(source, "/") {
+			ip := net.ParseIP(source)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted source %v", source)
+			}
+			if ip.To4() != nil {
+				source += "/32"
+			} else {
+				source += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(source)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted source %v", source)
+		}
+		pp.trusted = append(pp.trusted, ipNet)
+	}
+	return pp, nil
+}
+
+// trusts tells whether a connection from addr is expected to start with a PROXY protocol header
+func (pp *proxyProtocol) trusts(addr net.Addr) bool {
+	if pp == nil {
+		return false
+	}
+	if _, ok := addr.(*net.UnixAddr); ok {
+		return pp.trustedUnix
+	}
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, ipNet := range pp.trusted {
+		if ipNet.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxiedConn is a connection whose remote address was given in a PROXY protocol header
+type proxiedConn struct {
+	net.Conn
+	remoteAddr net.Addr
+}
+
+func (c *proxiedConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+func (c *proxiedConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+var proxyProtoV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// Types of the TLVs sent to proxy servers, in the range reserved for custom use
+const (
+	// proxyProtoTLVUID carries the 16 byte UID of the user
+	proxyProtoTLVUID = 0xE0
+	// proxyProtoTLVSessionID carries the session id as a 4 byte big endian integer
+	proxyProtoTLVSessionID = 0xE1
+)
+
+type proxyProtoTLV struct {
+	typ   byte
+	value []byte
+}
+
+// proxyProtoAddr is the address of a proxy server that expects each connection to start with a PROXY protocol v2
+// header carrying the client's address
+type proxyProtoAddr struct {
+	net.Addr
+}
+
+const proxyProtoV1MaxLen = 107
+
+// readProxyProtoHeader reads the PROXY protocol header at the start of conn, and returns conn with the client
+// address in the header as its remote address. A header without an address, e.g. from a health check, leaves the
+// remote address as it is
+func readProxyProtoHeader(conn net.Conn, timeout time.Duration) (net.Conn, error) {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	var first [1]byte
+	if _, err := io.ReadFull(conn, first[:]); err != nil {
+		return conn, err
+	}
+	var src net.Addr
+	var err error
+	switch first[0] {
+	case 'P':
+		src, err = readProxyProtoV1(conn)
+	case proxyProtoV2Sig[0]:
+		src, err = readProxyProtoV2(conn)
+	default:
+		err = errors.New("no PROXY protocol header")
+	}
+	if err != nil {
+		return conn, err
+	}
+	if src == nil {
+		return conn, nil
+	}
+	return &proxiedConn{conn, src}, nil
+}
+
+// readProxyProtoV1 reads the rest of a v1 header after its first byte
+func readProxyProtoV1(conn net.Conn) (net.Addr, error) {
+	line := []byte{'P'}
+	var b [1]byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyProtoV1MaxLen {
+			return nil, errors.New("v1 header too long")
+		}
+		if _, err := io.ReadFull(conn, b[:]); err != nil {
+			return nil, err
+		}
+		line = append(line, b[0])
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, errors.New("malformed v1 header")
+	}
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil, nil
+	case "TCP4", "TCP6":
+		if len(fields) != 6 {
+			return nil, errors.New("malformed v1 header")
+		}
+		ip := net.ParseIP(fields[2])
+		port, err := strconv.ParseUint(fields[4], 10, 16)
+		if ip == nil || err != nil {
+			return nil, errors.New("malformed v1 source address")
+		}
+		return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+	default:
+		return nil, fmt.Errorf("unknown v1 protocol %v", fields[1])
+	}
+}
+
+// readProxyProtoV2 reads the rest of a v2 header after its first byte
+func readProxyProtoV2(conn net.Conn) (net.Addr, error) {
+	header := make([]byte, 16)
+	header[0] = proxyProtoV2Sig[0]
+	if _, err := io.ReadFull(conn, header[1:]); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[:12], proxyProtoV2Sig) {
+		return nil, errors.New("no PROXY protocol header")
+	}
+	if header[12]>>4 != 2 {
+		return nil, fmt.Errorf("unknown version %v", header[12]>>4)
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(conn, payload); err != nil {
+		return nil, err
+	}
+	if header[12]&0x0f == 0x0 {
+		// LOCAL command, sent by the load balancer itself
+		return nil, nil
+	}
+	switch header[13] {
+	case 0x11, 0x12: // TCP or UDP over IPv4
+		if len(payload) < 12 {
+			return nil, errors.New("v2 address too short")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}, nil
+	case 0x21, 0x22: // TCP or UDP over IPv6
+		if len(payload) < 36 {
+			return nil, errors.New("v2 address too short")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}, nil
+	default:
+		// unspecified or unix addresses
+		return nil, nil
+	}
+}
+
+// proxyProtoV2Header makes a PROXY protocol v2 header for a TCP connection from src to dst, followed by tlvs. The
+// header has no address if either isn't a TCP address of the same IP version as the other
+func proxyProtoV2Header(src, dst net.Addr, tlvs ...proxyProtoTLV) []byte {
+	srcAddr, srcOk := src.(*net.TCPAddr)
+	dstAddr, dstOk := dst.(*net.TCPAddr)
+	var payload []byte
+	// AF_UNSPEC, with which the receiver keeps its own address
+	var family byte = 0x00
+	switch {
+	case srcOk && dstOk && srcAddr.IP.To4() != nil && dstAddr.IP.To4() != nil:
+		family = 0x11
+		payload = append(append(payload, srcAddr.IP.To4()...), dstAddr.IP.To4()...)
+	case srcOk && dstOk && srcAddr.IP.To4() == nil && dstAddr.IP.To4() == nil:
+		family = 0x21
+		payload = append(append(payload, srcAddr.IP.To16()...), dstAddr.IP.To16()...)
+	}
+	if family != 0x00 {
+		payload = binary.BigEndian.AppendUint16(payload, uint16(srcAddr.Port))
+		payload = binary.BigEndian.AppendUint16(payload, uint16(dstAddr.Port))
+	}
+	for _, tlv := range tlvs {
+		payload = append(payload, tlv.typ)
+		payload = binary.BigEndian.AppendUint16(payload, uint16(len(tlv.value)))
+		payload = append(payload, tlv.value...)
+	}
+	header := append(append([]byte{}, proxyProtoV2Sig...), 0x21, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(payload)))
+	return append(header, payload...)
+}
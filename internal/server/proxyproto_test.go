@@ -0,0 +1,215 @@
+package server
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseProxyProtocol(t *testing.T) {
+	pp, err := parseProxyProtocol(ProxyProtocolConfig{TrustedSources: []string{"10.0.0.0/8", "192.0.2.1", "2001:db8::1"}})
+	assert.NoError(t, err)
+	assert.True(t, pp.trusts(&net.TCPAddr{IP: net.ParseIP("10.1.2.3")}))
+	assert.True(t, pp.trusts(&net.TCPAddr{IP: net.ParseIP("192.0.2.1")}))
+	assert.True(t, pp.trusts(&net.TCPAddr{IP: net.ParseIP("2001:db8::1")}))
+	assert.False(t, pp.trusts(&net.TCPAddr{IP: net.ParseIP("192.0.2.2")}))
+	assert.False(t, pp.trusts(&net.UnixAddr{Name: "/tmp/ck.sock"}))
+
+	pp, err = parseProxyProtocol(ProxyProtocolConfig{TrustedSources: []string{"unix"}})
+	assert.NoError(t, err)
+	assert.True(t, pp.trusts(&net.UnixAddr{Name: "@", Net: "unix"}))
+	assert.False(t, pp.trusts(&net.TCPAddr{IP: net.ParseIP("10.1.2.3")}))
+
+	var disabled *proxyProtocol
+	assert.False(t, disabled.trusts(&net.TCPAddr{IP: net.ParseIP("10.1.2.3")}))
+
+	_, err = parseProxyProtocol(ProxyProtocolConfig{TrustedSources: []string{"balancer"}})
+	assert.Error(t, err)
+	_, err = parseProxyProtocol(ProxyProtocolConfig{TrustedSources: []string{"10.0.0.0/33"}})
+	assert.Error(t, err)
+}
+
+func TestReadProxyProtoHeader(t *testing.T) {
+	read := func(header []byte) (net.Conn, error) {
+		conn, balancer := net.Pipe()
+		go func() {
+			balancer.Write(append(header, "hello"...))
+		}()
+		proxied, err := readProxyProtoHeader(conn, time.Second)
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, 5)
+		_, err = io.ReadFull(proxied, buf)
+		assert.NoError(t, err)
+		assert.Equal(t, "hello", string(buf), "data after the header should be left intact")
+		return proxied, nil
+	}
+
+	t.Run("v1", func(t *testing.T) {
+		conn, err := read([]byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"))
+		assert.NoError(t, err)
+		assert.Equal(t, "192.0.2.1:56324", conn.RemoteAddr().String())
+
+		conn, err = read([]byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n"))
+		assert.NoError(t, err)
+		assert.Equal(t, "[2001:db8::1]:56324", conn.RemoteAddr().String())
+
+		conn, err = read([]byte("PROXY UNKNOWN\r\n"))
+		assert.NoError(t, err)
+		assert.Equal(t, "pipe", conn.RemoteAddr().String())
+
+		_, err = read([]byte("PROXY TCP4 192.0.2.1\r\n"))
+		assert.Error(t, err)
+	})
+
+	t.Run("v2", func(t *testing.T) {
+		local := &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 443}
+		conn, err := read(proxyProtoV2Header(&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 56324}, local))
+		assert.NoError(t, err)
+		assert.Equal(t, "192.0.2.1:56324", conn.RemoteAddr().String())
+
+		local6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443}
+		conn, err = read(proxyProtoV2Header(&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56324}, local6))
+		assert.NoError(t, err)
+		assert.Equal(t, "[2001:db8::1]:56324", conn.RemoteAddr().String())
+
+		conn, err = read(proxyProtoV2Header(&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 56324}, local6))
+		assert.NoError(t, err)
+		assert.Equal(t, "pipe", conn.RemoteAddr().String(), "mismatched address families should be sent unspecified")
+
+		localCmd := append(append([]byte{}, proxyProtoV2Sig...), 0x20, 0x00, 0x00, 0x00)
+		conn, err = read(localCmd)
+		assert.NoError(t, err)
+		assert.Equal(t, "pipe", conn.RemoteAddr().String())
+	})
+
+	t.Run("no header", func(t *testing.T) {
+		_, err := read([]byte{0x16, 0x03, 0x01})
+		assert.Error(t, err)
+	})
+}
+
+func TestProxyProtoV2Header_TLVs(t *testing.T) {
+	src := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 56324}
+	dst := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 8388}
+	header := proxyProtoV2Header(src, dst,
+		proxyProtoTLV{proxyProtoTLVUID, []byte("0123456789abcdef")},
+		proxyProtoTLV{proxyProtoTLVSessionID, []byte{0, 0, 0, 42}})
+	assert.Equal(t, []byte{0x21, 0x11, 0x00, 12 + 19 + 7}, header[12:16])
+	assert.Equal(t, append([]byte{proxyProtoTLVUID, 0x00, 16}, "0123456789abcdef"...), header[28:47])
+	assert.Equal(t, []byte{proxyProtoTLVSessionID, 0x00, 4, 0, 0, 0, 42}, header[47:])
+
+	conn, lb := net.Pipe()
+	go lb.Write(header)
+	proxied, err := readProxyProtoHeader(conn, time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, src.String(), proxied.RemoteAddr().String(), "TLVs should be skipped over")
+}
+
+func TestState_Redirect_SendProxyProtocol(t *testing.T) {
+	web, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer web.Close()
+	remoteAddrs := make(chan string, 1)
+	go func() {
+		conn, err := web.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		proxied, err := readProxyProtoHeader(conn, time.Second)
+		if err != nil {
+			remoteAddrs <- err.Error()
+			return
+		}
+		remoteAddrs <- proxied.RemoteAddr().String()
+	}()
+
+	host, port, _ := net.SplitHostPort(web.Addr().String())
+	sta := &State{
+		RedirHost:     host,
+		RedirPort:     port,
+		RedirDialer:   &net.Dialer{},
+		redirResolver: makeRedirResolver(time.Now),
+		redirLimiter:  makeRedirLimiter(RedirLimitsConfig{}),
+		proxyProtocol: &proxyProtocol{sendToRedir: true},
+	}
+
+	front, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer front.Close()
+	client, err := net.Dial("tcp", front.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	conn, err := front.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go sta.redirect(&proxiedConn{conn, &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 56324}}, []byte("hello"), nil)
+
+	select {
+	case remoteAddr := <-remoteAddrs:
+		assert.Equal(t, "192.0.2.1:56324", remoteAddr)
+	case <-time.After(3 * time.Second):
+		t.Fatal("redirection target got nothing")
+	}
+}
+
+func TestDispatchConnection_ProxyProtocol(t *testing.T) {
+	conf := AuthBanConfig{MaxFailures: 1, Window: 60, BanDuration: 600, Mode: BanModeDrop}
+	_ = conf.validate()
+	pp, _ := parseProxyProtocol(ProxyProtocolConfig{TrustedSources: []string{"127.0.0.1"}})
+	sta := &State{authBans: makeAuthBans(conf, time.Now), proxyProtocol: pp}
+	sta.authBans.recordFailure(&net.TCPAddr{IP: net.ParseIP("192.0.2.1")})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go dispatchConnection(conn, sta)
+		}
+	}()
+
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.Write([]byte("PROXY TCP4 192.0.2.1 127.0.0.1 56324 443\r\n"))
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = client.Read(make([]byte, 1))
+	assert.Error(t, err)
+	if netErr, ok := err.(net.Error); ok {
+		assert.False(t, netErr.Timeout(), "the ban on the address in the header should apply")
+	}
+
+	client, err = net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.Write([]byte{0x16, 0x03, 0x01, 0x00, 0x00})
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = client.Read(make([]byte, 1))
+	assert.Error(t, err)
+	if netErr, ok := err.(net.Error); ok {
+		assert.False(t, netErr.Timeout(), "a trusted source without a header should be closed")
+	}
+}
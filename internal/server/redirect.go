@@ -0,0 +1,184 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/common"
+	log "github.com/sirupsen/logrus"
+)
+
+// redirDialTimeout is how long to wait for each address of a redirection target before trying the next one
+const redirDialTimeout = 5 * time.Second
+
+// redirTarget is where connections that aren't Cloak's are forwarded to. An empty port means the port the connection
+// came in on
+type redirTarget struct {
+	host string
+	port string
+}
+
+// parseRedirTable parses RedirTable, which maps server names to addresses in the same format as RedirAddr. A server
+// name starting with "*." matches all of its subdomains
+func parseRedirTable(entries map[string]string) (map[string]redirTarget, error) {
+	table := make(map[string]redirTarget)
+	for pattern, redirAddr := range entries {
+		pattern = strings.ToLower(pattern)
+		if pattern == "" || strings.Contains(strings.TrimPrefix(pattern, "*."), "*") {
+			return nil, fmt.Errorf("invalid server name pattern %v", pattern)
+		}
+		host, port, err := parseRedirAddr(redirAddr)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", pattern, err)
+		}
+		table[pattern] = redirTarget{host, port}
+	}
+	return table, nil
+}
+
+// redirTargetOf returns where to forward a connection asking for serverName. An exact match in the redirect table
+// is preferred over a wildcard one, and a longer wildcard over a shorter one. RedirAddr is used if nothing matches
+func (sta *State) redirTargetOf(serverName string) redirTarget {
+	serverName = strings.TrimSuffix(strings.ToLower(serverName), ".")
+	if serverName != "" {
+		if target, ok := sta.redirTable[serverName]; ok {
+			return target
+		}
+		labels := strings.Split(serverName, ".")
+		for i := 1; i < len(labels); i++ {
+			if target, ok := sta.redirTable["*."+strings.Join(labels[i:], ".")]; ok {
+				return target
+			}
+		}
+	}
+	return redirTarget{sta.RedirHost, sta.RedirPort}
+}
+
+// redirTargets returns the targets in the redirect table
+func (sta *State) redirTargets() []redirTarget {
+	targets := make([]redirTarget, 0, len(sta.redirTable))
+	for _, target := range sta.redirTable {
+		targets = append(targets, target)
+	}
+	return targets
+}
+
+// dialRedir connects to a redirection target, trying each of its addresses in turn until one is reachable
+func (sta *State) dialRedir(target redirTarget, port string) (net.Conn, error) {
+	ips, err := sta.redirResolver.resolve(target.host)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		var conn net.Conn
+		conn, err = sta.RedirDialer.Dial("tcp", net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		log.Warnf("redirection target %v is unreachable at %v: %v", target.host, ip, err)
+		sta.redirResolver.demote(target.host, ip)
+	}
+	return nil, fmt.Errorf("none of the addresses of %v is reachable: %v", target.host, err)
+}
+
+// redirect forwards conn, whose first packet data has already been read, to the redirection target matching the
+// server name it asked for, and copies between them until either side is done. With TLSTermination, conn is served
+// by the built-in website instead
+func (sta *State) redirect(conn net.Conn, data []byte, transport Transport) {
+	ip, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	if !sta.redirLimiter.acquire(ip) {
+		log.WithField("remoteAddr", conn.RemoteAddr()).Debug("Too many redirected connections, dropping")
+		conn.Close()
+		return
+	}
+	defer sta.redirLimiter.release(ip)
+
+	if sta.site != nil {
+		start := time.Now()
+		sta.site.serve(conn, data, transport)
+		log.WithFields(log.Fields{
+			"remoteAddr": conn.RemoteAddr(),
+			"duration":   time.Since(start),
+		}).Debug("Connection to website closed")
+		return
+	}
+
+	target := sta.redirTargetOf(serverNameOf(data, transport))
+	redirPort := target.port
+	if redirPort == "" {
+		_, redirPort, _ = net.SplitHostPort(conn.LocalAddr().String())
+	}
+	if redirPort == "" {
+		// e.g. connections over unix sockets
+		log.Errorf("redirection target %v has no port and %v doesn't have one to reuse", target.host, conn.LocalAddr())
+		conn.Close()
+		return
+	}
+	webConn, err := sta.dialRedir(target, redirPort)
+	if err != nil {
+		log.Errorf("Making connection to redirection server: %v", err)
+		conn.Close()
+		return
+	}
+	if sta.proxyProtocol != nil && sta.proxyProtocol.sendToRedir {
+		data = append(proxyProtoV2Header(conn.RemoteAddr(), conn.LocalAddr()), data...)
+	}
+	_, err = webConn.Write(data)
+	if err != nil {
+		log.Error("Failed to send first packet to redirection server", err)
+		webConn.Close()
+		conn.Close()
+		return
+	}
+
+	start := time.Now()
+	a, b := conn, webConn
+	if sta.RedirLimits.IdleTimeout > 0 {
+		a, b = idleConnPair(conn, webConn, time.Duration(sta.RedirLimits.IdleTimeout)*time.Second)
+	}
+	errFromClient, errFromWeb := common.CopyBidirectional(a, b, common.DefaultHalfCloseTimeout)
+	log.WithFields(log.Fields{
+		"remoteAddr":    conn.RemoteAddr(),
+		"redirTarget":   target.host,
+		"duration":      time.Since(start),
+		"errFromClient": errFromClient,
+		"errFromWeb":    errFromWeb,
+	}).Debug("Redirected connection closed")
+}
+
+// serverNameOf returns the SNI in a TLS ClientHello, or the host in the Host header of an HTTP request. It returns an
+// empty string if the first packet doesn't have one
+func serverNameOf(data []byte, transport Transport) string {
+	switch transport.(type) {
+	case TLS:
+		ch, err := parseClientHello(data)
+		if err != nil {
+			return ""
+		}
+		sni, ok := ch.extensions[[2]byte{0x00, 0x00}]
+		if !ok {
+			return ""
+		}
+		serverName, err := parseSNI(sni)
+		if err != nil {
+			return ""
+		}
+		return serverName
+	case WebSocket:
+		req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(data)))
+		if err != nil {
+			return ""
+		}
+		if host, _, err := net.SplitHostPort(req.Host); err == nil {
+			return host
+		}
+		return req.Host
+	default:
+		return ""
+	}
+}
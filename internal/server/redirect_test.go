@@ -0,0 +1,66 @@
+package server
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRedirTable(t *testing.T) {
+	table, err := parseRedirTable(map[string]string{
+		"Example.org":   "1.2.3.4:443",
+		"*.example.net": "5.6.7.8",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "1.2.3.4", table["example.org"].host)
+	assert.Equal(t, "443", table["example.org"].port)
+	assert.Equal(t, "", table["*.example.net"].port)
+
+	_, err = parseRedirTable(map[string]string{"www.*.example.org": "1.2.3.4"})
+	assert.Error(t, err)
+	_, err = parseRedirTable(map[string]string{"": "1.2.3.4"})
+	assert.Error(t, err)
+}
+
+func TestState_RedirTargetOf(t *testing.T) {
+	defaultHost, defaultPort, _ := parseRedirAddr("9.9.9.9:8443")
+	table, err := parseRedirTable(map[string]string{
+		"example.org":       "1.1.1.1",
+		"*.example.org":     "2.2.2.2",
+		"*.sub.example.org": "3.3.3.3",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sta := &State{RedirHost: defaultHost, RedirPort: defaultPort, redirTable: table}
+
+	for serverName, expected := range map[string]string{
+		"example.org":            "1.1.1.1",
+		"EXAMPLE.ORG.":           "1.1.1.1",
+		"www.example.org":        "2.2.2.2",
+		"a.b.example.org":        "2.2.2.2",
+		"sub.example.org":        "2.2.2.2",
+		"www.sub.example.org":    "3.3.3.3",
+		"example.com":            "9.9.9.9",
+		"":                       "9.9.9.9",
+		"notexample.org":         "9.9.9.9",
+		"www.notsub.example.org": "2.2.2.2",
+	} {
+		assert.Equal(t, expected, sta.redirTargetOf(serverName).host, serverName)
+	}
+	assert.Equal(t, "8443", sta.redirTargetOf("example.com").port)
+}
+
+func TestServerNameOf(t *testing.T) {
+	chBytes, _ := hex.DecodeString("1603010200010001fc03034986187cfaf4c55866a0d9b68f82505fd694a3f0fbf21ca3dcf260baad91d75e20c10e2d2c66f4f9366296678550ed769aa0c41cae7e5f480f59bd929b747ee48d0024130113031302c02bc02fcca9cca8c02cc030c00ac009c013c01400330039002f0035000a0100018f00000011000f00000c7777772e62696e672e636f6d00170000ff01000100000a000e000c001d00170018001901000101000b00020100002300000010000e000c02683208687474702f312e310005000501000000000033006b0069001d00208d7d5a544a72e67adb1bacde46aa147b086f714c073f8335688dc13b2a032986001700414e06fb9a27480a93159f3d6273afebb4d307c4a734d7107d883b6edacb58f7d289a95ad8aaedef1b5f76fe09267a14e6bee2b6db4506b43cf0a410a4645105f79f002b0009080304030303020301000d0018001604030503060308040805080604010501060102030201002d00020101001c00024001001500920000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000")
+	assert.Equal(t, "www.bing.com", serverNameOf(chBytes, TLS{}))
+	assert.Equal(t, "", serverNameOf(chBytes[:100], TLS{}))
+
+	req := []byte("GET / HTTP/1.1\r\nHost: example.org:8080\r\nUpgrade: websocket\r\n\r\n")
+	assert.Equal(t, "example.org", serverNameOf(req, WebSocket{}))
+	req = []byte("GET / HTTP/1.1\r\nHost: example.org\r\n\r\n")
+	assert.Equal(t, "example.org", serverNameOf(req, WebSocket{}))
+
+	assert.Equal(t, "", serverNameOf([]byte("SSH-2.0-OpenSSH"), nil))
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/server/usermanager"
+)
+
+// RedirLimitsConfig limits the connections forwarded to redirection targets, so that scanners can't tie up the
+// server's file descriptors through them. Zero values mean no limit
+type RedirLimitsConfig struct {
+	// MaxConns is the number of redirected connections there can be at a time
+	MaxConns int
+	// MaxConnsPerIP is the number of redirected connections there can be at a time from one source IP
+	MaxConnsPerIP int
+	// IdleTimeout is the number of seconds a redirected connection is kept open with no data going either way
+	IdleTimeout int
+}
+
+func (c RedirLimitsConfig) validate() error {
+	if c.MaxConns < 0 || c.MaxConnsPerIP < 0 || c.IdleTimeout < 0 {
+		return errors.New("limits cannot be negative")
+	}
+	return nil
+}
+
+// redirLimiter counts the redirected connections and enforces RedirLimitsConfig on them
+type redirLimiter struct {
+	conf RedirLimitsConfig
+
+	connsM  sync.Mutex
+	conns   int
+	connsOf map[string]int
+
+	// total and rejected count the redirected connections since start, including rejected ones
+	total    atomic.Uint64
+	rejected atomic.Uint64
+}
+
+func makeRedirLimiter(conf RedirLimitsConfig) *redirLimiter {
+	return &redirLimiter{
+		conf:    conf,
+		connsOf: make(map[string]int),
+	}
+}
+
+// acquire takes a slot for a connection from ip. It returns false if there is none left, in which case the
+// connection must be dropped; otherwise release must be called once the connection is closed
+func (l *redirLimiter) acquire(ip string) bool {
+	l.total.Add(1)
+	l.connsM.Lock()
+	defer l.connsM.Unlock()
+	if (l.conf.MaxConns > 0 && l.conns >= l.conf.MaxConns) ||
+		(l.conf.MaxConnsPerIP > 0 && l.connsOf[ip] >= l.conf.MaxConnsPerIP) {
+		l.rejected.Add(1)
+		return false
+	}
+	l.conns++
+	l.connsOf[ip]++
+	return true
+}
+
+func (l *redirLimiter) release(ip string) {
+	l.connsM.Lock()
+	defer l.connsM.Unlock()
+	l.conns--
+	if l.connsOf[ip]--; l.connsOf[ip] <= 0 {
+		delete(l.connsOf, ip)
+	}
+}
+
+// active returns the number of redirected connections open right now
+func (l *redirLimiter) active() int {
+	l.connsM.Lock()
+	defer l.connsM.Unlock()
+	return l.conns
+}
+
+// stats returns the counters shown to the admin API. A nil redirLimiter has counted nothing
+func (l *redirLimiter) stats() usermanager.RedirectStats {
+	if l == nil {
+		return usermanager.RedirectStats{}
+	}
+	return usermanager.RedirectStats{
+		Total:    l.total.Load(),
+		Rejected: l.rejected.Load(),
+		Active:   l.active(),
+	}
+}
+
+// idleConn is one of a pair of connections being copied between. A Read on it times out once neither of the pair has
+// read anything for timeout, so that a connection sending in one direction only isn't closed
+type idleConn struct {
+	net.Conn
+	timeout time.Duration
+	// lastRead is the unix nano time of the last read from either of the pair
+	lastRead *atomic.Int64
+}
+
+// idleConnPair wraps a and b so that their Reads time out after timeout of inactivity on both
+func idleConnPair(a, b net.Conn, timeout time.Duration) (net.Conn, net.Conn) {
+	lastRead := &atomic.Int64{}
+	lastRead.Store(time.Now().UnixNano())
+	return &idleConn{a, timeout, lastRead}, &idleConn{b, timeout, lastRead}
+}
+
+func (c *idleConn) Read(b []byte) (int, error) {
+	for {
+		c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+		n, err := c.Conn.Read(b)
+		if n > 0 {
+			c.lastRead.Store(time.Now().UnixNano())
+		}
+		var netErr net.Error
+		if n == 0 && errors.As(err, &netErr) && netErr.Timeout() &&
+			time.Since(time.Unix(0, c.lastRead.Load())) < c.timeout {
+			// the other direction is still going
+			continue
+		}
+		return n, err
+	}
+}
+
+// CloseWrite half-closes the underlying connection if it supports it, so that common.Copy can propagate half-closes
+func (c *idleConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+// closeWrite half-closes conn if it supports it
+func closeWrite(conn net.Conn) error {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.New("half-close not supported")
+}
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/server/usermanager"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedirLimiter(t *testing.T) {
+	l := makeRedirLimiter(RedirLimitsConfig{MaxConns: 3, MaxConnsPerIP: 2})
+	assert.True(t, l.acquire("192.0.2.1"))
+	assert.True(t, l.acquire("192.0.2.1"))
+	assert.False(t, l.acquire("192.0.2.1"), "per IP limit")
+	assert.True(t, l.acquire("192.0.2.2"))
+	assert.False(t, l.acquire("192.0.2.3"), "global limit")
+	assert.Equal(t, 3, l.active())
+
+	l.release("192.0.2.1")
+	assert.True(t, l.acquire("192.0.2.3"))
+	assert.EqualValues(t, 6, l.total.Load())
+	assert.EqualValues(t, 2, l.rejected.Load())
+
+	unlimited := makeRedirLimiter(RedirLimitsConfig{})
+	for i := 0; i < 100; i++ {
+		assert.True(t, unlimited.acquire("192.0.2.1"))
+	}
+}
+
+func TestUserPanel_RedirectPanel(t *testing.T) {
+	l := makeRedirLimiter(RedirLimitsConfig{MaxConns: 1})
+	panel := &userPanel{redirects: l}
+	var redirects usermanager.RedirectPanel = panel
+	l.acquire("192.0.2.1")
+	l.acquire("192.0.2.2")
+	assert.Equal(t, usermanager.RedirectStats{Total: 2, Rejected: 1, Active: 1}, redirects.RedirectStats())
+
+	assert.Equal(t, usermanager.RedirectStats{}, (&userPanel{}).RedirectStats())
+}
+
+func TestIdleConnPair(t *testing.T) {
+	timeout := 100 * time.Millisecond
+
+	t.Run("closes when idle", func(t *testing.T) {
+		a, peerA := net.Pipe()
+		b, peerB := net.Pipe()
+		defer peerA.Close()
+		defer peerB.Close()
+		idleA, _ := idleConnPair(a, b, timeout)
+		start := time.Now()
+		_, err := idleA.Read(make([]byte, 1))
+		assert.Error(t, err)
+		assert.WithinDuration(t, start.Add(timeout), time.Now(), 100*time.Millisecond)
+	})
+
+	t.Run("kept open by the other direction", func(t *testing.T) {
+		a, peerA := net.Pipe()
+		b, peerB := net.Pipe()
+		defer peerA.Close()
+		defer peerB.Close()
+		idleA, idleB := idleConnPair(a, b, timeout)
+		go func() {
+			buf := make([]byte, 1)
+			for {
+				if _, err := idleB.Read(buf); err != nil {
+					return
+				}
+			}
+		}()
+		go func() {
+			for i := 0; i < 6; i++ {
+				time.Sleep(timeout / 2)
+				peerB.Write([]byte{1})
+			}
+		}()
+		start := time.Now()
+		_, err := idleA.Read(make([]byte, 1))
+		assert.Error(t, err)
+		assert.True(t, time.Since(start) > 3*timeout, "should time out only after the other direction stops")
+	})
+}
+
+func TestState_Redirect(t *testing.T) {
+	web, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer web.Close()
+	go func() {
+		for {
+			conn, err := web.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(conn, conn)
+		}
+	}()
+	host, port, _ := net.SplitHostPort(web.Addr().String())
+	conf := RedirLimitsConfig{MaxConns: 1, IdleTimeout: 1}
+	sta := &State{
+		RedirHost:     host,
+		RedirPort:     port,
+		RedirDialer:   &net.Dialer{},
+		RedirLimits:   conf,
+		redirResolver: makeRedirResolver(time.Now),
+		redirLimiter:  makeRedirLimiter(conf),
+	}
+
+	conn, client := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		sta.redirect(conn, []byte("hello"), nil)
+		close(done)
+	}()
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(client, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(buf))
+
+	extra, extraClient := net.Pipe()
+	sta.redirect(extra, []byte("hello"), nil)
+	_, err = extraClient.Read(buf)
+	assert.Error(t, err, "connections over MaxConns should be dropped")
+
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("idle redirected connection wasn't closed")
+	}
+	assert.Equal(t, 0, sta.redirLimiter.active())
+}
@@ -0,0 +1,236 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/common"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	// defaultRedirTTL is how long the addresses of a redirection target are used for before they are looked up again
+	// when the TTL of its records can't be found out
+	defaultRedirTTL = 5 * time.Minute
+	minRedirTTL     = 30 * time.Second
+	maxRedirTTL     = 1 * time.Hour
+
+	redirLookupTimeout = 5 * time.Second
+)
+
+// redirResolver resolves the host names of redirection targets and caches their addresses for as long as the TTL of
+// their DNS records, so that targets behind CDNs whose addresses change are followed. Once a host's addresses are due to be looked up again, that is done in
+// the background while the cached ones keep being used, so redirections never wait on DNS after the first lookup
+type redirResolver struct {
+	now func() time.Time
+	// lookup returns the addresses of host and how long they can be cached for
+	lookup func(host string) ([]net.IP, time.Duration, error)
+	// lookups collapses concurrent lookups of the same host into one
+	lookups singleflight.Group
+
+	cacheM sync.Mutex
+	cache  map[string]*resolvedHost
+}
+
+type resolvedHost struct {
+	ips []net.IP
+	// refreshAt is when ips are looked up again, after the TTL of their records
+	refreshAt  time.Time
+	refreshing bool
+}
+
+func makeRedirResolver(now func() time.Time) *redirResolver {
+	return &redirResolver{
+		now:    now,
+		lookup: lookupWithTTL,
+		cache:  make(map[string]*resolvedHost),
+	}
+}
+
+// resolve returns the addresses of host, in the order they should be tried. Only a host that has never been resolved
+// is looked up before returning
+func (r *redirResolver) resolve(host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+
+	r.cacheM.Lock()
+	if cached, ok := r.cache[host]; ok {
+		ips := append([]net.IP{}, cached.ips...)
+		if !cached.refreshing && !r.now().Before(cached.refreshAt) {
+			cached.refreshing = true
+			go r.refresh(host)
+		}
+		r.cacheM.Unlock()
+		return ips, nil
+	}
+	r.cacheM.Unlock()
+
+	if err := r.refresh(host); err != nil {
+		return nil, fmt.Errorf("unable to resolve %v: %v", host, err)
+	}
+	r.cacheM.Lock()
+	defer r.cacheM.Unlock()
+	return append([]net.IP{}, r.cache[host].ips...), nil
+}
+
+// refresh looks host up and caches its addresses. If host can't be looked up again, its previous addresses are kept
+// until the next attempt
+func (r *redirResolver) refresh(host string) error {
+	_, err, _ := r.lookups.Do(host, func() (interface{}, error) {
+		ips, ttl, err := r.lookup(host)
+		if err == nil && len(ips) == 0 {
+			err = errors.New("no addresses found")
+		}
+
+		r.cacheM.Lock()
+		defer r.cacheM.Unlock()
+		if err != nil {
+			if cached, ok := r.cache[host]; ok {
+				log.Warnf("unable to resolve redirection target %v again, using its previous addresses: %v", host, err)
+				cached.refreshAt = r.now().Add(minRedirTTL)
+				cached.refreshing = false
+			}
+			return nil, err
+		}
+		if ttl < minRedirTTL {
+			ttl = minRedirTTL
+		} else if ttl > maxRedirTTL {
+			ttl = maxRedirTTL
+		}
+		r.cache[host] = &resolvedHost{ips: ips, refreshAt: r.now().Add(ttl)}
+		return nil, nil
+	})
+	return err
+}
+
+// demote moves ip to the back of host's addresses after it's been found unreachable, so that it's tried last until
+// host is resolved again
+func (r *redirResolver) demote(host string, ip net.IP) {
+	r.cacheM.Lock()
+	defer r.cacheM.Unlock()
+	cached, ok := r.cache[host]
+	if !ok {
+		return
+	}
+	for i, cachedIP := range cached.ips {
+		if cachedIP.Equal(ip) {
+			cached.ips = append(append(cached.ips[:i:i], cached.ips[i+1:]...), cachedIP)
+			return
+		}
+	}
+}
+
+// lookupWithTTL resolves host with the system's resolver, so that the hosts file is honoured, and separately asks
+// the system's nameserver for the TTL of host's records, as the system's resolver doesn't tell
+func lookupWithTTL(host string) ([]net.IP, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redirLookupTimeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, 0, err
+	}
+	ips := make([]net.IP, len(addrs))
+	for i, addr := range addrs {
+		ips[i] = addr.IP
+	}
+
+	ttl, err := queryTTL(host, systemNameserver())
+	if err != nil {
+		log.Debugf("unable to find out the TTL of %v: %v", host, err)
+		ttl = defaultRedirTTL
+	}
+	return ips, ttl, nil
+}
+
+// systemNameserver returns the first nameserver in /etc/resolv.conf, or the local one if there's none
+func systemNameserver() string {
+	f, err := os.Open("/etc/resolv.conf")
+	if err != nil {
+		return "127.0.0.1:53"
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			return net.JoinHostPort(fields[1], "53")
+		}
+	}
+	return "127.0.0.1:53"
+}
+
+// queryTTL returns the smallest TTL of the records in the answer to an A query for host, or an AAAA query if host
+// has no A record
+func queryTTL(host string, nameserver string) (time.Duration, error) {
+	name, err := dnsmessage.NewName(strings.TrimSuffix(host, ".") + ".")
+	if err != nil {
+		return 0, err
+	}
+	for _, typ := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		ttl, found, err := queryMinTTL(name, typ, nameserver)
+		if err != nil {
+			return 0, err
+		}
+		if found {
+			return ttl, nil
+		}
+	}
+	return 0, errors.New("no records found")
+}
+
+func queryMinTTL(name dnsmessage.Name, typ dnsmessage.Type, nameserver string) (ttl time.Duration, found bool, err error) {
+	conn, err := net.DialTimeout("udp", nameserver, redirLookupTimeout)
+	if err != nil {
+		return 0, false, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(redirLookupTimeout))
+
+	var id [2]byte
+	common.CryptoRandRead(id[:])
+	query := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: uint16(id[0])<<8 | uint16(id[1]), RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: name, Type: typ, Class: dnsmessage.ClassINET}},
+	}
+	packed, err := query.Pack()
+	if err != nil {
+		return 0, false, err
+	}
+	if _, err = conn.Write(packed); err != nil {
+		return 0, false, err
+	}
+
+	buf := make([]byte, 1500)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return 0, false, err
+		}
+		var resp dnsmessage.Message
+		if err = resp.Unpack(buf[:n]); err != nil || resp.ID != query.ID || !resp.Response {
+			// not the answer to our query
+			continue
+		}
+		if resp.RCode != dnsmessage.RCodeSuccess {
+			return 0, false, fmt.Errorf("nameserver responded with %v", resp.RCode)
+		}
+		for _, answer := range resp.Answers {
+			answerTTL := time.Duration(answer.Header.TTL) * time.Second
+			if !found || answerTTL < ttl {
+				ttl = answerTTL
+			}
+			found = true
+		}
+		return ttl, found, nil
+	}
+}
@@ -0,0 +1,246 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestRedirResolver(t *testing.T) {
+	var nowM sync.Mutex
+	now := time.Unix(1000, 0)
+	r := makeRedirResolver(func() time.Time {
+		nowM.Lock()
+		defer nowM.Unlock()
+		return now
+	})
+	advance := func(d time.Duration) {
+		nowM.Lock()
+		now = now.Add(d)
+		nowM.Unlock()
+	}
+
+	var lookupM sync.Mutex
+	lookups := 0
+	var lookupErr error
+	ips := []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2")}
+	ttl := 10 * time.Minute
+	setLookup := func(newIPs []net.IP, err error) {
+		lookupM.Lock()
+		ips, lookupErr = newIPs, err
+		lookupM.Unlock()
+	}
+	lookupCount := func() int {
+		lookupM.Lock()
+		defer lookupM.Unlock()
+		return lookups
+	}
+	// unblock holds lookups back while it's set, so that concurrent lookups can pile up
+	var unblock chan struct{}
+	r.lookup = func(host string) ([]net.IP, time.Duration, error) {
+		lookupM.Lock()
+		lookups++
+		block := unblock
+		ret, retTTL, err := ips, ttl, lookupErr
+		lookupM.Unlock()
+		if block != nil {
+			<-block
+		}
+		return ret, retTTL, err
+	}
+
+	t.Run("IP literal", func(t *testing.T) {
+		got, err := r.resolve("2001:db8::1")
+		assert.NoError(t, err)
+		assert.Equal(t, []net.IP{net.ParseIP("2001:db8::1")}, got)
+		assert.Equal(t, 0, lookupCount())
+	})
+
+	t.Run("refreshed in the background", func(t *testing.T) {
+		got, err := r.resolve("example.org")
+		assert.NoError(t, err)
+		assert.Equal(t, ips, got)
+		_, _ = r.resolve("example.org")
+		assert.Equal(t, 1, lookupCount())
+
+		advance(9 * time.Minute)
+		_, _ = r.resolve("example.org")
+		time.Sleep(10 * time.Millisecond)
+		assert.Equal(t, 1, lookupCount(), "addresses shouldn't be looked up again before their TTL")
+
+		advance(time.Minute)
+		oldIPs := ips
+		setLookup([]net.IP{net.ParseIP("192.0.2.3")}, nil)
+		got, _ = r.resolve("example.org")
+		assert.Equal(t, oldIPs, got, "the cached addresses should be served while they are looked up again")
+		assert.Eventually(t, func() bool {
+			got, _ := r.resolve("example.org")
+			return len(got) == 1 && got[0].Equal(net.ParseIP("192.0.2.3"))
+		}, time.Second, time.Millisecond)
+		assert.Equal(t, 2, lookupCount())
+	})
+
+	t.Run("TTL is clamped", func(t *testing.T) {
+		lookupM.Lock()
+		ttl = time.Second
+		lookupM.Unlock()
+		defer func() {
+			lookupM.Lock()
+			ttl = 10 * time.Minute
+			lookupM.Unlock()
+		}()
+		before := lookupCount()
+		_, _ = r.resolve("short.example.org")
+		advance(time.Second)
+		_, _ = r.resolve("short.example.org")
+		time.Sleep(10 * time.Millisecond)
+		assert.Equal(t, before+1, lookupCount(), "a TTL below minRedirTTL should be raised to it")
+		advance(minRedirTTL)
+		_, _ = r.resolve("short.example.org")
+		assert.Eventually(t, func() bool { return lookupCount() == before+2 }, time.Second, time.Millisecond)
+	})
+
+	t.Run("concurrent lookups are collapsed", func(t *testing.T) {
+		before := lookupCount()
+		lookupM.Lock()
+		unblock = make(chan struct{})
+		lookupM.Unlock()
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				got, err := r.resolve("busy.example.org")
+				assert.NoError(t, err)
+				assert.Len(t, got, 1)
+			}()
+		}
+		assert.Eventually(t, func() bool { return lookupCount() > before }, time.Second, time.Millisecond)
+		// let the others pile up behind the first lookup
+		time.Sleep(50 * time.Millisecond)
+		lookupM.Lock()
+		close(unblock)
+		unblock = nil
+		lookupM.Unlock()
+		wg.Wait()
+		assert.Equal(t, before+1, lookupCount())
+	})
+
+	t.Run("demote", func(t *testing.T) {
+		setLookup([]net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2"), net.ParseIP("192.0.2.3")}, nil)
+		got, _ := r.resolve("demote.example.org")
+		r.demote("demote.example.org", got[0])
+		got, _ = r.resolve("demote.example.org")
+		assert.Equal(t, []net.IP{net.ParseIP("192.0.2.2"), net.ParseIP("192.0.2.3"), net.ParseIP("192.0.2.1")}, got)
+	})
+
+	t.Run("stale addresses are kept on failure", func(t *testing.T) {
+		advance(time.Hour)
+		setLookup(nil, errors.New("no network"))
+		before := lookupCount()
+		got, err := r.resolve("example.org")
+		assert.NoError(t, err)
+		assert.Equal(t, []net.IP{net.ParseIP("192.0.2.3")}, got)
+		assert.Eventually(t, func() bool { return lookupCount() == before+1 }, time.Second, time.Millisecond)
+
+		// the failed lookup is only retried after minRedirTTL
+		time.Sleep(10 * time.Millisecond)
+		_, _ = r.resolve("example.org")
+		assert.Equal(t, before+1, lookupCount())
+		advance(minRedirTTL)
+		got, _ = r.resolve("example.org")
+		assert.Equal(t, []net.IP{net.ParseIP("192.0.2.3")}, got)
+		assert.Eventually(t, func() bool { return lookupCount() == before+2 }, time.Second, time.Millisecond)
+
+		_, err = r.resolve("new.example.org")
+		assert.Error(t, err)
+	})
+}
+
+func TestState_DialRedir(t *testing.T) {
+	r := makeRedirResolver(time.Now)
+	r.lookup = func(host string) ([]net.IP, time.Duration, error) {
+		return []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("127.0.0.1")}, defaultRedirTTL, nil
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	var dialed []string
+	sta := &State{
+		RedirDialer: dialerFunc(func(network, address string) (net.Conn, error) {
+			dialed = append(dialed, address)
+			if address != l.Addr().String() {
+				return nil, errors.New("unreachable")
+			}
+			return net.Dial(network, address)
+		}),
+		redirResolver: r,
+	}
+	conn, err := sta.dialRedir(redirTarget{host: "example.org"}, port)
+	if assert.NoError(t, err) {
+		conn.Close()
+	}
+	conn, err = sta.dialRedir(redirTarget{host: "example.org"}, port)
+	if assert.NoError(t, err) {
+		conn.Close()
+	}
+	assert.Equal(t, []string{"192.0.2.1:" + port, l.Addr().String(), l.Addr().String()}, dialed,
+		"an unreachable address should be tried last")
+
+	l.Close()
+	_, err = sta.dialRedir(redirTarget{host: "example.org"}, port)
+	assert.Error(t, err)
+}
+
+type dialerFunc func(network, address string) (net.Conn, error)
+
+func (f dialerFunc) Dial(network, address string) (net.Conn, error) { return f(network, address) }
+
+func TestQueryTTL(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var query dnsmessage.Message
+			if err := query.Unpack(buf[:n]); err != nil {
+				continue
+			}
+			resp := dnsmessage.Message{
+				Header:    dnsmessage.Header{ID: query.ID, Response: true},
+				Questions: query.Questions,
+			}
+			if query.Questions[0].Type == dnsmessage.TypeA {
+				for _, ttl := range []uint32{300, 60} {
+					resp.Answers = append(resp.Answers, dnsmessage.Resource{
+						Header: dnsmessage.ResourceHeader{Name: query.Questions[0].Name, Type: dnsmessage.TypeA,
+							Class: dnsmessage.ClassINET, TTL: ttl},
+						Body: &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}},
+					})
+				}
+			}
+			packed, _ := resp.Pack()
+			_, _ = pc.WriteTo(packed, addr)
+		}
+	}()
+
+	ttl, err := queryTTL("example.org", pc.LocalAddr().String())
+	assert.NoError(t, err)
+	assert.Equal(t, 60*time.Second, ttl)
+}
@@ -0,0 +1,259 @@
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	stdlog "log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// TLSTerminationConfig makes ck-server complete the TLS handshakes of visitors that aren't Cloak clients itself, with
+// a real certificate, and serve them a website instead of forwarding them to the redirection target
+type TLSTerminationConfig struct {
+	// CertFile and KeyFile are the paths to the PEM encoded certificate and private key of the website
+	CertFile string
+	KeyFile  string
+	// ACME obtains the certificate from an ACME CA instead of CertFile and KeyFile
+	ACME *ACMEConfig
+	// StaticDir is the directory of the files of a static website
+	StaticDir string
+	// ProxyURL is the URL of a web server to reverse proxy to instead of serving StaticDir
+	ProxyURL string
+}
+
+// ACMEConfig obtains certificates through the TLS-ALPN-01 challenge, which needs ck-server to be reachable on port 443
+// of Domains
+type ACMEConfig struct {
+	Domains []string
+	Email   string
+	// CacheDir is where the certificates are kept across restarts. Without it, they are obtained again on every start
+	CacheDir string
+	// DirectoryURL defaults to Let's Encrypt
+	DirectoryURL string
+	// CAFile is the path to PEM encoded CA certificates the ACME server is trusted with on top of the system's, e.g.
+	// for a local test CA
+	CAFile string
+}
+
+const (
+	siteReadHeaderTimeout = 15 * time.Second
+	siteIdleTimeout       = 2 * time.Minute
+)
+
+// site serves the connections of visitors that aren't Cloak clients. It runs an http.Server on a listener which the
+// connections are handed to one by one
+type site struct {
+	tlsConfig *tls.Config
+	server    *http.Server
+	listener  *connListener
+}
+
+func makeSite(conf TLSTerminationConfig, idleTimeout time.Duration) (*site, error) {
+	s := &site{listener: makeConnListener()}
+
+	switch {
+	case conf.ACME != nil && (conf.CertFile != "" || conf.KeyFile != ""):
+		return nil, errors.New("ACME cannot be set along with CertFile and KeyFile")
+	case conf.ACME != nil:
+		manager, err := makeACMEManager(*conf.ACME)
+		if err != nil {
+			return nil, err
+		}
+		s.tlsConfig = manager.TLSConfig()
+	case conf.CertFile != "" && conf.KeyFile != "":
+		cert, err := tls.LoadX509KeyPair(conf.CertFile, conf.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load certificate: %w", err)
+		}
+		s.tlsConfig = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			NextProtos:   []string{"h2", "http/1.1"},
+		}
+	default:
+		return nil, errors.New("either CertFile and KeyFile or ACME must be set")
+	}
+
+	var handler http.Handler
+	switch {
+	case conf.StaticDir != "" && conf.ProxyURL != "":
+		return nil, errors.New("StaticDir and ProxyURL cannot both be set")
+	case conf.StaticDir != "":
+		if info, err := os.Stat(conf.StaticDir); err != nil || !info.IsDir() {
+			return nil, fmt.Errorf("StaticDir %v is not a directory", conf.StaticDir)
+		}
+		handler = http.FileServer(http.Dir(conf.StaticDir))
+	case conf.ProxyURL != "":
+		target, err := url.Parse(conf.ProxyURL)
+		if err != nil || target.Host == "" {
+			return nil, fmt.Errorf("invalid ProxyURL %v", conf.ProxyURL)
+		}
+		handler = httputil.NewSingleHostReverseProxy(target)
+	default:
+		return nil, errors.New("either StaticDir or ProxyURL must be set")
+	}
+
+	if idleTimeout == 0 {
+		idleTimeout = siteIdleTimeout
+	}
+	s.server = &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: siteReadHeaderTimeout,
+		IdleTimeout:       idleTimeout,
+		// failed handshakes of scanners aren't worth more than debug logs
+		ErrorLog: stdlog.New(log.StandardLogger().WriterLevel(log.DebugLevel), "", 0),
+	}
+	go func() {
+		// Serve only returns once the listener is closed
+		err := s.server.Serve(s.listener)
+		log.Debugf("TLS termination site stopped: %v", err)
+	}()
+	return s, nil
+}
+
+func makeACMEManager(conf ACMEConfig) (*autocert.Manager, error) {
+	if len(conf.Domains) == 0 {
+		return nil, errors.New("ACME needs Domains")
+	}
+	client := &acme.Client{DirectoryURL: conf.DirectoryURL}
+	if conf.CAFile != "" {
+		pem, err := os.ReadFile(conf.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read CAFile: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in CAFile")
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+		client.HTTPClient = &http.Client{Transport: transport}
+	}
+	manager := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(conf.Domains...),
+		Email:      conf.Email,
+		Client:     client,
+	}
+	if conf.CacheDir != "" {
+		manager.Cache = autocert.DirCache(conf.CacheDir)
+	}
+	return manager, nil
+}
+
+// acmeTLSALPN is the protocol ACME CAs offer, and offer alone, when they validate a TLS-ALPN-01 challenge
+const acmeTLSALPN = "acme-tls/1"
+
+// isACMEChallenge tells whether data is the ClientHello of an ACME CA validating a TLS-ALPN-01 challenge, which has to
+// be answered by the site
+func isACMEChallenge(data []byte, transport Transport) bool {
+	if _, ok := transport.(TLS); !ok {
+		return false
+	}
+	ch, err := parseClientHello(data)
+	if err != nil {
+		return false
+	}
+	alpn, ok := ch.extensions[[2]byte{0x00, 0x10}]
+	if !ok {
+		return false
+	}
+	protos, err := parseALPN(alpn)
+	return err == nil && len(protos) == 1 && protos[0] == acmeTLSALPN
+}
+
+// serve hands conn, whose first packet data has already been read, to the website, completing the TLS handshake
+// first if it came in over TLS. It returns once conn is closed
+func (s *site) serve(conn net.Conn, data []byte, transport Transport) {
+	c := &siteConn{
+		Conn:   conn,
+		r:      io.MultiReader(bytes.NewReader(data), conn),
+		closed: make(chan struct{}),
+	}
+	var served net.Conn = c
+	if _, ok := transport.(TLS); ok {
+		served = tls.Server(c, s.tlsConfig)
+	}
+	if !s.listener.push(served) {
+		conn.Close()
+		return
+	}
+	<-c.closed
+}
+
+// siteConn replays the first packet already read from a connection before reading the rest of it
+type siteConn struct {
+	net.Conn
+	r io.Reader
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func (c *siteConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *siteConn) Close() error {
+	err := c.Conn.Close()
+	c.closeOnce.Do(func() { close(c.closed) })
+	return err
+}
+
+// connListener is a net.Listener accepting the connections pushed into it
+type connListener struct {
+	conns     chan net.Conn
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func makeConnListener() *connListener {
+	return &connListener{
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+}
+
+// push hands conn to whoever is accepting. It returns false if the listener is closed
+func (l *connListener) push(conn net.Conn) bool {
+	select {
+	case l.conns <- conn:
+		return true
+	case <-l.closed:
+		return false
+	}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *connListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return &net.TCPAddr{}
+}
@@ -0,0 +1,348 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/common"
+	"github.com/stretchr/testify/assert"
+)
+
+// writeTestCert writes a self-signed certificate for example.com and its key into dir
+func writeTestCert(t *testing.T, dir string) (certFile string, keyFile string, pool *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		DNSNames:     []string{"example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	cert, _ := x509.ParseCertificate(der)
+	pool = x509.NewCertPool()
+	pool.AddCert(cert)
+	return
+}
+
+// serveRedirected redirects the connections to l the way dispatchConnection does with those that aren't Cloak's
+func serveRedirected(sta *State, l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			buf := make([]byte, firstPacketSize)
+			i, transport, redirOnErr, err := readFirstPacket(conn, buf, time.Second)
+			if err != nil && !redirOnErr {
+				return
+			}
+			sta.redirect(conn, buf[:i], transport)
+		}()
+	}
+}
+
+func TestMakeSite(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, _ := writeTestCert(t, dir)
+
+	for name, conf := range map[string]TLSTerminationConfig{
+		"no certificate":        {StaticDir: dir},
+		"certificate and ACME":  {CertFile: certFile, KeyFile: keyFile, ACME: &ACMEConfig{Domains: []string{"example.com"}}, StaticDir: dir},
+		"ACME without domains":  {ACME: &ACMEConfig{}, StaticDir: dir},
+		"bad certificate":       {CertFile: keyFile, KeyFile: keyFile, StaticDir: dir},
+		"no site":               {CertFile: certFile, KeyFile: keyFile},
+		"both sites":            {CertFile: certFile, KeyFile: keyFile, StaticDir: dir, ProxyURL: "http://127.0.0.1:8080"},
+		"missing static dir":    {CertFile: certFile, KeyFile: keyFile, StaticDir: filepath.Join(dir, "missing")},
+		"relative proxy target": {CertFile: certFile, KeyFile: keyFile, ProxyURL: "/index.html"},
+	} {
+		_, err := makeSite(conf, 0)
+		assert.Error(t, err, name)
+	}
+
+	_, err := makeSite(TLSTerminationConfig{ACME: &ACMEConfig{Domains: []string{"example.com"}}, StaticDir: dir}, 0)
+	assert.NoError(t, err)
+
+	sta, err := InitState(RawConfig{
+		TLSTermination: &TLSTerminationConfig{CertFile: certFile, KeyFile: keyFile, StaticDir: dir},
+		PrivateKey:     make([]byte, 32),
+	}, common.WorldOfTime(time.Now()))
+	assert.NoError(t, err, "RedirAddr shouldn't be needed with TLSTermination")
+	assert.NotNil(t, sta.site)
+}
+
+func TestSite_Static(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, pool := writeTestCert(t, dir)
+	os.WriteFile(filepath.Join(dir, "index.html"), []byte("<h1>hello</h1>"), 0600)
+
+	s, err := makeSite(TLSTerminationConfig{CertFile: certFile, KeyFile: keyFile, StaticDir: dir}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.listener.Close()
+	sta := &State{site: s, redirLimiter: makeRedirLimiter(RedirLimitsConfig{})}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go serveRedirected(sta, l)
+
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, "tcp", l.Addr().String())
+	}
+	client := &http.Client{Transport: &http.Transport{
+		DialContext:       dial,
+		TLSClientConfig:   &tls.Config{RootCAs: pool},
+		ForceAttemptHTTP2: true,
+	}}
+
+	resp, err := client.Get("https://example.com/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "<h1>hello</h1>", string(body))
+	assert.Equal(t, uint16(tls.VersionTLS13), resp.TLS.Version)
+	assert.Equal(t, "h2", resp.TLS.NegotiatedProtocol)
+
+	// visitors over plain HTTP, e.g. on a WebSocket port, get the same site
+	plain := &http.Client{Transport: &http.Transport{DialContext: dial}}
+	resp, err = plain.Get("http://example.com/index.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "<h1>hello</h1>", string(body))
+}
+
+func TestSite_Proxy(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, pool := writeTestCert(t, dir)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("X-Forwarded-For")))
+	}))
+	defer upstream.Close()
+
+	s, err := makeSite(TLSTerminationConfig{CertFile: certFile, KeyFile: keyFile, ProxyURL: upstream.URL}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.listener.Close()
+	sta := &State{site: s, redirLimiter: makeRedirLimiter(RedirLimitsConfig{})}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go serveRedirected(sta, l)
+
+	conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{RootCAs: pool, ServerName: "example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n"))
+	resp, err := io.ReadAll(conn)
+	assert.NoError(t, err)
+	assert.Contains(t, string(resp), "\r\n\r\n127.0.0.1", "the visitor's address should be passed on")
+}
+
+// recordACMEHellos makes s send the server names of the ClientHellos offering acme-tls/1 to the returned channel
+func recordACMEHellos(s *site) <-chan string {
+	hellos := make(chan string, 16)
+	tlsConfig := s.tlsConfig.Clone()
+	getCertificate := tlsConfig.GetCertificate
+	certificates := tlsConfig.Certificates
+	// ALPN is negotiated before the certificate is asked for, as it is with autocert
+	if !slices.Contains(tlsConfig.NextProtos, acmeTLSALPN) {
+		tlsConfig.NextProtos = append(tlsConfig.NextProtos, acmeTLSALPN)
+	}
+	tlsConfig.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		for _, proto := range hello.SupportedProtos {
+			if proto == acmeTLSALPN {
+				hellos <- hello.ServerName
+			}
+		}
+		if getCertificate != nil {
+			return getCertificate(hello)
+		}
+		return &certificates[0], nil
+	}
+	s.tlsConfig = tlsConfig
+	return hellos
+}
+
+// serveDispatched dispatches the connections to l the way ck-server does
+func serveDispatched(sta *State, l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go dispatchConnection(conn, sta)
+	}
+}
+
+func TestDispatchConnection_ACMEChallenge(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, _ := writeTestCert(t, dir)
+	sta, err := InitState(RawConfig{
+		TLSTermination: &TLSTerminationConfig{CertFile: certFile, KeyFile: keyFile, StaticDir: dir},
+		AuthBans:       AuthBanConfig{MaxFailures: 1, Window: 60, BanDuration: 60},
+		PrivateKey:     make([]byte, 32),
+	}, common.WorldOfTime(time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sta.site.listener.Close()
+	hellos := recordACMEHellos(sta.site)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go serveDispatched(sta, l)
+	visitor := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+
+	// the site has no challenge to answer with, so only getting there matters
+	conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{
+		ServerName:         "example.com",
+		NextProtos:         []string{acmeTLSALPN},
+		InsecureSkipVerify: true,
+	})
+	if err == nil {
+		conn.Close()
+	}
+	select {
+	case serverName := <-hellos:
+		assert.Equal(t, "example.com", serverName)
+	case <-time.After(time.Second):
+		t.Fatal("the challenge didn't reach the site")
+	}
+	assert.False(t, sta.authBans.isBanned(visitor), "the challenge shouldn't be authenticated as a Cloak client")
+
+	// whereas anything else is, and fails
+	conn, err = tls.Dial("tcp", l.Addr().String(), &tls.Config{ServerName: "example.com", InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	assert.True(t, sta.authBans.isBanned(visitor))
+}
+
+// TestSite_PebbleACME obtains a certificate from a pebble ACME test server, which is only run when
+// CK_PEBBLE_DIRECTORY is set, e.g.
+//
+//	PEBBLE_VA_NOSLEEP=1 pebble -config test/config/pebble-config.json
+//	CK_PEBBLE_DIRECTORY=https://localhost:14000/dir CK_PEBBLE_CA_FILE=test/certs/pebble.minica.pem go test -run Pebble ./internal/server
+//
+// CK_PEBBLE_TLS_ALPN_ADDR is where pebble connects to for TLS-ALPN-01 challenges, 127.0.0.1:5001 by default, and
+// CK_PEBBLE_DOMAIN, example.com by default, must resolve to it for pebble
+func TestSite_PebbleACME(t *testing.T) {
+	directory := os.Getenv("CK_PEBBLE_DIRECTORY")
+	if directory == "" {
+		t.Skip("CK_PEBBLE_DIRECTORY is not set")
+	}
+	listenAddr := os.Getenv("CK_PEBBLE_TLS_ALPN_ADDR")
+	if listenAddr == "" {
+		listenAddr = "127.0.0.1:5001"
+	}
+	domain := os.Getenv("CK_PEBBLE_DOMAIN")
+	if domain == "" {
+		domain = "example.com"
+	}
+
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "index.html"), []byte("<h1>hello</h1>"), 0600)
+	sta, err := InitState(RawConfig{
+		TLSTermination: &TLSTerminationConfig{
+			ACME: &ACMEConfig{
+				Domains:      []string{domain},
+				DirectoryURL: directory,
+				CAFile:       os.Getenv("CK_PEBBLE_CA_FILE"),
+			},
+			StaticDir: dir,
+		},
+		AuthBans:   AuthBanConfig{MaxFailures: 1, Window: 60, BanDuration: 60},
+		PrivateKey: make([]byte, 32),
+	}, common.WorldOfTime(time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sta.site.listener.Close()
+	hellos := recordACMEHellos(sta.site)
+
+	l, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go serveDispatched(sta, l)
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "tcp", l.Addr().String())
+			},
+			// pebble makes up a new root for every run
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+		Timeout: time.Minute,
+	}
+	resp, err := client.Get("https://" + domain + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "<h1>hello</h1>", string(body))
+	assert.Contains(t, resp.TLS.PeerCertificates[0].DNSNames, domain)
+	assert.Contains(t, resp.TLS.PeerCertificates[0].Issuer.CommonName, "Pebble")
+
+	select {
+	case serverName := <-hellos:
+		assert.Equal(t, domain, serverName)
+	default:
+		t.Error("no challenge reached the site")
+	}
+	for _, addr := range []string{"127.0.0.1", "::1"} {
+		assert.False(t, sta.authBans.isBanned(&net.TCPAddr{IP: net.ParseIP(addr)}), "pebble shouldn't be banned")
+	}
+}
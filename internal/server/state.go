@@ -7,24 +7,34 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net"
+	"net/http"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/cbeuw/Cloak/internal/common"
 	"github.com/cbeuw/Cloak/internal/server/usermanager"
+	log "github.com/sirupsen/logrus"
 )
 
 type RawConfig struct {
-	ProxyBook    map[string][]string
-	BindAddr     []string
-	BypassUID    [][]byte
-	RedirAddr    string
-	PrivateKey   []byte
-	AdminUID     []byte
-	DatabasePath string
-	KeepAlive    int
-	CncMode      bool
+	ProxyBook        map[string][]string
+	BindAddr         []string
+	BypassUID        [][]byte
+	RedirAddr        string
+	RedirTable       map[string]string
+	RedirLimits      RedirLimitsConfig
+	AuthBans         AuthBanConfig
+	ProxyProtocol    *ProxyProtocolConfig
+	TLSTermination   *TLSTerminationConfig
+	MimicServerHello *MimicConfig
+	PrivateKey       []byte
+	AdminUID         []byte
+	DatabasePath     string
+	DatabaseDSN      string
+	KeepAlive        int
+	CncMode          bool
+	AdminAPI         *AdminAPIConfig
 }
 
 // State type stores the global state of the program
@@ -38,18 +48,42 @@ type State struct {
 	BypassUID map[[16]byte]struct{}
 	StaticPv  crypto.PrivateKey
 
-	// TODO: this doesn't have to be a net.Addr; resolution is done in Dial automatically
-	RedirHost   net.Addr
+	// RedirHost is a host name or an IP address, resolved through redirResolver every time it's dialed
+	RedirHost   string
 	RedirPort   string
 	RedirDialer common.Dialer
+	// redirResolver caches the addresses of RedirHost and the hosts in redirTable
+	redirResolver *redirResolver
+	RedirLimits   RedirLimitsConfig
+	redirLimiter  *redirLimiter
+	// redirTable maps server names to the redirection targets used instead of RedirHost and RedirPort
+	redirTable map[string]redirTarget
 
 	usedRandomM sync.RWMutex
 	UsedRandom  map[[32]byte]int64
 
 	Panel *userPanel
+
+	// authBans bans the subnets failing authentication too often
+	authBans *authBans
+
+	// proxyProtocol is nil unless the PROXY protocol is enabled
+	proxyProtocol *proxyProtocol
+
+	// serverHelloMimic makes the replies to Cloak clients look like those of the redirection targets. It's nil unless
+	// MimicServerHello is configured
+	serverHelloMimic *serverHelloMimic
+
+	// site serves visitors that aren't Cloak clients in place of the redirection targets. It's nil unless
+	// TLSTermination is configured
+	site *site
+
+	// AdminAPI serves the user management API over HTTPS. It's nil unless configured
+	AdminAPI *http.Server
 }
 
-func parseRedirAddr(redirAddr string) (net.Addr, string, error) {
+// parseRedirAddr splits redirAddr into a host and a port, which is empty if redirAddr doesn't have one
+func parseRedirAddr(redirAddr string) (string, string, error) {
 	var host string
 	var port string
 	colonSep := strings.Split(redirAddr, ":")
@@ -73,38 +107,36 @@ func parseRedirAddr(redirAddr string) (net.Addr, string, error) {
 		// domain or ipv4 without port
 		host = redirAddr
 	}
-
-	redirHost, err := net.ResolveIPAddr("ip", host)
-	if err != nil {
-		return nil, "", fmt.Errorf("unable to resolve RedirAddr: %v. ", err)
+	if host == "" {
+		return "", "", errors.New("empty host")
 	}
-	return redirHost, port, nil
+	return host, port, nil
 }
 
 func parseProxyBook(bookEntries map[string][]string) (map[string]net.Addr, error) {
 	proxyBook := map[string]net.Addr{}
-	for name, pair := range bookEntries {
+	for name, entry := range bookEntries {
 		name = strings.ToLower(name)
-		if len(pair) != 2 {
-			return nil, fmt.Errorf("invalid proxy endpoint and address pair for %v: %v", name, pair)
+		endpoint, err := usermanager.ParseProxyEndpoint(name, entry)
+		if err != nil {
+			return nil, err
 		}
-		network := strings.ToLower(pair[0])
-		switch network {
+		var addr net.Addr
+		switch endpoint.Network {
 		case "tcp":
-			addr, err := net.ResolveTCPAddr("tcp", pair[1])
-			if err != nil {
-				return nil, err
-			}
-			proxyBook[name] = addr
-			continue
+			addr, err = net.ResolveTCPAddr("tcp", endpoint.Address)
 		case "udp":
-			addr, err := net.ResolveUDPAddr("udp", pair[1])
-			if err != nil {
-				return nil, err
-			}
-			proxyBook[name] = addr
-			continue
+			addr, err = net.ResolveUDPAddr("udp", endpoint.Address)
+		case "unix":
+			addr, err = net.ResolveUnixAddr("unix", endpoint.Address)
 		}
+		if err != nil {
+			return nil, err
+		}
+		if endpoint.ProxyProtocol {
+			addr = proxyProtoAddr{addr}
+		}
+		proxyBook[name] = addr
 	}
 	return proxyBook, nil
 }
@@ -137,16 +169,34 @@ func InitState(preParse RawConfig, worldState common.WorldState) (sta *State, er
 		BypassUID:   make(map[[16]byte]struct{}),
 		ProxyBook:   map[string]net.Addr{},
 		UsedRandom:  map[[32]byte]int64{},
-		RedirDialer: &net.Dialer{},
+		RedirDialer: &net.Dialer{Timeout: redirDialTimeout},
 		WorldState:  worldState,
 	}
+	sta.redirResolver = makeRedirResolver(worldState.Now)
+	if err = preParse.AuthBans.validate(); err != nil {
+		err = fmt.Errorf("invalid AuthBans: %v", err)
+		return
+	}
+	sta.authBans = makeAuthBans(preParse.AuthBans, worldState.Now)
+	if sta.authBans.enabled() && preParse.AuthBans.Mode == BanModeDrop {
+		log.Warnf("AuthBans drops connections from banned subnets, and ordinary visitors of the redirection target "+
+			"count as failures too: a subnet with %v visits within %v seconds can no longer reach the site",
+			preParse.AuthBans.MaxFailures, preParse.AuthBans.Window)
+	}
+
 	if preParse.CncMode {
 		err = errors.New("command & control mode not implemented")
 		return
 	} else {
 		var manager usermanager.UserManager
-		if len(preParse.AdminUID) == 0 || preParse.DatabasePath == "" {
+		adminEnabled := len(preParse.AdminUID) != 0 || preParse.AdminAPI != nil
+		if !adminEnabled || (preParse.DatabasePath == "" && preParse.DatabaseDSN == "") {
 			manager = &usermanager.Voidmanager{}
+		} else if preParse.DatabaseDSN != "" {
+			manager, err = usermanager.MakeSQLManager(preParse.DatabaseDSN, worldState)
+			if err != nil {
+				return sta, fmt.Errorf("unable to open user database: %w", err)
+			}
 		} else {
 			manager, err = usermanager.MakeLocalManager(preParse.DatabasePath, worldState)
 			if err != nil {
@@ -154,6 +204,15 @@ func InitState(preParse RawConfig, worldState common.WorldState) (sta *State, er
 			}
 		}
 		sta.Panel = MakeUserPanel(manager)
+		sta.Panel.bans = sta.authBans
+
+		if preParse.AdminAPI != nil {
+			sta.AdminAPI, err = makeAdminAPIServer(*preParse.AdminAPI, sta.Panel)
+			if err != nil {
+				err = fmt.Errorf("unable to set up AdminAPI: %w", err)
+				return
+			}
+		}
 	}
 
 	if preParse.KeepAlive <= 0 {
@@ -162,11 +221,63 @@ func InitState(preParse RawConfig, worldState common.WorldState) (sta *State, er
 		sta.ProxyDialer = &net.Dialer{KeepAlive: time.Duration(preParse.KeepAlive) * time.Second}
 	}
 
-	sta.RedirHost, sta.RedirPort, err = parseRedirAddr(preParse.RedirAddr)
+	if preParse.TLSTermination != nil {
+		sta.site, err = makeSite(*preParse.TLSTermination, time.Duration(preParse.RedirLimits.IdleTimeout)*time.Second)
+		if err != nil {
+			err = fmt.Errorf("unable to set up TLSTermination: %v", err)
+			return
+		}
+	}
+
+	// RedirAddr isn't used with TLSTermination
+	if preParse.RedirAddr != "" || sta.site == nil {
+		sta.RedirHost, sta.RedirPort, err = parseRedirAddr(preParse.RedirAddr)
+		if err != nil {
+			err = fmt.Errorf("unable to parse RedirAddr: %v", err)
+			return
+		}
+	}
+	sta.redirTable, err = parseRedirTable(preParse.RedirTable)
 	if err != nil {
-		err = fmt.Errorf("unable to parse RedirAddr: %v", err)
+		err = fmt.Errorf("unable to parse RedirTable: %v", err)
 		return
 	}
+	if err = preParse.RedirLimits.validate(); err != nil {
+		err = fmt.Errorf("invalid RedirLimits: %v", err)
+		return
+	}
+	sta.RedirLimits = preParse.RedirLimits
+	sta.redirLimiter = makeRedirLimiter(preParse.RedirLimits)
+	if sta.Panel != nil {
+		sta.Panel.redirects = sta.redirLimiter
+	}
+
+	if preParse.ProxyProtocol != nil {
+		sta.proxyProtocol, err = parseProxyProtocol(*preParse.ProxyProtocol)
+		if err != nil {
+			err = fmt.Errorf("invalid ProxyProtocol: %v", err)
+			return
+		}
+	}
+
+	// resolve the redirection targets once to catch typos early
+	for _, target := range append(sta.redirTargets(), redirTarget{host: sta.RedirHost}) {
+		if target.host == "" {
+			continue
+		}
+		if _, err = sta.redirResolver.resolve(target.host); err != nil {
+			err = fmt.Errorf("unable to resolve redirection target: %v", err)
+			return
+		}
+	}
+
+	if preParse.MimicServerHello != nil {
+		sta.serverHelloMimic, err = makeServerHelloMimic(*preParse.MimicServerHello, sta.redirTargetOf, sta.dialRedir)
+		if err != nil {
+			err = fmt.Errorf("invalid MimicServerHello: %v", err)
+			return
+		}
+	}
 
 	sta.ProxyBook, err = parseProxyBook(preParse.ProxyBook)
 	if err != nil {
@@ -195,6 +306,16 @@ func InitState(preParse RawConfig, worldState common.WorldState) (sta *State, er
 	}
 
 	go sta.UsedRandomCleaner()
+	if sta.authBans.enabled() {
+		go sta.authBans.sweeper()
+	}
+	if sta.serverHelloMimic != nil {
+		targets := sta.redirTargets()
+		if sta.RedirHost != "" {
+			targets = append(targets, redirTarget{sta.RedirHost, sta.RedirPort})
+		}
+		go sta.serverHelloMimic.refresher(targets)
+	}
 	return sta, nil
 }
 
@@ -13,8 +13,8 @@ func TestParseRedirAddr(t *testing.T) {
 			t.Errorf("parsing %v error: %v", ipv4noPort, err)
 			return
 		}
-		if host.String() != "1.2.3.4" {
-			t.Errorf("expected %v got %v", "1.2.3.4", host.String())
+		if host != "1.2.3.4" {
+			t.Errorf("expected %v got %v", "1.2.3.4", host)
 		}
 		if port != "" {
 			t.Errorf("port not empty when there is no port")
@@ -28,8 +28,8 @@ func TestParseRedirAddr(t *testing.T) {
 			t.Errorf("parsing %v error: %v", ipv4wPort, err)
 			return
 		}
-		if host.String() != "1.2.3.4" {
-			t.Errorf("expected %v got %v", "1.2.3.4", host.String())
+		if host != "1.2.3.4" {
+			t.Errorf("expected %v got %v", "1.2.3.4", host)
 		}
 		if port != "1234" {
 			t.Errorf("wrong port: expected %v, got %v", "1234", port)
@@ -44,21 +44,8 @@ func TestParseRedirAddr(t *testing.T) {
 			return
 		}
 
-		expIPs, err := net.LookupIP("example.com")
-		if err != nil {
-			t.Errorf("tester error: cannot resolve example.com: %v", err)
-			return
-		}
-
-		contain := false
-		for _, expIP := range expIPs {
-			if expIP.String() == host.String() {
-				contain = true
-			}
-		}
-
-		if !contain {
-			t.Errorf("expected one of %v got %v", expIPs, host.String())
+		if host != "example.com" {
+			t.Errorf("expected %v got %v", "example.com", host)
 		}
 		if port != "" {
 			t.Errorf("port not empty when there is no port")
@@ -73,21 +60,8 @@ func TestParseRedirAddr(t *testing.T) {
 			return
 		}
 
-		expIPs, err := net.LookupIP("example.com")
-		if err != nil {
-			t.Errorf("tester error: cannot resolve example.com: %v", err)
-			return
-		}
-
-		contain := false
-		for _, expIP := range expIPs {
-			if expIP.String() == host.String() {
-				contain = true
-			}
-		}
-
-		if !contain {
-			t.Errorf("expected one of %v got %v", expIPs, host.String())
+		if host != "example.com" {
+			t.Errorf("expected %v got %v", "example.com", host)
 		}
 		if port != "80" {
 			t.Errorf("wrong port: expected %v, got %v", "80", port)
@@ -101,8 +75,8 @@ func TestParseRedirAddr(t *testing.T) {
 			t.Errorf("parsing %v error: %v", ipv6noPort, err)
 			return
 		}
-		if host.String() != "a:b:c:d::" {
-			t.Errorf("expected %v got %v", "a:b:c:d::", host.String())
+		if host != "a:b:c:d::" {
+			t.Errorf("expected %v got %v", "a:b:c:d::", host)
 		}
 		if port != "" {
 			t.Errorf("port not empty when there is no port")
@@ -116,11 +90,42 @@ func TestParseRedirAddr(t *testing.T) {
 			t.Errorf("parsing %v error: %v", ipv6wPort, err)
 			return
 		}
-		if host.String() != "a:b:c:d::" {
-			t.Errorf("expected %v got %v", "a:b:c:d::", host.String())
+		if host != "a:b:c:d::" {
+			t.Errorf("expected %v got %v", "a:b:c:d::", host)
 		}
 		if port != "80" {
 			t.Errorf("wrong port: expected %v, got %v", "80", port)
 		}
 	})
 }
+
+func TestParseProxyBook(t *testing.T) {
+	proxyBook, err := parseProxyBook(map[string][]string{
+		"shadowsocks": {"tcp", "127.0.0.1:8388"},
+		"openvpn":     {"tcp", "127.0.0.1:1194", "ProxyProtocol"},
+		"v2ray":       {"unix", "/run/v2ray.sock"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := proxyBook["shadowsocks"].(*net.TCPAddr); !ok {
+		t.Errorf("expected a plain tcp address, got %T", proxyBook["shadowsocks"])
+	}
+	if addr, ok := proxyBook["openvpn"].(proxyProtoAddr); !ok || addr.String() != "127.0.0.1:1194" {
+		t.Errorf("expected a PROXY protocol address, got %T %v", proxyBook["openvpn"], proxyBook["openvpn"])
+	}
+	if addr := proxyBook["v2ray"]; addr == nil || addr.Network() != "unix" || addr.String() != "/run/v2ray.sock" {
+		t.Errorf("expected a unix socket address, got %v", addr)
+	}
+
+	for _, pair := range [][]string{
+		{"tcp", "127.0.0.1:1194", "unknown"},
+		{"udp", "127.0.0.1:1194", "ProxyProtocol"},
+		{"sctp", "127.0.0.1:1194"},
+		{"tcp"},
+	} {
+		if _, err := parseProxyBook(map[string][]string{"openvpn": pair}); err == nil {
+			t.Errorf("expected an error for %v", pair)
+		}
+	}
+}
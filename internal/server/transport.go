@@ -3,14 +3,46 @@ package server
 import (
 	"crypto"
 	"errors"
+	"fmt"
 	"io"
 	"net"
+	"strings"
 )
 
-type Responder = func(originalConn net.Conn, sessionKey [32]byte, randSource io.Reader) (preparedConn net.Conn, err error)
+// Responder completes the handshake of an authenticated client described by info
+type Responder = func(originalConn net.Conn, info ClientInfo, sessionKey [32]byte, randSource io.Reader) (preparedConn net.Conn, err error)
 type Transport interface {
-	processFirstPacket(reqPacket []byte, privateKey crypto.PrivateKey) (authFragments, Responder, error)
+	processFirstPacket(reqPacket []byte, privateKey crypto.PrivateKey, mimic *serverHelloMimic) (authFragments, Responder, error)
 }
 
 var ErrInvalidPubKey = errors.New("public key has invalid format")
 var ErrCiphertextLength = errors.New("ciphertext has the wrong length")
+
+// ParseTransports parses a comma-separated list of transport names, tls and websocket
+func ParseTransports(names string) ([]Transport, error) {
+	var transports []Transport
+	for _, name := range strings.Split(names, ",") {
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "tls":
+			transports = append(transports, TLS{})
+		case "websocket":
+			transports = append(transports, WebSocket{})
+		default:
+			return nil, fmt.Errorf("unknown transport %v", name)
+		}
+	}
+	return transports, nil
+}
+
+// acceptsTransport tells whether transport is one of transports. No transports means all of them
+func acceptsTransport(transports []Transport, transport Transport) bool {
+	if len(transports) == 0 {
+		return true
+	}
+	for _, t := range transports {
+		if t == transport {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,136 @@
+package usermanager
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	gmux "github.com/gorilla/mux"
+)
+
+var ErrUserNotActive = errors.New("User is not active")
+var ErrSessionNotFound = errors.New("Session does not exist")
+
+// defaultKickReason is sent to clients kicked through the admin API without a reason given
+const defaultKickReason = "Kicked by admin"
+
+// SessionStatus describes a live session of an active user
+type SessionStatus struct {
+	SessionID   uint32
+	NumStreams  int
+	RemoteAddrs []string
+}
+
+// ActiveUserStatus describes a user that is connected right now. RxBytes and TxBytes are the usage since it was
+// last uploaded to the UserManager, and are always 0 for bypass users
+type ActiveUserStatus struct {
+	UID      []byte
+	Bypass   bool
+	RxBytes  int64
+	TxBytes  int64
+	Sessions []SessionStatus
+}
+
+// ActiveUserPanel gives the admin API access to the users connected to the server
+type ActiveUserPanel interface {
+	ListActiveUsers() []ActiveUserStatus
+	// GetActiveUser returns ErrUserNotActive if UID isn't connected
+	GetActiveUser(UID []byte) (ActiveUserStatus, error)
+	// TerminateUser closes all sessions of a user. It returns ErrUserNotActive if UID isn't connected
+	TerminateUser(UID []byte, reason string) error
+	// CloseSession closes one session of a user. It returns ErrUserNotActive or ErrSessionNotFound if either doesn't
+	// exist
+	CloseSession(UID []byte, sessionID uint32, reason string) error
+	// RefreshUser applies the user's UserInfo in the UserManager to it if it's active, so that changes to its rates
+	// and sessions cap take effect on the sessions it already has
+	RefreshUser(UID []byte)
+}
+
+// refreshUser is called after a user is changed through the API
+func (ar *APIRouter) refreshUser(UID []byte) {
+	if ar.panel != nil {
+		ar.panel.RefreshUser(UID)
+	}
+}
+
+func uidOf(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	b64UID := gmux.Vars(r)["UID"]
+	if b64UID == "" {
+		http.Error(w, "UID cannot be empty", http.StatusBadRequest)
+		return nil, false
+	}
+	UID, err := base64.URLEncoding.DecodeString(b64UID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	return UID, true
+}
+
+func kickReasonOf(r *http.Request) string {
+	if reason := r.URL.Query().Get("reason"); reason != "" {
+		return reason
+	}
+	return defaultKickReason
+}
+
+func writeKickError(w http.ResponseWriter, err error) {
+	switch err {
+	case nil:
+		w.WriteHeader(http.StatusOK)
+	case ErrUserNotActive, ErrSessionNotFound:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (ar *APIRouter) listActiveUsersHlr(w http.ResponseWriter, r *http.Request) {
+	resp, err := json.Marshal(ar.panel.ListActiveUsers())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, _ = w.Write(resp)
+}
+
+func (ar *APIRouter) getActiveUserHlr(w http.ResponseWriter, r *http.Request) {
+	UID, ok := uidOf(w, r)
+	if !ok {
+		return
+	}
+	status, err := ar.panel.GetActiveUser(UID)
+	if err == ErrUserNotActive {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	resp, err := json.Marshal(status)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, _ = w.Write(resp)
+}
+
+func (ar *APIRouter) terminateActiveUserHlr(w http.ResponseWriter, r *http.Request) {
+	UID, ok := uidOf(w, r)
+	if !ok {
+		return
+	}
+	writeKickError(w, ar.panel.TerminateUser(UID, kickReasonOf(r)))
+}
+
+func (ar *APIRouter) closeSessionHlr(w http.ResponseWriter, r *http.Request) {
+	UID, ok := uidOf(w, r)
+	if !ok {
+		return
+	}
+	sessionID, err := strconv.ParseUint(gmux.Vars(r)["SessionID"], 10, 32)
+	if err != nil {
+		http.Error(w, "invalid SessionID", http.StatusBadRequest)
+		return
+	}
+	writeKickError(w, ar.panel.CloseSession(UID, uint32(sessionID), kickReasonOf(r)))
+}
@@ -0,0 +1,133 @@
+package usermanager
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type kick struct {
+	UID       []byte
+	SessionID uint32
+	Reason    string
+}
+
+// mockPanel has one active user, mockUID, with a session of ID 1
+type mockPanel struct {
+	kicks     []kick
+	refreshes [][]byte
+}
+
+func (p *mockPanel) RefreshUser(UID []byte) {
+	p.refreshes = append(p.refreshes, UID)
+}
+
+func (p *mockPanel) ListActiveUsers() []ActiveUserStatus {
+	return []ActiveUserStatus{mockActiveUserStatus}
+}
+
+func (p *mockPanel) GetActiveUser(UID []byte) (ActiveUserStatus, error) {
+	if !bytes.Equal(UID, mockUID) {
+		return ActiveUserStatus{}, ErrUserNotActive
+	}
+	return mockActiveUserStatus, nil
+}
+
+func (p *mockPanel) TerminateUser(UID []byte, reason string) error {
+	if !bytes.Equal(UID, mockUID) {
+		return ErrUserNotActive
+	}
+	p.kicks = append(p.kicks, kick{UID, 0, reason})
+	return nil
+}
+
+func (p *mockPanel) CloseSession(UID []byte, sessionID uint32, reason string) error {
+	if !bytes.Equal(UID, mockUID) {
+		return ErrUserNotActive
+	}
+	if sessionID != 1 {
+		return ErrSessionNotFound
+	}
+	p.kicks = append(p.kicks, kick{UID, sessionID, reason})
+	return nil
+}
+
+var mockActiveUserStatus = ActiveUserStatus{
+	UID:     mockUID,
+	RxBytes: 10,
+	TxBytes: 20,
+	Sessions: []SessionStatus{{
+		SessionID:   1,
+		NumStreams:  2,
+		RemoteAddrs: []string{"192.0.2.1:12345"},
+	}},
+}
+
+func TestActiveUserHlrs(t *testing.T) {
+	panel := &mockPanel{}
+	router := APIRouterOf(nil, panel)
+	serve := func(method, target string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest(method, target, nil))
+		return rr
+	}
+
+	t.Run("list", func(t *testing.T) {
+		rr := serve("GET", "/admin/active")
+		assert.Equal(t, http.StatusOK, rr.Code)
+		var got []ActiveUserStatus
+		assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &got))
+		assert.Equal(t, []ActiveUserStatus{mockActiveUserStatus}, got)
+	})
+
+	t.Run("get", func(t *testing.T) {
+		rr := serve("GET", "/admin/active/"+mockUIDb64)
+		assert.Equal(t, http.StatusOK, rr.Code)
+		var got ActiveUserStatus
+		assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &got))
+		assert.Equal(t, mockActiveUserStatus, got)
+
+		assert.Equal(t, http.StatusNotFound, serve("GET", "/admin/active/AAAAAAAAAAAAAAAAAAAAAA==").Code)
+		assert.Equal(t, http.StatusBadRequest, serve("GET", "/admin/active/defonotbase64").Code)
+	})
+
+	t.Run("kick", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, serve("DELETE", "/admin/active/"+mockUIDb64+"/sessions/1?reason=maintenance").Code)
+		assert.Equal(t, http.StatusNotFound, serve("DELETE", "/admin/active/"+mockUIDb64+"/sessions/2").Code)
+		assert.Equal(t, http.StatusBadRequest, serve("DELETE", "/admin/active/"+mockUIDb64+"/sessions/x").Code)
+		assert.Equal(t, http.StatusOK, serve("DELETE", "/admin/active/"+mockUIDb64).Code)
+		assert.Equal(t, http.StatusNotFound, serve("DELETE", "/admin/active/AAAAAAAAAAAAAAAAAAAAAA==").Code)
+		assert.Equal(t, []kick{
+			{mockUID, 1, "maintenance"},
+			{mockUID, 0, defaultKickReason},
+		}, panel.kicks)
+	})
+
+	t.Run("not served without a panel", func(t *testing.T) {
+		router, cleaner := makeRouter(t)
+		defer cleaner()
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("GET", "/admin/active", nil))
+		assert.NotEqual(t, http.StatusOK, rr.Code)
+	})
+
+	t.Run("refresh on write", func(t *testing.T) {
+		router, cleaner := makeRouter(t)
+		defer cleaner()
+		panel := &mockPanel{}
+		router.panel = panel
+
+		marshalled, _ := json.Marshal(mockUserInfo)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("POST", "/admin/users/"+mockUIDb64, bytes.NewReader(marshalled)))
+		assert.Equal(t, http.StatusCreated, rr.Code)
+		rr = httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("DELETE", "/admin/users/"+mockUIDb64, nil))
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.Equal(t, [][]byte{mockUID, mockUID}, panel.refreshes)
+	})
+}
@@ -0,0 +1,104 @@
+package usermanager
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Scope is what an admin API caller is allowed to do. ScopeWrite includes ScopeRead
+type Scope int
+
+const (
+	ScopeRead Scope = iota + 1
+	ScopeWrite
+)
+
+func ParseScope(s string) (Scope, error) {
+	switch strings.ToLower(s) {
+	case "read":
+		return ScopeRead, nil
+	case "write":
+		return ScopeWrite, nil
+	default:
+		return 0, fmt.Errorf("unknown scope %v, must be read or write", s)
+	}
+}
+
+// AnyClientCert is the key in APIAuth.ClientCertScopes that matches any verified client certificate
+const AnyClientCert = "*"
+
+// APIAuth authenticates callers of the admin API reached directly rather than through an AdminUID session, either
+// with a bearer token or with a client certificate verified by the TLS server
+type APIAuth struct {
+	// sha256 of bearer token -> scope
+	tokens map[[32]byte]Scope
+	// common name of client certificate -> scope
+	clientCertScopes map[string]Scope
+}
+
+// MakeAPIAuth takes maps of bearer tokens and client certificate common names to scopes
+func MakeAPIAuth(tokens map[string]Scope, clientCertScopes map[string]Scope) *APIAuth {
+	auth := &APIAuth{
+		tokens:           make(map[[32]byte]Scope),
+		clientCertScopes: clientCertScopes,
+	}
+	for token, scope := range tokens {
+		// tokens are looked up by their hashes so that the lookup doesn't leak how much of a token is right
+		auth.tokens[sha256.Sum256([]byte(token))] = scope
+	}
+	return auth
+}
+
+// scopeOf returns the scope of the caller of r, or 0 if it isn't authenticated
+func (auth *APIAuth) scopeOf(r *http.Request) Scope {
+	if r.TLS != nil && len(r.TLS.VerifiedChains) != 0 {
+		cn := r.TLS.VerifiedChains[0][0].Subject.CommonName
+		if scope, ok := auth.clientCertScopes[cn]; ok {
+			return scope
+		}
+		if scope, ok := auth.clientCertScopes[AnyClientCert]; ok {
+			return scope
+		}
+	}
+
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return 0
+	}
+	return auth.tokens[sha256.Sum256([]byte(token))]
+}
+
+// requiredScope is ScopeRead for requests that don't change anything, and ScopeWrite for everything else
+func requiredScope(r *http.Request) Scope {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		return ScopeRead
+	default:
+		return ScopeWrite
+	}
+}
+
+// Middleware rejects requests whose callers aren't authenticated or don't have the scope needed. CORS preflight
+// requests are let through as they carry no credentials and change nothing
+func (auth *APIAuth) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions {
+			w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+			next.ServeHTTP(w, r)
+			return
+		}
+		scope := auth.scopeOf(r)
+		if scope == 0 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="cloak"`)
+			http.Error(w, "unauthorised", http.StatusUnauthorized)
+			return
+		}
+		if scope < requiredScope(r) {
+			http.Error(w, "insufficient scope", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,66 @@
+package usermanager
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAPIAuth_Middleware(t *testing.T) {
+	router, cleaner := makeRouter(t)
+	defer cleaner()
+	auth := MakeAPIAuth(map[string]Scope{
+		"reader": ScopeRead,
+		"writer": ScopeWrite,
+	}, map[string]Scope{
+		"automation": ScopeWrite,
+	})
+	handler := auth.Middleware(router)
+
+	marshalled, err := json.Marshal(mockUserInfo)
+	assert.NoError(t, err)
+
+	do := func(method string, token string, peerCN string) int {
+		req := httptest.NewRequest(method, "/admin/users/"+mockUIDb64, bytes.NewReader(marshalled))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		if peerCN != "" {
+			cert := &x509.Certificate{Subject: pkix.Name{CommonName: peerCN}}
+			req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, do("GET", "", ""))
+	assert.Equal(t, http.StatusUnauthorized, do("GET", "wrong", ""))
+	assert.Equal(t, http.StatusUnauthorized, do("GET", "", "stranger"))
+
+	assert.Equal(t, http.StatusForbidden, do("POST", "reader", ""))
+	assert.Equal(t, http.StatusCreated, do("POST", "writer", ""))
+	assert.Equal(t, http.StatusOK, do("GET", "reader", ""))
+	assert.Equal(t, http.StatusOK, do("GET", "", "automation"))
+	assert.Equal(t, http.StatusOK, do("DELETE", "", "automation"))
+
+	assert.Equal(t, http.StatusOK, do("OPTIONS", "", ""), "CORS preflight doesn't carry credentials")
+}
+
+func TestParseScope(t *testing.T) {
+	scope, err := ParseScope("Read")
+	assert.NoError(t, err)
+	assert.Equal(t, ScopeRead, scope)
+	scope, err = ParseScope("write")
+	assert.NoError(t, err)
+	assert.Equal(t, ScopeWrite, scope)
+	_, err = ParseScope("admin")
+	assert.Error(t, err)
+}
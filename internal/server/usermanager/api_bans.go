@@ -0,0 +1,55 @@
+package usermanager
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	gmux "github.com/gorilla/mux"
+)
+
+var ErrBanNotFound = errors.New("Subnet is not banned")
+
+// Ban is a subnet banned for failing authentication too many times
+type Ban struct {
+	// Subnet is in CIDR notation
+	Subnet   string
+	Failures int
+	// Until is the unix time the ban is lifted at
+	Until int64
+}
+
+// BanPanel gives the admin API access to the subnets banned by the server. An ActiveUserPanel can implement it as well
+type BanPanel interface {
+	ListBans() []Ban
+	// ClearBan lifts the ban on a subnet. It returns ErrBanNotFound if the subnet isn't banned
+	ClearBan(subnet string) error
+	ClearBans()
+}
+
+func (ar *APIRouter) listBansHlr(w http.ResponseWriter, r *http.Request) {
+	resp, err := json.Marshal(ar.bans.ListBans())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, _ = w.Write(resp)
+}
+
+func (ar *APIRouter) clearBanHlr(w http.ResponseWriter, r *http.Request) {
+	err := ar.bans.ClearBan(gmux.Vars(r)["Subnet"])
+	if err == ErrBanNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (ar *APIRouter) clearBansHlr(w http.ResponseWriter, r *http.Request) {
+	ar.bans.ClearBans()
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,63 @@
+package usermanager
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type mockBanPanel struct {
+	mockPanel
+	bans []Ban
+}
+
+func (p *mockBanPanel) ListBans() []Ban {
+	return p.bans
+}
+
+func (p *mockBanPanel) ClearBan(subnet string) error {
+	for i, ban := range p.bans {
+		if ban.Subnet == subnet {
+			p.bans = append(p.bans[:i], p.bans[i+1:]...)
+			return nil
+		}
+	}
+	return ErrBanNotFound
+}
+
+func (p *mockBanPanel) ClearBans() {
+	p.bans = nil
+}
+
+func TestBanHlrs(t *testing.T) {
+	panel := &mockBanPanel{bans: []Ban{
+		{Subnet: "192.0.2.0/24", Failures: 5, Until: 1000},
+		{Subnet: "2001:db8::/64", Failures: 7, Until: 2000},
+	}}
+	router := APIRouterOf(nil, panel)
+	serve := func(method, target string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest(method, target, nil))
+		return rr
+	}
+
+	rr := serve("GET", "/admin/bans")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.JSONEq(t, `[{"Subnet":"192.0.2.0/24","Failures":5,"Until":1000},{"Subnet":"2001:db8::/64","Failures":7,"Until":2000}]`,
+		rr.Body.String())
+
+	assert.Equal(t, http.StatusOK, serve("DELETE", "/admin/bans/192.0.2.0/24").Code)
+	assert.Equal(t, http.StatusNotFound, serve("DELETE", "/admin/bans/192.0.2.0/24").Code)
+	assert.Len(t, panel.bans, 1)
+	assert.Equal(t, http.StatusOK, serve("DELETE", "/admin/bans").Code)
+	assert.Empty(t, panel.bans)
+
+	t.Run("not served without a BanPanel", func(t *testing.T) {
+		router := APIRouterOf(nil, &mockPanel{})
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("GET", "/admin/bans", nil))
+		assert.NotEqual(t, http.StatusOK, rr.Code)
+	})
+}
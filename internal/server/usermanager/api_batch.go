@@ -0,0 +1,258 @@
+package usermanager
+
+import (
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+)
+
+const (
+	ndjsonContentType = "application/x-ndjson"
+	csvContentType    = "text/csv"
+)
+
+// maxBatchSize is the largest body /admin/users:batch reads, as the whole batch is held in memory to be written in
+// one transaction. It fits a few hundred thousand users
+var maxBatchSize int64 = 32 << 20
+
+// csvColumns are the columns of an exported CSV. An imported CSV can have them in any order, and can leave any of
+// them out except for UID. UIDs are in standard base64, same as in JSON. AllowedProxyMethods and ProxyEndpoints
+// can't be expressed in CSV, so they are only carried by NDJSON. An empty Plan leaves the plan unchanged, so taking a
+// user off its plan also needs NDJSON
+var csvColumns = []string{"UID", "SessionsCap", "UpRate", "DownRate", "UpCredit", "DownCredit", "ExpiryTime",
+	"TotalCredit", "Plan", "NextResetTime", "FallbackUpRate", "FallbackDownRate"}
+
+// clearable are the columns that can be null
+var clearable = map[string]bool{"TotalCredit": true, "FallbackUpRate": true, "FallbackDownRate": true}
+
+// decodeNDJSON reads one UserInfo in JSON per line
+func decodeNDJSON(r io.Reader) ([]UserInfo, error) {
+	var infos []UserInfo
+	dec := json.NewDecoder(r)
+	for i := 1; ; i++ {
+		var raw json.RawMessage
+		err := dec.Decode(&raw)
+		if err == io.EOF {
+			return infos, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("record %v: %w", i, err)
+		}
+		uinfo, err := decodeUserInfo(raw)
+		if err != nil {
+			return nil, fmt.Errorf("record %v: %w", i, err)
+		}
+		if err := uinfo.validate(); err != nil {
+			return nil, fmt.Errorf("record %v: %w", i, err)
+		}
+		infos = append(infos, uinfo)
+	}
+}
+
+// decodeCSV reads a CSV with a header row naming the columns. An empty field is left nil, so that a row can update
+// only some fields of an existing user, and a field of null removes it from the user like a JSON null does
+func decodeCSV(r io.Reader) ([]UserInfo, error) {
+	reader := csv.NewReader(r)
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read header: %w", err)
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		known := false
+		for _, c := range csvColumns {
+			known = known || c == name
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown column %v", name)
+		}
+		columns[name] = i
+	}
+	if _, ok := columns["UID"]; !ok {
+		return nil, errors.New("missing UID column")
+	}
+
+	var infos []UserInfo
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return infos, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		var uinfo UserInfo
+		uinfo.UID, err = base64.StdEncoding.DecodeString(record[columns["UID"]])
+		if err != nil || len(uinfo.UID) == 0 {
+			return nil, fmt.Errorf("line %v: invalid UID", line)
+		}
+		parseField := func(name string, bitSize int) (*int64, error) {
+			i, ok := columns[name]
+			if !ok || record[i] == "" {
+				return nil, nil
+			}
+			if record[i] == "null" && clearable[name] {
+				return JustInt64(Cleared), nil
+			}
+			v, err := strconv.ParseInt(record[i], 10, bitSize)
+			if err != nil {
+				return nil, fmt.Errorf("line %v: invalid %v: %w", line, name, err)
+			}
+			return &v, nil
+		}
+		sessionsCap, err := parseField("SessionsCap", 32)
+		if err != nil {
+			return nil, err
+		}
+		if sessionsCap != nil {
+			uinfo.SessionsCap = JustInt32(int32(*sessionsCap))
+		}
+		for _, f := range []struct {
+			name  string
+			field *MaybeInt64
+		}{
+			{"UpRate", &uinfo.UpRate},
+			{"DownRate", &uinfo.DownRate},
+			{"UpCredit", &uinfo.UpCredit},
+			{"DownCredit", &uinfo.DownCredit},
+			{"ExpiryTime", &uinfo.ExpiryTime},
+			{"TotalCredit", &uinfo.TotalCredit},
+			{"NextResetTime", &uinfo.NextResetTime},
+			{"FallbackUpRate", &uinfo.FallbackUpRate},
+			{"FallbackDownRate", &uinfo.FallbackDownRate},
+		} {
+			v, err := parseField(f.name, 64)
+			if err != nil {
+				return nil, err
+			}
+			*f.field = v
+		}
+		if i, ok := columns["Plan"]; ok && record[i] != "" {
+			uinfo.Plan = JustString(record[i])
+		}
+		infos = append(infos, uinfo)
+	}
+}
+
+func formatMaybeInt32(v MaybeInt32) string {
+	if v == nil {
+		return ""
+	}
+	return strconv.FormatInt(int64(*v), 10)
+}
+
+func formatMaybeInt64(v MaybeInt64) string {
+	if v == nil {
+		return ""
+	}
+	return strconv.FormatInt(*v, 10)
+}
+
+func formatMaybeString(v MaybeString) string {
+	if v == nil {
+		return ""
+	}
+	return *v
+}
+
+func csvRecordOf(uinfo UserInfo) []string {
+	return []string{
+		base64.StdEncoding.EncodeToString(uinfo.UID),
+		formatMaybeInt32(uinfo.SessionsCap),
+		formatMaybeInt64(uinfo.UpRate),
+		formatMaybeInt64(uinfo.DownRate),
+		formatMaybeInt64(uinfo.UpCredit),
+		formatMaybeInt64(uinfo.DownCredit),
+		formatMaybeInt64(uinfo.ExpiryTime),
+		formatMaybeInt64(uinfo.TotalCredit),
+		formatMaybeString(uinfo.Plan),
+		formatMaybeInt64(uinfo.NextResetTime),
+		formatMaybeInt64(uinfo.FallbackUpRate),
+		formatMaybeInt64(uinfo.FallbackDownRate),
+	}
+}
+
+// batchWriteUsersHlr writes all the users in the request body, in NDJSON or CSV depending on its Content-Type. If any
+// of them is invalid or fails to be written, none is written
+func (ar *APIRouter) batchWriteUsersHlr(w http.ResponseWriter, r *http.Request) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	body := http.MaxBytesReader(w, r.Body, maxBatchSize)
+	var infos []UserInfo
+	var err error
+	switch mediaType {
+	case ndjsonContentType, "application/jsonl", "application/json":
+		infos, err = decodeNDJSON(body)
+	case csvContentType:
+		infos, err = decodeCSV(body)
+	default:
+		http.Error(w, "Content-Type must be "+ndjsonContentType+" or "+csvContentType, http.StatusUnsupportedMediaType)
+		return
+	}
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, fmt.Sprintf("batch is larger than %v bytes, split it up", tooLarge.Limit),
+			http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = ar.manager.WriteUserInfos(infos)
+	if err == ErrPlanNotFound {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, uinfo := range infos {
+		ar.refreshUser(uinfo.UID)
+	}
+	resp, _ := json.Marshal(struct{ Written int }{len(infos)})
+	_, _ = w.Write(resp)
+}
+
+// exportUsersHlr writes out all users as NDJSON, or as CSV if the format query parameter is csv. The users are all
+// read into memory through ListAllUsers before any is written, the same as /admin/users does
+func (ar *APIRouter) exportUsersHlr(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "ndjson" && format != "csv" {
+		http.Error(w, "unknown format "+format, http.StatusBadRequest)
+		return
+	}
+	infos, err := ar.manager.ListAllUsers()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	switch format {
+	case "", "ndjson":
+		w.Header().Set("Content-Type", ndjsonContentType)
+		enc := json.NewEncoder(w)
+		for _, uinfo := range infos {
+			if err := enc.Encode(uinfo); err != nil {
+				return
+			}
+		}
+	case "csv":
+		w.Header().Set("Content-Type", csvContentType)
+		cw := csv.NewWriter(w)
+		_ = cw.Write(csvColumns)
+		for _, uinfo := range infos {
+			if err := cw.Write(csvRecordOf(uinfo)); err != nil {
+				return
+			}
+		}
+		cw.Flush()
+	}
+}
@@ -0,0 +1,148 @@
+package usermanager
+
+import (
+	"bufio"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var mockUIDStdb64 = base64.StdEncoding.EncodeToString(mockUID)
+
+func TestBatchWriteUsersHlr(t *testing.T) {
+	router, cleaner := makeRouter(t)
+	defer cleaner()
+
+	post := func(contentType string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/admin/users:batch", strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	t.Run("ndjson", func(t *testing.T) {
+		rr := post("application/x-ndjson", `{"UID":"`+mockUIDStdb64+`","SessionsCap":10,"UpCredit":5}
+{"UID":"AAAAAAAAAAAAAAAAAAAAAA==","DownCredit":6}
+`)
+		assert.Equalf(t, http.StatusOK, rr.Code, "response body: %v", rr.Body)
+		assert.JSONEq(t, `{"Written":2}`, rr.Body.String())
+
+		got, err := router.manager.GetUserInfo(mockUID)
+		assert.NoError(t, err)
+		assert.EqualValues(t, 10, *got.SessionsCap)
+		assert.EqualValues(t, 5, *got.UpCredit)
+	})
+
+	t.Run("csv", func(t *testing.T) {
+		rr := post("text/csv; charset=utf-8", "UID,UpCredit,ExpiryTime,TotalCredit,FallbackUpRate\n"+mockUIDStdb64+",7,,70,3\n")
+		assert.Equalf(t, http.StatusOK, rr.Code, "response body: %v", rr.Body)
+
+		got, err := router.manager.GetUserInfo(mockUID)
+		assert.NoError(t, err)
+		assert.EqualValues(t, 7, *got.UpCredit)
+		assert.EqualValues(t, 70, *got.TotalCredit)
+		assert.EqualValues(t, 3, *got.FallbackUpRate)
+		assert.EqualValues(t, 10, *got.SessionsCap, "columns left out shouldn't be changed")
+	})
+
+	t.Run("clear TotalCredit", func(t *testing.T) {
+		rr := post("text/csv", "UID,TotalCredit\n"+mockUIDStdb64+",null\n")
+		assert.Equalf(t, http.StatusOK, rr.Code, "response body: %v", rr.Body)
+		got, err := router.manager.GetUserInfo(mockUID)
+		assert.NoError(t, err)
+		assert.Nil(t, got.TotalCredit)
+		assert.EqualValues(t, 7, *got.UpCredit)
+
+		rr = post("text/csv", "UID,UpCredit\n"+mockUIDStdb64+",null\n")
+		assert.Equal(t, http.StatusBadRequest, rr.Code, "only removable fields can be null")
+	})
+
+	t.Run("bad record", func(t *testing.T) {
+		rr := post("text/csv", "UID,UpCredit\n"+mockUIDStdb64+",8\n"+mockUIDStdb64+",eight\n")
+		assert.Equal(t, http.StatusBadRequest, rr.Code)
+		assert.Contains(t, rr.Body.String(), "line 3")
+
+		got, err := router.manager.GetUserInfo(mockUID)
+		assert.NoError(t, err)
+		assert.EqualValues(t, 7, *got.UpCredit, "nothing should be written from a bad batch")
+	})
+
+	t.Run("too large", func(t *testing.T) {
+		defer func(size int64) { maxBatchSize = size }(maxBatchSize)
+		maxBatchSize = 64
+		rr := post("text/csv", "UID,UpCredit\n"+mockUIDStdb64+",9\n"+mockUIDStdb64+",9\n"+mockUIDStdb64+",9\n")
+		assert.Equal(t, http.StatusRequestEntityTooLarge, rr.Code)
+		rr = post("application/x-ndjson", strings.Repeat(`{"UID":"`+mockUIDStdb64+`","UpCredit":9}`+"\n", 3))
+		assert.Equal(t, http.StatusRequestEntityTooLarge, rr.Code)
+
+		got, err := router.manager.GetUserInfo(mockUID)
+		assert.NoError(t, err)
+		assert.EqualValues(t, 7, *got.UpCredit, "nothing should be written from a batch that's too large")
+	})
+
+	t.Run("unsupported content type", func(t *testing.T) {
+		rr := post("application/xml", "")
+		assert.Equal(t, http.StatusUnsupportedMediaType, rr.Code)
+	})
+}
+
+func TestExportUsersHlr(t *testing.T) {
+	router, cleaner := makeRouter(t)
+	defer cleaner()
+	other := mockUserInfo
+	other.UID = make([]byte, 16)
+	other.TotalCredit = JustInt64(50000)
+	other.FallbackUpRate = JustInt64(10)
+	other.FallbackDownRate = JustInt64(20)
+	_ = router.manager.WritePlan(mockPlan)
+	planned := mockUserInfo
+	planned.UID = []byte{15: 1}
+	planned.Plan = JustString(mockPlan.Name)
+	_ = router.manager.WriteUserInfos([]UserInfo{mockUserInfo, other, planned})
+	stored, _ := router.manager.ListAllUsers()
+	if assert.Len(t, stored, 3) {
+		assert.NotNil(t, stored[1].NextResetTime, "the user on a plan should have a reset time to round trip")
+	}
+
+	get := func(url string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", url, nil)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	t.Run("ndjson", func(t *testing.T) {
+		rr := get("/admin/users:export")
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.Equal(t, ndjsonContentType, rr.Header().Get("Content-Type"))
+		infos, err := decodeNDJSON(rr.Body)
+		assert.NoError(t, err)
+		// a TotalCredit or fallback rate the user doesn't have is exported as null, which removes it when imported
+		want := append([]UserInfo{}, stored...)
+		for i := range want {
+			for _, field := range []*MaybeInt64{&want[i].TotalCredit, &want[i].FallbackUpRate, &want[i].FallbackDownRate} {
+				if *field == nil {
+					*field = JustInt64(Cleared)
+				}
+			}
+		}
+		assert.EqualValues(t, want, infos)
+	})
+
+	t.Run("csv round trip", func(t *testing.T) {
+		rr := get("/admin/users:export?format=csv")
+		assert.Equal(t, http.StatusOK, rr.Code)
+		body := rr.Body.String()
+		header, _ := bufio.NewReader(strings.NewReader(body)).ReadString('\n')
+		assert.Equal(t, strings.Join(csvColumns, ",")+"\n", header)
+
+		infos, err := decodeCSV(strings.NewReader(body))
+		assert.NoError(t, err)
+		assert.EqualValues(t, stored, infos)
+	})
+}
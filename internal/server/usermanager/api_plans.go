@@ -0,0 +1,77 @@
+package usermanager
+
+import (
+	"encoding/json"
+	"net/http"
+
+	gmux "github.com/gorilla/mux"
+)
+
+func (ar *APIRouter) listPlansHlr(w http.ResponseWriter, r *http.Request) {
+	plans, err := ar.manager.ListPlans()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	resp, err := json.Marshal(plans)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, _ = w.Write(resp)
+}
+
+func (ar *APIRouter) getPlanHlr(w http.ResponseWriter, r *http.Request) {
+	plan, err := ar.manager.GetPlan(gmux.Vars(r)["Name"])
+	if err == ErrPlanNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	resp, err := json.Marshal(plan)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, _ = w.Write(resp)
+}
+
+func (ar *APIRouter) writePlanHlr(w http.ResponseWriter, r *http.Request) {
+	var plan Plan
+	err := json.NewDecoder(r.Body).Decode(&plan)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if plan.Name != gmux.Vars(r)["Name"] {
+		http.Error(w, "Name mismatch", http.StatusBadRequest)
+		return
+	}
+	if err := plan.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = ar.manager.WritePlan(plan)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (ar *APIRouter) deletePlanHlr(w http.ResponseWriter, r *http.Request) {
+	err := ar.manager.DeletePlan(gmux.Vars(r)["Name"])
+	if err == ErrPlanNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,47 @@
+package usermanager
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPlanHlrs(t *testing.T) {
+	router, cleaner := makeRouter(t)
+	defer cleaner()
+	serve := func(method, target string, body []byte) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest(method, target, bytes.NewReader(body)))
+		return rr
+	}
+
+	marshalled, _ := json.Marshal(mockPlan)
+	assert.Equal(t, http.StatusBadRequest, serve("POST", "/admin/plans/other", marshalled).Code)
+	invalid, _ := json.Marshal(Plan{Name: "basic", ResetPeriod: "yearly"})
+	assert.Equal(t, http.StatusBadRequest, serve("POST", "/admin/plans/basic", invalid).Code)
+	assert.Equal(t, http.StatusCreated, serve("POST", "/admin/plans/basic", marshalled).Code)
+
+	rr := serve("GET", "/admin/plans/basic", nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var got Plan
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &got))
+	assert.Equal(t, mockPlan, got)
+
+	rr = serve("GET", "/admin/plans", nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var plans []Plan
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &plans))
+	assert.Equal(t, []Plan{mockPlan}, plans)
+
+	uinfo, _ := json.Marshal(UserInfo{UID: mockUID, Plan: JustString("premium")})
+	assert.Equal(t, http.StatusBadRequest, serve("POST", "/admin/users/"+mockUIDb64, uinfo).Code,
+		"assigning a plan that doesn't exist")
+
+	assert.Equal(t, http.StatusOK, serve("DELETE", "/admin/plans/basic", nil).Code)
+	assert.Equal(t, http.StatusNotFound, serve("DELETE", "/admin/plans/basic", nil).Code)
+	assert.Equal(t, http.StatusNotFound, serve("GET", "/admin/plans/basic", nil).Code)
+}
@@ -0,0 +1,32 @@
+package usermanager
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// RedirectStats counts the connections from visitors that aren't Cloak clients, which are forwarded to redirection
+// targets
+type RedirectStats struct {
+	// Total is the number of connections redirected since start, including rejected ones
+	Total uint64
+	// Rejected is the number of connections dropped for going over RedirLimits
+	Rejected uint64
+	// Active is the number of redirected connections open right now
+	Active int
+}
+
+// RedirectPanel gives the admin API the redirection counters of the server. An ActiveUserPanel can implement it as
+// well
+type RedirectPanel interface {
+	RedirectStats() RedirectStats
+}
+
+func (ar *APIRouter) redirectStatsHlr(w http.ResponseWriter, r *http.Request) {
+	resp, err := json.Marshal(ar.redirects.RedirectStats())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, _ = w.Write(resp)
+}
@@ -0,0 +1,33 @@
+package usermanager
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type mockRedirectPanel struct {
+	mockPanel
+	stats RedirectStats
+}
+
+func (p *mockRedirectPanel) RedirectStats() RedirectStats {
+	return p.stats
+}
+
+func TestRedirectStatsHlr(t *testing.T) {
+	router := APIRouterOf(nil, &mockRedirectPanel{stats: RedirectStats{Total: 10, Rejected: 3, Active: 2}})
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/admin/redirects", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.JSONEq(t, `{"Total":10,"Rejected":3,"Active":2}`, rr.Body.String())
+
+	t.Run("not served without a RedirectPanel", func(t *testing.T) {
+		router := APIRouterOf(nil, &mockPanel{})
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("GET", "/admin/redirects", nil))
+		assert.NotEqual(t, http.StatusOK, rr.Code)
+	})
+}
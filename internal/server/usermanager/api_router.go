@@ -11,13 +11,22 @@ import (
 
 type APIRouter struct {
 	*gmux.Router
-	manager UserManager
+	manager   UserManager
+	panel     ActiveUserPanel
+	bans      BanPanel
+	redirects RedirectPanel
 }
 
-func APIRouterOf(manager UserManager) *APIRouter {
+// APIRouterOf makes the router of the admin API. The routes about active users are only served if panel isn't nil,
+// the routes about bans only if panel implements BanPanel, and the route about redirections only if it implements
+// RedirectPanel
+func APIRouterOf(manager UserManager, panel ActiveUserPanel) *APIRouter {
 	ret := &APIRouter{
 		manager: manager,
+		panel:   panel,
 	}
+	ret.bans, _ = panel.(BanPanel)
+	ret.redirects, _ = panel.(RedirectPanel)
 	ret.registerMux()
 	return ret
 }
@@ -32,9 +41,29 @@ func corsMiddleware(next http.Handler) http.Handler {
 func (ar *APIRouter) registerMux() {
 	ar.Router = gmux.NewRouter()
 	ar.HandleFunc("/admin/users", ar.listAllUsersHlr).Methods("GET")
+	ar.HandleFunc("/admin/users:batch", ar.batchWriteUsersHlr).Methods("POST")
+	ar.HandleFunc("/admin/users:export", ar.exportUsersHlr).Methods("GET")
 	ar.HandleFunc("/admin/users/{UID}", ar.getUserInfoHlr).Methods("GET")
 	ar.HandleFunc("/admin/users/{UID}", ar.writeUserInfoHlr).Methods("POST")
 	ar.HandleFunc("/admin/users/{UID}", ar.deleteUserHlr).Methods("DELETE")
+	ar.HandleFunc("/admin/plans", ar.listPlansHlr).Methods("GET")
+	ar.HandleFunc("/admin/plans/{Name}", ar.getPlanHlr).Methods("GET")
+	ar.HandleFunc("/admin/plans/{Name}", ar.writePlanHlr).Methods("POST")
+	ar.HandleFunc("/admin/plans/{Name}", ar.deletePlanHlr).Methods("DELETE")
+	if ar.panel != nil {
+		ar.HandleFunc("/admin/active", ar.listActiveUsersHlr).Methods("GET")
+		ar.HandleFunc("/admin/active/{UID}", ar.getActiveUserHlr).Methods("GET")
+		ar.HandleFunc("/admin/active/{UID}", ar.terminateActiveUserHlr).Methods("DELETE")
+		ar.HandleFunc("/admin/active/{UID}/sessions/{SessionID}", ar.closeSessionHlr).Methods("DELETE")
+	}
+	if ar.bans != nil {
+		ar.HandleFunc("/admin/bans", ar.listBansHlr).Methods("GET")
+		ar.HandleFunc("/admin/bans", ar.clearBansHlr).Methods("DELETE")
+		ar.HandleFunc("/admin/bans/{Subnet:.+}", ar.clearBanHlr).Methods("DELETE")
+	}
+	if ar.redirects != nil {
+		ar.HandleFunc("/admin/redirects", ar.redirectStatsHlr).Methods("GET")
+	}
 	ar.Methods("OPTIONS").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Methods", "GET,POST,DELETE,OPTIONS")
 	})
@@ -80,6 +109,32 @@ func (ar *APIRouter) getUserInfoHlr(w http.ResponseWriter, r *http.Request) {
 	_, _ = w.Write(resp)
 }
 
+// decodeUserInfo decodes a UserInfo written to the API. Fields written as null, which are otherwise the same as left
+// out, are set to Cleared if they can be removed
+func decodeUserInfo(data []byte) (UserInfo, error) {
+	var uinfo UserInfo
+	if err := json.Unmarshal(data, &uinfo); err != nil {
+		return UserInfo{}, err
+	}
+	var nulls struct {
+		TotalCredit, FallbackUpRate, FallbackDownRate json.RawMessage
+	}
+	_ = json.Unmarshal(data, &nulls)
+	for _, f := range []struct {
+		raw   json.RawMessage
+		field *MaybeInt64
+	}{
+		{nulls.TotalCredit, &uinfo.TotalCredit},
+		{nulls.FallbackUpRate, &uinfo.FallbackUpRate},
+		{nulls.FallbackDownRate, &uinfo.FallbackDownRate},
+	} {
+		if string(f.raw) == "null" {
+			*f.field = JustInt64(Cleared)
+		}
+	}
+	return uinfo, nil
+}
+
 func (ar *APIRouter) writeUserInfoHlr(w http.ResponseWriter, r *http.Request) {
 	b64UID := gmux.Vars(r)["UID"]
 	if b64UID == "" {
@@ -92,20 +147,36 @@ func (ar *APIRouter) writeUserInfoHlr(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var uinfo UserInfo
-	err = json.NewDecoder(r.Body).Decode(&uinfo)
+	var raw json.RawMessage
+	err = json.NewDecoder(r.Body).Decode(&raw)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	uinfo, err := decodeUserInfo(raw)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 	if !bytes.Equal(UID, uinfo.UID) {
 		http.Error(w, "UID mismatch", http.StatusBadRequest)
+		return
+	}
+	if err := uinfo.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
 	err = ar.manager.WriteUserInfo(uinfo)
+	if err == ErrPlanNotFound {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
+	ar.refreshUser(UID)
 	w.WriteHeader(http.StatusCreated)
 }
 
@@ -124,6 +195,8 @@ func (ar *APIRouter) deleteUserHlr(w http.ResponseWriter, r *http.Request) {
 	err = ar.manager.DeleteUser(UID)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
+	ar.refreshUser(UID)
 	w.WriteHeader(http.StatusOK)
 }
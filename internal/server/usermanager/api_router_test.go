@@ -22,7 +22,7 @@ func makeRouter(t *testing.T) (router *APIRouter, cleaner func()) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	router = APIRouterOf(mgr)
+	router = APIRouterOf(mgr, nil)
 	return router, cleaner
 }
 
@@ -77,6 +77,50 @@ func TestWriteUserInfoHlr(t *testing.T) {
 		assert.EqualValues(t, expected, got)
 	})
 
+	t.Run("clear TotalCredit", func(t *testing.T) {
+		post := func(body string) {
+			req, err := http.NewRequest("POST", "/admin/users/"+mockUIDb64, bytes.NewBufferString(body))
+			assert.NoError(t, err)
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+			assert.Equalf(t, http.StatusCreated, rr.Code, "response body: %v", rr.Body)
+		}
+		uid, _ := json.Marshal(mockUID)
+		post(`{"UID":` + string(uid) + `,"TotalCredit":100}`)
+		got, err := router.manager.GetUserInfo(mockUID)
+		assert.NoError(t, err)
+		assert.EqualValues(t, 100, *got.TotalCredit)
+
+		post(`{"UID":` + string(uid) + `,"SessionsCap":3}`)
+		got, _ = router.manager.GetUserInfo(mockUID)
+		assert.EqualValues(t, 100, *got.TotalCredit, "TotalCredit left out should be kept")
+
+		post(`{"UID":` + string(uid) + `,"TotalCredit":null}`)
+		got, _ = router.manager.GetUserInfo(mockUID)
+		assert.Nil(t, got.TotalCredit)
+		assert.EqualValues(t, 3, *got.SessionsCap)
+	})
+
+	t.Run("clear fallback rates", func(t *testing.T) {
+		post := func(body string) {
+			req, err := http.NewRequest("POST", "/admin/users/"+mockUIDb64, bytes.NewBufferString(body))
+			assert.NoError(t, err)
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+			assert.Equalf(t, http.StatusCreated, rr.Code, "response body: %v", rr.Body)
+		}
+		uid, _ := json.Marshal(mockUID)
+		post(`{"UID":` + string(uid) + `,"FallbackUpRate":5,"FallbackDownRate":50}`)
+		got, err := router.manager.GetUserInfo(mockUID)
+		assert.NoError(t, err)
+		assert.EqualValues(t, 5, *got.FallbackUpRate)
+
+		post(`{"UID":` + string(uid) + `,"FallbackUpRate":null,"FallbackDownRate":null}`)
+		got, _ = router.manager.GetUserInfo(mockUID)
+		assert.Nil(t, got.FallbackUpRate)
+		assert.Nil(t, got.FallbackDownRate)
+	})
+
 	t.Run("empty parameter", func(t *testing.T) {
 		req, err := http.NewRequest("POST", "/admin/users/", bytes.NewBuffer(marshalled))
 		if err != nil {
@@ -212,3 +256,18 @@ func TestListAllUsersHlr(t *testing.T) {
 	}
 	assert.True(t, assert.Subset(t, got, expected), assert.Subset(t, expected, got))
 }
+
+func TestWriteUserInfoHlr_InvalidProxyEndpoints(t *testing.T) {
+	router, cleaner := makeRouter(t)
+	defer cleaner()
+
+	uinfo := mockUserInfo
+	uinfo.ProxyEndpoints = map[string][]string{"tenant-a": {"sctp", "10.0.0.2:8388"}}
+	marshalled, _ := json.Marshal(uinfo)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("POST", "/admin/users/"+mockUIDb64, bytes.NewReader(marshalled)))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	_, err := router.manager.GetUserInfo(mockUID)
+	assert.Equal(t, ErrUserNotFound, err)
+}
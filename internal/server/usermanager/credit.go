@@ -0,0 +1,102 @@
+package usermanager
+
+import "strings"
+
+func valueOf(v MaybeInt64) int64 {
+	if v == nil {
+		return 0
+	}
+	return *v
+}
+
+// hasFallback tells whether the user is throttled rather than cut off when it runs out of credit
+func hasFallback(uinfo UserInfo) bool {
+	return valueOf(uinfo.FallbackUpRate) > 0 && valueOf(uinfo.FallbackDownRate) > 0
+}
+
+// exhaustedCredits returns the errors for the credits the user has used up. A user with a TotalCredit only has that
+// checked
+func exhaustedCredits(uinfo UserInfo) []error {
+	if uinfo.TotalCredit != nil {
+		if *uinfo.TotalCredit <= 0 {
+			return []error{ErrNoCredit}
+		}
+		return nil
+	}
+	var exhausted []error
+	if valueOf(uinfo.UpCredit) <= 0 {
+		exhausted = append(exhausted, ErrNoUpCredit)
+	}
+	if valueOf(uinfo.DownCredit) <= 0 {
+		exhausted = append(exhausted, ErrNoDownCredit)
+	}
+	return exhausted
+}
+
+// authenticate returns the rates a user should have if it's allowed to connect at now. A user out of credit gets its
+// fallback rates if it has them
+func authenticate(uinfo UserInfo, now int64) (upRate, downRate int64, err error) {
+	var creditErr error
+	if exhausted := exhaustedCredits(uinfo); len(exhausted) != 0 {
+		creditErr = exhausted[0]
+	}
+	if creditErr != nil && !hasFallback(uinfo) {
+		return 0, 0, creditErr
+	}
+	if valueOf(uinfo.ExpiryTime) < now {
+		return 0, 0, ErrUserExpired
+	}
+	if creditErr != nil {
+		return *uinfo.FallbackUpRate, *uinfo.FallbackDownRate, nil
+	}
+	return valueOf(uinfo.UpRate), valueOf(uinfo.DownRate), nil
+}
+
+// statusResponsesOf works out what needs to be done with a user given its UserInfo after a status upload. plan is nil
+// if the user doesn't have one
+func statusResponsesOf(uinfo UserInfo, now int64, plan *Plan) []StatusResponse {
+	var exhausted []string
+	for _, err := range exhaustedCredits(uinfo) {
+		exhausted = append(exhausted, err.Error())
+	}
+	expired := now > valueOf(uinfo.ExpiryTime)
+
+	if len(exhausted) != 0 && !expired && hasFallback(uinfo) {
+		return []StatusResponse{{
+			UID:      uinfo.UID,
+			Action:   THROTTLE,
+			Message:  strings.Join(exhausted, ", "),
+			UpRate:   *uinfo.FallbackUpRate,
+			DownRate: *uinfo.FallbackDownRate,
+		}}
+	}
+
+	var responses []StatusResponse
+	for _, message := range exhausted {
+		responses = append(responses, StatusResponse{UID: uinfo.UID, Action: TERMINATE, Message: message})
+	}
+	if expired {
+		responses = append(responses, StatusResponse{UID: uinfo.UID, Action: TERMINATE, Message: "User has expired"})
+	}
+	if len(responses) != 0 || plan == nil {
+		return responses
+	}
+
+	switch {
+	case plan.below(uinfo, plan.ThrottleBelow):
+		responses = append(responses, StatusResponse{
+			UID:      uinfo.UID,
+			Action:   THROTTLE,
+			Message:  "Quota nearly exhausted",
+			UpRate:   plan.ThrottleUpRate,
+			DownRate: plan.ThrottleDownRate,
+		})
+	case plan.below(uinfo, plan.WarnBelow):
+		responses = append(responses, StatusResponse{
+			UID:     uinfo.UID,
+			Action:  WARN,
+			Message: "Quota nearly exhausted",
+		})
+	}
+	return responses
+}
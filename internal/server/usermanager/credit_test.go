@@ -0,0 +1,209 @@
+package usermanager
+
+import (
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func creditOf(upCredit, downCredit, expiryTime int64) UserInfo {
+	return UserInfo{
+		UID:         mockUID,
+		SessionsCap: JustInt32(1),
+		UpRate:      JustInt64(1000),
+		DownRate:    JustInt64(10000),
+		UpCredit:    JustInt64(upCredit),
+		DownCredit:  JustInt64(downCredit),
+		ExpiryTime:  JustInt64(expiryTime),
+	}
+}
+
+func withFallback(uinfo UserInfo) UserInfo {
+	uinfo.FallbackUpRate = JustInt64(5)
+	uinfo.FallbackDownRate = JustInt64(50)
+	return uinfo
+}
+
+func TestAuthenticate(t *testing.T) {
+	upRate, downRate, err := authenticate(creditOf(1, 1, 10), 0)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 1000, upRate)
+	assert.EqualValues(t, 10000, downRate)
+
+	_, _, err = authenticate(creditOf(0, 1, 10), 0)
+	assert.Equal(t, ErrNoUpCredit, err)
+	_, _, err = authenticate(creditOf(1, 0, 10), 0)
+	assert.Equal(t, ErrNoDownCredit, err)
+	_, _, err = authenticate(creditOf(1, 1, 10), 20)
+	assert.Equal(t, ErrUserExpired, err)
+
+	upRate, downRate, err = authenticate(withFallback(creditOf(0, 1, 10)), 0)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 5, upRate)
+	assert.EqualValues(t, 50, downRate)
+	_, _, err = authenticate(withFallback(creditOf(0, 1, 10)), 20)
+	assert.Equal(t, ErrUserExpired, err, "fallback rates don't outlive the expiry time")
+}
+
+func TestAuthenticate_TotalCredit(t *testing.T) {
+	uinfo := creditOf(0, 0, 10)
+	uinfo.TotalCredit = JustInt64(1)
+	upRate, _, err := authenticate(uinfo, 0)
+	assert.NoError(t, err, "UpCredit and DownCredit aren't checked with a TotalCredit")
+	assert.EqualValues(t, 1000, upRate)
+
+	uinfo = creditOf(1, 1, 10)
+	uinfo.TotalCredit = JustInt64(0)
+	_, _, err = authenticate(uinfo, 0)
+	assert.Equal(t, ErrNoCredit, err)
+
+	upRate, _, err = authenticate(withFallback(uinfo), 0)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 5, upRate)
+}
+
+func TestStatusResponsesOf(t *testing.T) {
+	assert.Empty(t, statusResponsesOf(creditOf(500, 5000, 10), 0, &mockPlan))
+	assert.Empty(t, statusResponsesOf(creditOf(1, 1, 10), 0, nil))
+
+	resps := statusResponsesOf(creditOf(150, 5000, 10), 0, &mockPlan)
+	if assert.Len(t, resps, 1) {
+		assert.Equal(t, WARN, resps[0].Action)
+	}
+	resps = statusResponsesOf(creditOf(500, 500, 10), 0, &mockPlan)
+	if assert.Len(t, resps, 1) {
+		assert.Equal(t, THROTTLE, resps[0].Action)
+		assert.Equal(t, mockPlan.ThrottleUpRate, resps[0].UpRate)
+		assert.Equal(t, mockPlan.ThrottleDownRate, resps[0].DownRate)
+	}
+	resps = statusResponsesOf(creditOf(0, 500, 10), 20, &mockPlan)
+	if assert.Len(t, resps, 2) {
+		assert.Equal(t, TERMINATE, resps[0].Action)
+		assert.Equal(t, TERMINATE, resps[1].Action)
+	}
+
+	t.Run("total credit", func(t *testing.T) {
+		plan := mockPlan
+		plan.TotalCredit = 1000
+		uinfo := creditOf(0, 0, 10)
+		uinfo.TotalCredit = JustInt64(500)
+		assert.Empty(t, statusResponsesOf(uinfo, 0, &plan))
+
+		uinfo.TotalCredit = JustInt64(150)
+		resps := statusResponsesOf(uinfo, 0, &plan)
+		if assert.Len(t, resps, 1) {
+			assert.Equal(t, WARN, resps[0].Action)
+		}
+		uinfo.TotalCredit = JustInt64(0)
+		resps = statusResponsesOf(uinfo, 0, &plan)
+		if assert.Len(t, resps, 1) {
+			assert.Equal(t, StatusResponse{UID: mockUID, Action: TERMINATE, Message: ErrNoCredit.Error()}, resps[0])
+		}
+	})
+
+	t.Run("fallback", func(t *testing.T) {
+		resps := statusResponsesOf(withFallback(creditOf(0, 0, 10)), 0, &mockPlan)
+		if assert.Len(t, resps, 1) {
+			assert.Equal(t, StatusResponse{
+				UID:      mockUID,
+				Action:   THROTTLE,
+				Message:  "No upload credit left, No download credit left",
+				UpRate:   5,
+				DownRate: 50,
+			}, resps[0])
+		}
+		resps = statusResponsesOf(withFallback(creditOf(0, 10, 10)), 20, nil)
+		if assert.Len(t, resps, 2) {
+			assert.Equal(t, TERMINATE, resps[1].Action)
+			assert.Equal(t, "User has expired", resps[1].Message)
+		}
+	})
+}
+
+func testFallback(t *testing.T, makeManager func(world common.WorldState) UserManager) {
+	now := time.Unix(1000, 0)
+	mgr := makeManager(common.WorldState{Rand: rand.Reader, Now: func() time.Time { return now }})
+
+	assert.NoError(t, mgr.WriteUserInfo(withFallback(creditOf(100, 100, 2000))))
+	resps, err := mgr.UploadStatus([]StatusUpdate{{UID: mockUID, UpUsage: 100, Timestamp: now.Unix()}})
+	assert.NoError(t, err)
+	if assert.Len(t, resps, 1) {
+		assert.Equal(t, THROTTLE, resps[0].Action)
+		assert.EqualValues(t, 5, resps[0].UpRate)
+		assert.EqualValues(t, 50, resps[0].DownRate)
+	}
+
+	upRate, downRate, err := mgr.AuthenticateUser(mockUID)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 5, upRate)
+	assert.EqualValues(t, 50, downRate)
+	assert.NoError(t, mgr.AuthoriseNewSession(mockUID, AuthorisationInfo{NumExistingSessions: 0}))
+
+	now = time.Unix(3000, 0)
+	_, _, err = mgr.AuthenticateUser(mockUID)
+	assert.Equal(t, ErrUserExpired, err)
+
+	now = time.Unix(1000, 0)
+	assert.NoError(t, mgr.WriteUserInfo(UserInfo{UID: mockUID, FallbackUpRate: JustInt64(Cleared),
+		FallbackDownRate: JustInt64(Cleared)}))
+	got, err := mgr.GetUserInfo(mockUID)
+	assert.NoError(t, err)
+	assert.Nil(t, got.FallbackUpRate)
+	assert.Nil(t, got.FallbackDownRate)
+	_, _, err = mgr.AuthenticateUser(mockUID)
+	assert.Equal(t, ErrNoUpCredit, err, "a user without fallback rates is cut off again")
+}
+
+func testTotalCredit(t *testing.T, makeManager func(world common.WorldState) UserManager) {
+	now := time.Date(2024, 1, 15, 0, 0, 0, 0, time.UTC)
+	mgr := makeManager(common.WorldState{Rand: rand.Reader, Now: func() time.Time { return now }})
+
+	assert.NoError(t, mgr.WriteUserInfo(creditOf(100, 100, now.AddDate(1, 0, 0).Unix())))
+	got, err := mgr.GetUserInfo(mockUID)
+	assert.NoError(t, err)
+	assert.Nil(t, got.TotalCredit, "existing users don't get a TotalCredit")
+	resps, err := mgr.UploadStatus([]StatusUpdate{{UID: mockUID, UpUsage: 10, DownUsage: 20}})
+	assert.NoError(t, err)
+	assert.Empty(t, resps)
+	got, _ = mgr.GetUserInfo(mockUID)
+	assert.Nil(t, got.TotalCredit)
+	assert.EqualValues(t, 90, *got.UpCredit)
+
+	assert.NoError(t, mgr.WriteUserInfo(UserInfo{UID: mockUID, UpCredit: JustInt64(0), TotalCredit: JustInt64(100)}))
+	_, _, err = mgr.AuthenticateUser(mockUID)
+	assert.NoError(t, err)
+	assert.NoError(t, mgr.AuthoriseNewSession(mockUID, AuthorisationInfo{NumExistingSessions: 0}))
+
+	resps, err = mgr.UploadStatus([]StatusUpdate{{UID: mockUID, UpUsage: 30, DownUsage: 40}})
+	assert.NoError(t, err)
+	assert.Empty(t, resps)
+	got, _ = mgr.GetUserInfo(mockUID)
+	assert.EqualValues(t, 30, *got.TotalCredit, "both directions are taken from TotalCredit")
+
+	resps, _ = mgr.UploadStatus([]StatusUpdate{{UID: mockUID, DownUsage: 30}})
+	if assert.Len(t, resps, 1) {
+		assert.Equal(t, TERMINATE, resps[0].Action)
+		assert.Equal(t, ErrNoCredit.Error(), resps[0].Message)
+	}
+	_, _, err = mgr.AuthenticateUser(mockUID)
+	assert.Equal(t, ErrNoCredit, err)
+	assert.Equal(t, ErrNoCredit, mgr.AuthoriseNewSession(mockUID, AuthorisationInfo{NumExistingSessions: 0}))
+
+	plan := Plan{Name: "shared", TotalCredit: 500, ResetPeriod: ResetDaily}
+	assert.NoError(t, mgr.WritePlan(plan))
+	assert.NoError(t, mgr.WriteUserInfo(UserInfo{UID: mockUID, Plan: JustString("shared"), TotalCredit: JustInt64(0)}))
+	now = now.AddDate(0, 0, 1)
+	_, _, err = mgr.AuthenticateUser(mockUID)
+	assert.NoError(t, err)
+	got, _ = mgr.GetUserInfo(mockUID)
+	assert.EqualValues(t, 500, *got.TotalCredit, "TotalCredit is reset to the plan's quota")
+
+	assert.NoError(t, mgr.WriteUserInfo(UserInfo{UID: mockUID, Plan: JustString(""), TotalCredit: JustInt64(Cleared)}))
+	got, _ = mgr.GetUserInfo(mockUID)
+	assert.Nil(t, got.TotalCredit)
+	_, _, err = mgr.AuthenticateUser(mockUID)
+	assert.Equal(t, ErrNoUpCredit, err, "UpCredit is checked again once TotalCredit is removed")
+}
@@ -1,15 +1,62 @@
 package usermanager
 
 import (
+	"bytes"
 	"encoding/binary"
+	"encoding/json"
 
 	"github.com/cbeuw/Cloak/internal/common"
 	log "github.com/sirupsen/logrus"
 	bolt "go.etcd.io/bbolt"
 )
 
-var u32 = binary.BigEndian.Uint32
-var u64 = binary.BigEndian.Uint64
+// getU32 and getI64 read a field of a user bucket. A missing or malformed field reads as 0
+func getU32(bucket *bolt.Bucket, key string) uint32 {
+	b := bucket.Get([]byte(key))
+	if len(b) != 4 {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+// getMaybeI64 is getI64 for optional fields, returning nil if the field is missing
+func getMaybeI64(bucket *bolt.Bucket, key string) MaybeInt64 {
+	if bucket.Get([]byte(key)) == nil {
+		return nil
+	}
+	return JustInt64(getI64(bucket, key))
+}
+
+func getI64(bucket *bolt.Bucket, key string) int64 {
+	b := bucket.Get([]byte(key))
+	if len(b) != 8 {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(b))
+}
+
+// getJSON reads a field of a user bucket stored in JSON into v. A missing or malformed field leaves v unchanged
+func getJSON(bucket *bolt.Bucket, key string, v interface{}) {
+	b := bucket.Get([]byte(key))
+	if b == nil {
+		return
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		log.Errorf("malformed %v in user database: %v", key, err)
+	}
+}
+
+// putJSON stores v in JSON under key, or deletes key if v is empty
+func putJSON(bucket *bolt.Bucket, key string, v interface{}, empty bool) error {
+	if empty {
+		return bucket.Delete([]byte(key))
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(key), b)
+}
 
 func i64ToB(value int64) []byte {
 	oct := make([]byte, 8)
@@ -33,6 +80,10 @@ func MakeLocalManager(dbPath string, worldState common.WorldState) (*localManage
 	if err != nil {
 		return nil, err
 	}
+	if err = migrate(db); err != nil {
+		db.Close()
+		return nil, err
+	}
 	ret := &localManager{
 		db:    db,
 		world: worldState,
@@ -43,67 +94,25 @@ func MakeLocalManager(dbPath string, worldState common.WorldState) (*localManage
 // Authenticate user returns err==nil along with the users' up and down bandwidths if the UID is allowed to connect
 // More specifically it checks that the user exists, that it has positive credit and that it hasn't expired
 func (manager *localManager) AuthenticateUser(UID []byte) (int64, int64, error) {
-	var upRate, downRate, upCredit, downCredit, expiryTime int64
-	err := manager.db.View(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket(UID)
-		if bucket == nil {
-			return ErrUserNotFound
-		}
-		upRate = int64(u64(bucket.Get([]byte("UpRate"))))
-		downRate = int64(u64(bucket.Get([]byte("DownRate"))))
-		upCredit = int64(u64(bucket.Get([]byte("UpCredit"))))
-		downCredit = int64(u64(bucket.Get([]byte("DownCredit"))))
-		expiryTime = int64(u64(bucket.Get([]byte("ExpiryTime"))))
-		return nil
-	})
+	uinfo, err := manager.readUserResetting(UID)
 	if err != nil {
 		return 0, 0, err
 	}
-	if upCredit <= 0 {
-		return 0, 0, ErrNoUpCredit
-	}
-	if downCredit <= 0 {
-		return 0, 0, ErrNoDownCredit
-	}
-	if expiryTime < manager.world.Now().Unix() {
-		return 0, 0, ErrUserExpired
-	}
-
-	return upRate, downRate, nil
+	return authenticate(uinfo, manager.world.Now().Unix())
 }
 
 // AuthoriseNewSession returns err==nil when the user is allowed to make a new session
-// More specifically it checks that the user exists, has credit, hasn't expired and hasn't reached sessionsCap
+// More specifically it checks that the user exists, has credit or fallback rates, hasn't expired and hasn't reached
+// sessionsCap
 func (manager *localManager) AuthoriseNewSession(UID []byte, ainfo AuthorisationInfo) error {
-	var arrUID [16]byte
-	copy(arrUID[:], UID)
-	var sessionsCap int
-	var upCredit, downCredit, expiryTime int64
-	err := manager.db.View(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket(arrUID[:])
-		if bucket == nil {
-			return ErrUserNotFound
-		}
-		sessionsCap = int(u32(bucket.Get([]byte("SessionsCap"))))
-		upCredit = int64(u64(bucket.Get([]byte("UpCredit"))))
-		downCredit = int64(u64(bucket.Get([]byte("DownCredit"))))
-		expiryTime = int64(u64(bucket.Get([]byte("ExpiryTime"))))
-		return nil
-	})
+	uinfo, err := manager.readUserResetting(UID)
 	if err != nil {
 		return err
 	}
-	if upCredit <= 0 {
-		return ErrNoUpCredit
-	}
-	if downCredit <= 0 {
-		return ErrNoDownCredit
-	}
-	if expiryTime < manager.world.Now().Unix() {
-		return ErrUserExpired
+	if _, _, err = authenticate(uinfo, manager.world.Now().Unix()); err != nil {
+		return err
 	}
-
-	if ainfo.NumExistingSessions >= sessionsCap {
+	if ainfo.NumExistingSessions >= int(*uinfo.SessionsCap) {
 		return ErrSessionsCapReached
 	}
 	return nil
@@ -119,57 +128,40 @@ func (manager *localManager) UploadStatus(uploads []StatusUpdate) ([]StatusRespo
 	}
 	err := manager.db.Update(func(tx *bolt.Tx) error {
 		for _, status := range uploads {
-			var resp StatusResponse
-			bucket := tx.Bucket(status.UID)
+			bucket := userBucket(tx, status.UID)
 			if bucket == nil {
-				resp = StatusResponse{
-					status.UID,
-					TERMINATE,
-					"User no longer exists",
-				}
-				responses = append(responses, resp)
+				responses = append(responses, StatusResponse{
+					UID:     status.UID,
+					Action:  TERMINATE,
+					Message: "User no longer exists",
+				})
 				continue
 			}
-
-			oldUp := int64(u64(bucket.Get([]byte("UpCredit"))))
-			newUp := oldUp - status.UpUsage
-			if newUp <= 0 {
-				resp = StatusResponse{
-					status.UID,
-					TERMINATE,
-					"No upload credit left",
-				}
-				responses = append(responses, resp)
+			if err := manager.resetIfDue(tx, bucket); err != nil {
+				return err
 			}
+
+			newUp := getI64(bucket, "UpCredit") - status.UpUsage
 			err := bucket.Put([]byte("UpCredit"), i64ToB(newUp))
 			if err != nil {
 				log.Error(err)
 			}
-
-			oldDown := int64(u64(bucket.Get([]byte("DownCredit"))))
-			newDown := oldDown - status.DownUsage
-			if newDown <= 0 {
-				resp = StatusResponse{
-					status.UID,
-					TERMINATE,
-					"No download credit left",
-				}
-				responses = append(responses, resp)
-			}
+			newDown := getI64(bucket, "DownCredit") - status.DownUsage
 			err = bucket.Put([]byte("DownCredit"), i64ToB(newDown))
 			if err != nil {
 				log.Error(err)
 			}
-
-			expiry := int64(u64(bucket.Get([]byte("ExpiryTime"))))
-			if manager.world.Now().Unix() > expiry {
-				resp = StatusResponse{
-					status.UID,
-					TERMINATE,
-					"User has expired",
+			if totalCredit := getMaybeI64(bucket, "TotalCredit"); totalCredit != nil {
+				newTotal := *totalCredit - status.UpUsage - status.DownUsage
+				err = bucket.Put([]byte("TotalCredit"), i64ToB(newTotal))
+				if err != nil {
+					log.Error(err)
 				}
-				responses = append(responses, resp)
 			}
+
+			plan, _ := userPlan(tx, bucket)
+			responses = append(responses, statusResponsesOf(readUserInfo(status.UID, bucket), manager.world.Now().Unix(),
+				plan)...)
 		}
 		return nil
 	})
@@ -179,15 +171,10 @@ func (manager *localManager) UploadStatus(uploads []StatusUpdate) ([]StatusRespo
 func (manager *localManager) ListAllUsers() (infos []UserInfo, err error) {
 	err = manager.db.View(func(tx *bolt.Tx) error {
 		err = tx.ForEach(func(UID []byte, bucket *bolt.Bucket) error {
-			var uinfo UserInfo
-			uinfo.UID = UID
-			uinfo.SessionsCap = JustInt32(int32(u32(bucket.Get([]byte("SessionsCap")))))
-			uinfo.UpRate = JustInt64(int64(u64(bucket.Get([]byte("UpRate")))))
-			uinfo.DownRate = JustInt64(int64(u64(bucket.Get([]byte("DownRate")))))
-			uinfo.UpCredit = JustInt64(int64(u64(bucket.Get([]byte("UpCredit")))))
-			uinfo.DownCredit = JustInt64(int64(u64(bucket.Get([]byte("DownCredit")))))
-			uinfo.ExpiryTime = JustInt64(int64(u64(bucket.Get([]byte("ExpiryTime")))))
-			infos = append(infos, uinfo)
+			if isMetaBucket(UID) {
+				return nil
+			}
+			infos = append(infos, readUserInfo(UID, bucket))
 			return nil
 		})
 		return err
@@ -198,19 +185,33 @@ func (manager *localManager) ListAllUsers() (infos []UserInfo, err error) {
 	return
 }
 
+func readUserInfo(UID []byte, bucket *bolt.Bucket) (uinfo UserInfo) {
+	uinfo.UID = UID
+	uinfo.SessionsCap = JustInt32(int32(getU32(bucket, "SessionsCap")))
+	uinfo.UpRate = JustInt64(getI64(bucket, "UpRate"))
+	uinfo.DownRate = JustInt64(getI64(bucket, "DownRate"))
+	uinfo.UpCredit = JustInt64(getI64(bucket, "UpCredit"))
+	uinfo.DownCredit = JustInt64(getI64(bucket, "DownCredit"))
+	uinfo.ExpiryTime = JustInt64(getI64(bucket, "ExpiryTime"))
+	getJSON(bucket, "AllowedProxyMethods", &uinfo.AllowedProxyMethods)
+	getJSON(bucket, "ProxyEndpoints", &uinfo.ProxyEndpoints)
+	if plan := bucket.Get([]byte("Plan")); plan != nil {
+		uinfo.Plan = JustString(string(plan))
+	}
+	uinfo.NextResetTime = getMaybeI64(bucket, "NextResetTime")
+	uinfo.FallbackUpRate = getMaybeI64(bucket, "FallbackUpRate")
+	uinfo.FallbackDownRate = getMaybeI64(bucket, "FallbackDownRate")
+	uinfo.TotalCredit = getMaybeI64(bucket, "TotalCredit")
+	return
+}
+
 func (manager *localManager) GetUserInfo(UID []byte) (uinfo UserInfo, err error) {
 	err = manager.db.View(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket(UID)
+		bucket := userBucket(tx, UID)
 		if bucket == nil {
 			return ErrUserNotFound
 		}
-		uinfo.UID = UID
-		uinfo.SessionsCap = JustInt32(int32(u32(bucket.Get([]byte("SessionsCap")))))
-		uinfo.UpRate = JustInt64(int64(u64(bucket.Get([]byte("UpRate")))))
-		uinfo.DownRate = JustInt64(int64(u64(bucket.Get([]byte("DownRate")))))
-		uinfo.UpCredit = JustInt64(int64(u64(bucket.Get([]byte("UpCredit")))))
-		uinfo.DownCredit = JustInt64(int64(u64(bucket.Get([]byte("DownCredit")))))
-		uinfo.ExpiryTime = JustInt64(int64(u64(bucket.Get([]byte("ExpiryTime")))))
+		uinfo = readUserInfo(UID, bucket)
 		return nil
 	})
 	return
@@ -218,52 +219,291 @@ func (manager *localManager) GetUserInfo(UID []byte) (uinfo UserInfo, err error)
 
 func (manager *localManager) WriteUserInfo(u UserInfo) (err error) {
 	err = manager.db.Update(func(tx *bolt.Tx) error {
-		bucket, err := tx.CreateBucketIfNotExists(u.UID)
+		return manager.writeUserInfo(tx, u)
+	})
+	return
+}
+
+// WriteUserInfos writes all of infos in one transaction, so either all of them are written or none is
+func (manager *localManager) WriteUserInfos(infos []UserInfo) (err error) {
+	err = manager.db.Update(func(tx *bolt.Tx) error {
+		for _, u := range infos {
+			if err := manager.writeUserInfo(tx, u); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return
+}
+
+func (manager *localManager) writeUserInfo(tx *bolt.Tx, u UserInfo) error {
+	if isMetaBucket(u.UID) {
+		return ErrReservedUID
+	}
+	// resets are counted from a NextResetTime written explicitly, or from when the plan is assigned
+	resetAnchor := u.NextResetTime
+	if u.Plan != nil && *u.Plan != "" {
+		plan, err := getPlan(tx, *u.Plan)
 		if err != nil {
 			return err
 		}
-		if u.SessionsCap != nil {
-			if err = bucket.Put([]byte("SessionsCap"), i32ToB(*u.SessionsCap)); err != nil {
-				return err
-			}
+		now := manager.world.Now().Unix()
+		if resetAnchor == nil {
+			resetAnchor = JustInt64(now)
 		}
-		if u.UpRate != nil {
-			if err = bucket.Put([]byte("UpRate"), i64ToB(*u.UpRate)); err != nil {
-				return err
-			}
+		plan.applyTo(&u, now)
+	}
+	bucket, err := tx.CreateBucketIfNotExists(u.UID)
+	if err != nil {
+		return err
+	}
+	if u.SessionsCap != nil {
+		if err = bucket.Put([]byte("SessionsCap"), i32ToB(*u.SessionsCap)); err != nil {
+			return err
 		}
-		if u.DownRate != nil {
-			if err = bucket.Put([]byte("DownRate"), i64ToB(*u.DownRate)); err != nil {
-				return err
-			}
+	}
+	if u.UpRate != nil {
+		if err = bucket.Put([]byte("UpRate"), i64ToB(*u.UpRate)); err != nil {
+			return err
 		}
-		if u.UpCredit != nil {
-			if err = bucket.Put([]byte("UpCredit"), i64ToB(*u.UpCredit)); err != nil {
-				return err
-			}
+	}
+	if u.DownRate != nil {
+		if err = bucket.Put([]byte("DownRate"), i64ToB(*u.DownRate)); err != nil {
+			return err
 		}
-		if u.DownCredit != nil {
-			if err = bucket.Put([]byte("DownCredit"), i64ToB(*u.DownCredit)); err != nil {
-				return err
-			}
+	}
+	if u.UpCredit != nil {
+		if err = bucket.Put([]byte("UpCredit"), i64ToB(*u.UpCredit)); err != nil {
+			return err
 		}
-		if u.ExpiryTime != nil {
-			if err = bucket.Put([]byte("ExpiryTime"), i64ToB(*u.ExpiryTime)); err != nil {
-				return err
-			}
+	}
+	if u.DownCredit != nil {
+		if err = bucket.Put([]byte("DownCredit"), i64ToB(*u.DownCredit)); err != nil {
+			return err
 		}
-		return nil
-	})
-	return
+	}
+	if u.ExpiryTime != nil {
+		if err = bucket.Put([]byte("ExpiryTime"), i64ToB(*u.ExpiryTime)); err != nil {
+			return err
+		}
+	}
+	if u.AllowedProxyMethods != nil {
+		if err = putJSON(bucket, "AllowedProxyMethods", u.AllowedProxyMethods, len(u.AllowedProxyMethods) == 0); err != nil {
+			return err
+		}
+	}
+	if u.ProxyEndpoints != nil {
+		if err = putJSON(bucket, "ProxyEndpoints", u.ProxyEndpoints, len(u.ProxyEndpoints) == 0); err != nil {
+			return err
+		}
+	}
+	if u.Plan != nil {
+		if *u.Plan == "" {
+			err = bucket.Delete([]byte("Plan"))
+		} else {
+			err = bucket.Put([]byte("Plan"), []byte(*u.Plan))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if u.NextResetTime != nil {
+		if err = bucket.Put([]byte("NextResetTime"), i64ToB(*u.NextResetTime)); err != nil {
+			return err
+		}
+	}
+	if resetAnchor != nil {
+		if err = bucket.Put([]byte("ResetAnchor"), i64ToB(*resetAnchor)); err != nil {
+			return err
+		}
+	}
+	for _, f := range []struct {
+		key   string
+		value MaybeInt64
+	}{
+		{"FallbackUpRate", u.FallbackUpRate},
+		{"FallbackDownRate", u.FallbackDownRate},
+		{"TotalCredit", u.TotalCredit},
+	} {
+		if f.value == nil {
+			continue
+		}
+		if isCleared(f.value) {
+			err = bucket.Delete([]byte(f.key))
+		} else {
+			err = bucket.Put([]byte(f.key), i64ToB(*f.value))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (manager *localManager) DeleteUser(UID []byte) (err error) {
 	err = manager.db.Update(func(tx *bolt.Tx) error {
+		if isMetaBucket(UID) {
+			return ErrUserNotFound
+		}
 		return tx.DeleteBucket(UID)
 	})
 	return
 }
 
+func plansBucket(tx *bolt.Tx) *bolt.Bucket {
+	return tx.Bucket(metaBucketName).Bucket(plansBucketName)
+}
+
+func getPlan(tx *bolt.Tx, name string) (plan Plan, err error) {
+	b := plansBucket(tx).Get([]byte(name))
+	if b == nil {
+		return plan, ErrPlanNotFound
+	}
+	err = json.Unmarshal(b, &plan)
+	return
+}
+
+// userPlan returns the plan of the user in bucket, or nil if it doesn't have one or its plan has been deleted
+func userPlan(tx *bolt.Tx, bucket *bolt.Bucket) (*Plan, error) {
+	name := bucket.Get([]byte("Plan"))
+	if name == nil {
+		return nil, nil
+	}
+	plan, err := getPlan(tx, string(name))
+	if err == ErrPlanNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &plan, nil
+}
+
+// readUserResetting reads the user of UID, resetting its credits first if its reset time has passed. This happens on
+// every handshake, so the database is only written to when a reset is actually due
+func (manager *localManager) readUserResetting(UID []byte) (uinfo UserInfo, err error) {
+	var due bool
+	err = manager.db.View(func(tx *bolt.Tx) error {
+		bucket := userBucket(tx, UID)
+		if bucket == nil {
+			return ErrUserNotFound
+		}
+		var err error
+		_, _, due, err = manager.dueReset(tx, bucket)
+		if err != nil {
+			return err
+		}
+		uinfo = readUserInfo(UID, bucket)
+		return nil
+	})
+	if err != nil || !due {
+		return
+	}
+	err = manager.db.Update(func(tx *bolt.Tx) error {
+		bucket := userBucket(tx, UID)
+		if bucket == nil {
+			return ErrUserNotFound
+		}
+		// another handshake may have done the reset in the meantime, which resetIfDue checks again
+		if err := manager.resetIfDue(tx, bucket); err != nil {
+			return err
+		}
+		uinfo = readUserInfo(UID, bucket)
+		return nil
+	})
+	return
+}
+
+// dueReset returns the plan of the user in bucket, and whether its credits are due a reset along with the reset time
+// after it
+func (manager *localManager) dueReset(tx *bolt.Tx, bucket *bolt.Bucket) (plan *Plan, next int64, due bool, err error) {
+	plan, err = userPlan(tx, bucket)
+	if err != nil || plan == nil {
+		return
+	}
+	next, due = plan.dueReset(getI64(bucket, "ResetAnchor"), getI64(bucket, "NextResetTime"), manager.world.Now().Unix())
+	return
+}
+
+// resetIfDue sets the credits of the user in bucket back to the quotas of its plan if its reset time has passed
+func (manager *localManager) resetIfDue(tx *bolt.Tx, bucket *bolt.Bucket) error {
+	plan, next, due, err := manager.dueReset(tx, bucket)
+	if err != nil || plan == nil || !due {
+		return err
+	}
+	upCredit, downCredit, totalCredit := plan.resetCredits(getI64(bucket, "UpCredit"), getI64(bucket, "DownCredit"),
+		getMaybeI64(bucket, "TotalCredit"))
+	if err = bucket.Put([]byte("UpCredit"), i64ToB(upCredit)); err != nil {
+		return err
+	}
+	if err = bucket.Put([]byte("DownCredit"), i64ToB(downCredit)); err != nil {
+		return err
+	}
+	if totalCredit != nil {
+		if err = bucket.Put([]byte("TotalCredit"), i64ToB(*totalCredit)); err != nil {
+			return err
+		}
+	}
+	return bucket.Put([]byte("NextResetTime"), i64ToB(next))
+}
+
+func (manager *localManager) ListPlans() (plans []Plan, err error) {
+	plans = []Plan{}
+	err = manager.db.View(func(tx *bolt.Tx) error {
+		return plansBucket(tx).ForEach(func(name, b []byte) error {
+			var plan Plan
+			if err := json.Unmarshal(b, &plan); err != nil {
+				return err
+			}
+			plans = append(plans, plan)
+			return nil
+		})
+	})
+	return
+}
+
+func (manager *localManager) GetPlan(name string) (plan Plan, err error) {
+	err = manager.db.View(func(tx *bolt.Tx) error {
+		plan, err = getPlan(tx, name)
+		return err
+	})
+	return
+}
+
+func (manager *localManager) WritePlan(plan Plan) error {
+	if err := plan.validate(); err != nil {
+		return err
+	}
+	b, err := json.Marshal(plan)
+	if err != nil {
+		return err
+	}
+	return manager.db.Update(func(tx *bolt.Tx) error {
+		return plansBucket(tx).Put([]byte(plan.Name), b)
+	})
+}
+
+// DeletePlan deletes a plan and takes its users off it. They keep their current limits, but their credits are no
+// longer reset
+func (manager *localManager) DeletePlan(name string) error {
+	return manager.db.Update(func(tx *bolt.Tx) error {
+		bucket := plansBucket(tx)
+		if bucket.Get([]byte(name)) == nil {
+			return ErrPlanNotFound
+		}
+		if err := bucket.Delete([]byte(name)); err != nil {
+			return err
+		}
+		return tx.ForEach(func(UID []byte, bucket *bolt.Bucket) error {
+			if isMetaBucket(UID) || !bytes.Equal(bucket.Get([]byte("Plan")), []byte(name)) {
+				return nil
+			}
+			return bucket.Delete([]byte("Plan"))
+		})
+	})
+}
+
 func (manager *localManager) Close() error {
 	return manager.db.Close()
 }
@@ -0,0 +1,119 @@
+package usermanager
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+// metaBucketName is the top level bucket holding information about the database itself rather than a user. UIDs are
+// 16 bytes long so a real user won't clash with it, but the name is reserved regardless
+var metaBucketName = []byte("cloak-meta")
+
+var schemaVersionKey = []byte("SchemaVersion")
+
+// plansBucketName is the bucket in the meta bucket holding Plans in JSON, keyed by their names
+var plansBucketName = []byte("Plans")
+
+func isMetaBucket(name []byte) bool { return bytes.Equal(name, metaBucketName) }
+
+// userBucket returns the bucket of a user, or nil if there isn't one
+func userBucket(tx *bolt.Tx, UID []byte) *bolt.Bucket {
+	if isMetaBucket(UID) {
+		return nil
+	}
+	return tx.Bucket(UID)
+}
+
+type migration struct {
+	description string
+	migrate     func(tx *bolt.Tx) error
+}
+
+// migrations[i] upgrades the database from schema version i to i+1. Databases made before schema versions were
+// recorded have no meta bucket and are at version 0. Only ever append to this.
+var migrations = []migration{
+	{"fill in missing user fields", fillMissingUserFields},
+	{"add plans", createPlansBucket},
+}
+
+var currentSchemaVersion = uint32(len(migrations))
+
+var userFieldLengths = map[string]int{
+	"SessionsCap": 4,
+	"UpRate":      8,
+	"DownRate":    8,
+	"UpCredit":    8,
+	"DownCredit":  8,
+	"ExpiryTime":  8,
+}
+
+// fillMissingUserFields sets fields that are missing or of the wrong length in every user bucket to 0
+func fillMissingUserFields(tx *bolt.Tx) error {
+	return tx.ForEach(func(UID []byte, bucket *bolt.Bucket) error {
+		if isMetaBucket(UID) {
+			return nil
+		}
+		for key, length := range userFieldLengths {
+			if len(bucket.Get([]byte(key))) == length {
+				continue
+			}
+			if err := bucket.Put([]byte(key), make([]byte, length)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func createPlansBucket(tx *bolt.Tx) error {
+	meta, err := tx.CreateBucketIfNotExists(metaBucketName)
+	if err != nil {
+		return err
+	}
+	_, err = meta.CreateBucketIfNotExists(plansBucketName)
+	return err
+}
+
+func schemaVersion(tx *bolt.Tx) uint32 {
+	meta := tx.Bucket(metaBucketName)
+	if meta == nil {
+		return 0
+	}
+	v := meta.Get(schemaVersionKey)
+	if len(v) != 4 {
+		return 0
+	}
+	return binary.BigEndian.Uint32(v)
+}
+
+// migrate brings the database up to currentSchemaVersion. All the migrations needed are run in a single transaction,
+// so the database is left untouched if any of them fails
+func migrate(db *bolt.DB) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		version := schemaVersion(tx)
+		if version == currentSchemaVersion {
+			return nil
+		}
+		if version > currentSchemaVersion {
+			return fmt.Errorf("user database has schema version %v, which is newer than the supported version %v",
+				version, currentSchemaVersion)
+		}
+		for ; version < currentSchemaVersion; version++ {
+			m := migrations[version]
+			log.Infof("Migrating user database to schema version %v: %v", version+1, m.description)
+			if err := m.migrate(tx); err != nil {
+				return fmt.Errorf("failed to migrate user database to schema version %v: %w", version+1, err)
+			}
+		}
+
+		meta, err := tx.CreateBucketIfNotExists(metaBucketName)
+		if err != nil {
+			return err
+		}
+		return meta.Put(schemaVersionKey, i32ToB(int32(currentSchemaVersion)))
+	})
+}
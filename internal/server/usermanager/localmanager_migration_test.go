@@ -0,0 +1,130 @@
+package usermanager
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	bolt "go.etcd.io/bbolt"
+)
+
+// makeFixture writes a bbolt database with the given top level buckets and returns its path
+func makeFixture(t *testing.T, buckets map[string]map[string][]byte) string {
+	path := filepath.Join(t.TempDir(), "userinfo.db")
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for name, fields := range buckets {
+			bucket, err := tx.CreateBucket([]byte(name))
+			if err != nil {
+				return err
+			}
+			for k, v := range fields {
+				if err := bucket.Put([]byte(k), v); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	return path
+}
+
+// unversionedFixture has the layout written before schema versions were recorded, with one user written in full and
+// one with fields missing or truncated
+func unversionedFixture(t *testing.T) string {
+	return makeFixture(t, map[string]map[string][]byte{
+		string(mockUID): {
+			"SessionsCap": i32ToB(*mockUserInfo.SessionsCap),
+			"UpRate":      i64ToB(*mockUserInfo.UpRate),
+			"DownRate":    i64ToB(*mockUserInfo.DownRate),
+			"UpCredit":    i64ToB(*mockUserInfo.UpCredit),
+			"DownCredit":  i64ToB(*mockUserInfo.DownCredit),
+			"ExpiryTime":  i64ToB(*mockUserInfo.ExpiryTime),
+		},
+		string(make([]byte, 16)): {
+			"SessionsCap": {0, 1},
+			"UpCredit":    i64ToB(100),
+		},
+	})
+}
+
+func TestMakeLocalManager_Unversioned(t *testing.T) {
+	path := unversionedFixture(t)
+	mgr, err := MakeLocalManager(path, mockWorldState)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mgr.Close()
+
+	got, err := mgr.GetUserInfo(mockUID)
+	assert.NoError(t, err)
+	assert.EqualValues(t, mockUserInfo, got)
+
+	got, err = mgr.GetUserInfo(make([]byte, 16))
+	assert.NoError(t, err)
+	assert.EqualValues(t, UserInfo{
+		UID:         make([]byte, 16),
+		SessionsCap: JustInt32(0),
+		UpRate:      JustInt64(0),
+		DownRate:    JustInt64(0),
+		UpCredit:    JustInt64(100),
+		DownCredit:  JustInt64(0),
+		ExpiryTime:  JustInt64(0),
+	}, got, "missing fields should be filled in with 0")
+
+	users, err := mgr.ListAllUsers()
+	assert.NoError(t, err)
+	assert.Len(t, users, 2, "the meta bucket shouldn't be listed as a user")
+
+	err = mgr.db.View(func(tx *bolt.Tx) error {
+		assert.Equal(t, currentSchemaVersion, schemaVersion(tx))
+		return nil
+	})
+	assert.NoError(t, err)
+}
+
+func TestMakeLocalManager_Reopen(t *testing.T) {
+	path := unversionedFixture(t)
+	mgr, err := MakeLocalManager(path, mockWorldState)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, mgr.WriteUserInfo(UserInfo{UID: mockUID, UpCredit: JustInt64(1)}))
+	mgr.Close()
+
+	mgr, err = MakeLocalManager(path, mockWorldState)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mgr.Close()
+	got, err := mgr.GetUserInfo(mockUID)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 1, *got.UpCredit)
+}
+
+func TestMakeLocalManager_NewerSchema(t *testing.T) {
+	path := makeFixture(t, map[string]map[string][]byte{
+		string(metaBucketName): {
+			string(schemaVersionKey): i32ToB(int32(currentSchemaVersion + 1)),
+		},
+	})
+	_, err := MakeLocalManager(path, mockWorldState)
+	assert.Error(t, err)
+}
+
+func TestLocalManager_ReservedUID(t *testing.T) {
+	mgr, cleaner := makeManager(t)
+	defer cleaner()
+
+	_, err := mgr.GetUserInfo(metaBucketName)
+	assert.Equal(t, ErrUserNotFound, err)
+	assert.Equal(t, ErrReservedUID, mgr.WriteUserInfo(UserInfo{UID: metaBucketName}))
+	assert.Equal(t, ErrUserNotFound, mgr.DeleteUser(metaBucketName))
+}
@@ -5,6 +5,7 @@ import (
 	"io/ioutil"
 	"math/rand"
 	"os"
+	"path/filepath"
 	"reflect"
 	"sort"
 	"sync"
@@ -363,3 +364,127 @@ func TestLocalManager_ListAllUsers(t *testing.T) {
 		t.Error("listed users deviates from uploaded ones")
 	}
 }
+
+func TestLocalManager_WriteUserInfos(t *testing.T) {
+	mgr, cleaner := makeManager(t)
+	defer cleaner()
+
+	other := mockUserInfo
+	other.UID = make([]byte, 16)
+	assert.NoError(t, mgr.WriteUserInfos([]UserInfo{mockUserInfo, other}))
+	users, err := mgr.ListAllUsers()
+	assert.NoError(t, err)
+	assert.Len(t, users, 2)
+
+	// a failed batch leaves the database unchanged
+	updated := mockUserInfo
+	updated.UpCredit = JustInt64(0)
+	err = mgr.WriteUserInfos([]UserInfo{updated, {UID: metaBucketName}})
+	assert.Equal(t, ErrReservedUID, err)
+	got, err := mgr.GetUserInfo(mockUID)
+	assert.NoError(t, err)
+	assert.EqualValues(t, mockUserInfo, got)
+}
+
+// testProxyRules checks that AllowedProxyMethods and ProxyEndpoints are stored by mgr, left alone when nil and
+// removed when empty
+func testProxyRules(t *testing.T, mgr UserManager) {
+	withRules := mockUserInfo
+	withRules.AllowedProxyMethods = []string{"shadowsocks", "tenant-a"}
+	withRules.ProxyEndpoints = map[string][]string{"tenant-a": {"tcp", "10.0.0.2:8388"}}
+	assert.NoError(t, mgr.WriteUserInfo(withRules))
+	got, err := mgr.GetUserInfo(mockUID)
+	assert.NoError(t, err)
+	assert.EqualValues(t, withRules, got)
+
+	assert.NoError(t, mgr.WriteUserInfo(UserInfo{UID: mockUID, UpRate: JustInt64(1)}))
+	got, _ = mgr.GetUserInfo(mockUID)
+	assert.Equal(t, withRules.AllowedProxyMethods, got.AllowedProxyMethods)
+	assert.Equal(t, withRules.ProxyEndpoints, got.ProxyEndpoints)
+
+	assert.NoError(t, mgr.WriteUserInfo(UserInfo{
+		UID:                 mockUID,
+		AllowedProxyMethods: []string{},
+		ProxyEndpoints:      map[string][]string{},
+	}))
+	got, _ = mgr.GetUserInfo(mockUID)
+	assert.Nil(t, got.AllowedProxyMethods)
+	assert.Nil(t, got.ProxyEndpoints)
+}
+
+func TestLocalManager_ProxyRules(t *testing.T) {
+	mgr, cleaner := makeManager(t)
+	defer cleaner()
+	testProxyRules(t, mgr)
+}
+
+func TestLocalManager_Plans(t *testing.T) {
+	testPlans(t, func(world common.WorldState) UserManager {
+		mgr, err := MakeLocalManager(filepath.Join(t.TempDir(), "userinfo.db"), world)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { mgr.Close() })
+		return mgr
+	})
+}
+
+func TestLocalManager_Fallback(t *testing.T) {
+	testFallback(t, func(world common.WorldState) UserManager {
+		mgr, err := MakeLocalManager(filepath.Join(t.TempDir(), "userinfo.db"), world)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { mgr.Close() })
+		return mgr
+	})
+}
+
+func TestLocalManager_TotalCredit(t *testing.T) {
+	testTotalCredit(t, func(world common.WorldState) UserManager {
+		mgr, err := MakeLocalManager(filepath.Join(t.TempDir(), "userinfo.db"), world)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { mgr.Close() })
+		return mgr
+	})
+}
+
+func TestLocalManager_ResetOnlyWritesWhenDue(t *testing.T) {
+	now := time.Date(2024, 1, 15, 0, 0, 0, 0, time.UTC)
+	mgr, err := MakeLocalManager(filepath.Join(t.TempDir(), "userinfo.db"),
+		common.WorldState{Now: func() time.Time { return now }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mgr.Close()
+	assert.NoError(t, mgr.WritePlan(mockPlan))
+	assert.NoError(t, mgr.WriteUserInfo(UserInfo{
+		UID:        mockUID,
+		Plan:       JustString("basic"),
+		ExpiryTime: JustInt64(now.AddDate(1, 0, 0).Unix()),
+	}))
+	_, err = mgr.UploadStatus([]StatusUpdate{{UID: mockUID, UpUsage: 100}})
+	assert.NoError(t, err)
+
+	writesOf := func() int64 {
+		stats := mgr.db.Stats()
+		return stats.TxStats.GetWrite()
+	}
+	writes := writesOf()
+	_, _, err = mgr.AuthenticateUser(mockUID)
+	assert.NoError(t, err)
+	assert.NoError(t, mgr.AuthoriseNewSession(mockUID, AuthorisationInfo{}))
+	assert.Equal(t, writes, writesOf(), "nothing should be written before the reset is due")
+	got, _ := mgr.GetUserInfo(mockUID)
+	assert.EqualValues(t, mockPlan.UpCredit-100, *got.UpCredit)
+
+	now = now.AddDate(0, 1, 0)
+	_, _, err = mgr.AuthenticateUser(mockUID)
+	assert.NoError(t, err)
+	assert.Greater(t, writesOf(), writes)
+	got, _ = mgr.GetUserInfo(mockUID)
+	assert.EqualValues(t, mockPlan.UpCredit, *got.UpCredit, "credits should have been reset")
+	assert.Equal(t, time.Date(2024, 3, 15, 0, 0, 0, 0, time.UTC).Unix(), *got.NextResetTime)
+}
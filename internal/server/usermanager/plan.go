@@ -0,0 +1,171 @@
+package usermanager
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var ErrPlanNotFound = errors.New("Plan does not exist")
+
+const (
+	ResetDaily   = "daily"
+	ResetWeekly  = "weekly"
+	ResetMonthly = "monthly"
+)
+
+// Plan is a template of limits assigned to users through UserInfo.Plan. Its non-zero SessionsCap, rates and credits
+// are copied into a user when the plan is assigned, except for the ones written along with the assignment. Changes to
+// a plan only apply to its users when their credits are next reset, or when the plan is assigned again
+type Plan struct {
+	Name        string
+	SessionsCap int32
+	UpRate      int64
+	DownRate    int64
+	// UpCredit and DownCredit are the quotas of the plan. Users' credits are set back to them at every reset
+	UpCredit   int64
+	DownCredit int64
+	// TotalCredit is the quota shared by both directions. Users on a plan with it have their UpCredit and DownCredit
+	// ignored
+	TotalCredit int64
+	// ResetPeriod is how often credits are reset: daily, weekly or monthly, counting from when the plan is assigned.
+	// Credits are never reset if it's empty
+	ResetPeriod string
+
+	// WarnBelow and ThrottleBelow are percentages of the quotas. When a user's credit in either direction falls below
+	// WarnBelow percent of its quota, a warning is logged; below ThrottleBelow percent, its rates are lowered to
+	// ThrottleUpRate and ThrottleDownRate until its credits are reset. Zero disables either
+	WarnBelow        int32
+	ThrottleBelow    int32
+	ThrottleUpRate   int64
+	ThrottleDownRate int64
+
+	// FallbackUpRate and FallbackDownRate are copied into users like the rates are
+	FallbackUpRate   int64
+	FallbackDownRate int64
+}
+
+func (p Plan) validate() error {
+	if p.Name == "" {
+		return errors.New("plan name cannot be empty")
+	}
+	switch p.ResetPeriod {
+	case "", ResetDaily, ResetWeekly, ResetMonthly:
+	default:
+		return fmt.Errorf("unknown ResetPeriod %v, must be daily, weekly or monthly", p.ResetPeriod)
+	}
+	if p.WarnBelow < 0 || p.WarnBelow > 100 || p.ThrottleBelow < 0 || p.ThrottleBelow > 100 {
+		return errors.New("WarnBelow and ThrottleBelow must be between 0 and 100")
+	}
+	if p.ThrottleBelow != 0 && (p.ThrottleUpRate <= 0 || p.ThrottleDownRate <= 0) {
+		return errors.New("ThrottleUpRate and ThrottleDownRate must be positive when ThrottleBelow is set")
+	}
+	return nil
+}
+
+// nextReset returns the time one reset period after from, or 0 if the plan is never reset. Monthly resets are counted
+// from anchor rather than from, so that they stay on its day of the month, or on the last day of shorter months
+func (p Plan) nextReset(anchor int64, from int64) int64 {
+	t := time.Unix(from, 0).UTC()
+	switch p.ResetPeriod {
+	case ResetDaily:
+		return t.AddDate(0, 0, 1).Unix()
+	case ResetWeekly:
+		return t.AddDate(0, 0, 7).Unix()
+	case ResetMonthly:
+		a := time.Unix(anchor, 0).UTC()
+		months := max((t.Year()-a.Year())*12+int(t.Month()-a.Month()), 0)
+		for {
+			next := addMonths(a, months)
+			if next.After(t) {
+				return next.Unix()
+			}
+			months++
+		}
+	default:
+		return 0
+	}
+}
+
+// addMonths returns the time n months after t, on the last day of the month if it's too short to have t's day.
+// Unlike AddDate, Jan 31 plus one month is Feb 28 or 29 rather than early March
+func addMonths(t time.Time, n int) time.Time {
+	firstOfMonth := time.Date(t.Year(), t.Month()+time.Month(n), 1, t.Hour(), t.Minute(), t.Second(), 0, time.UTC)
+	lastDay := firstOfMonth.AddDate(0, 1, -1).Day()
+	return firstOfMonth.AddDate(0, 0, min(t.Day(), lastDay)-1)
+}
+
+// dueReset tells whether credits whose next reset is at nextResetTime need resetting at now, and if so, when the
+// reset after that is. Periods missed entirely, e.g. while the server was down, are skipped. resetAnchor is when the
+// resets are counted from, and nextResetTime is taken for it if it's 0
+func (p Plan) dueReset(resetAnchor int64, nextResetTime int64, now int64) (next int64, due bool) {
+	if p.ResetPeriod == "" || nextResetTime == 0 || now < nextResetTime {
+		return nextResetTime, false
+	}
+	if resetAnchor == 0 {
+		resetAnchor = nextResetTime
+	}
+	next = nextResetTime
+	for next <= now {
+		next = p.nextReset(resetAnchor, next)
+	}
+	return next, true
+}
+
+// resetCredits returns the credits after a reset. A credit without a quota is kept as it is
+func (p Plan) resetCredits(upCredit, downCredit int64, totalCredit MaybeInt64) (int64, int64, MaybeInt64) {
+	if p.UpCredit > 0 {
+		upCredit = p.UpCredit
+	}
+	if p.DownCredit > 0 {
+		downCredit = p.DownCredit
+	}
+	if p.TotalCredit > 0 {
+		totalCredit = JustInt64(p.TotalCredit)
+	}
+	return upCredit, downCredit, totalCredit
+}
+
+// applyTo fills the fields of u left nil with the plan's, as u is being assigned the plan at now
+func (p Plan) applyTo(u *UserInfo, now int64) {
+	if u.SessionsCap == nil && p.SessionsCap > 0 {
+		u.SessionsCap = JustInt32(p.SessionsCap)
+	}
+	if u.UpRate == nil && p.UpRate > 0 {
+		u.UpRate = JustInt64(p.UpRate)
+	}
+	if u.DownRate == nil && p.DownRate > 0 {
+		u.DownRate = JustInt64(p.DownRate)
+	}
+	if u.UpCredit == nil && p.UpCredit > 0 {
+		u.UpCredit = JustInt64(p.UpCredit)
+	}
+	if u.DownCredit == nil && p.DownCredit > 0 {
+		u.DownCredit = JustInt64(p.DownCredit)
+	}
+	if u.TotalCredit == nil && p.TotalCredit > 0 {
+		u.TotalCredit = JustInt64(p.TotalCredit)
+	}
+	if u.FallbackUpRate == nil && p.FallbackUpRate > 0 {
+		u.FallbackUpRate = JustInt64(p.FallbackUpRate)
+	}
+	if u.FallbackDownRate == nil && p.FallbackDownRate > 0 {
+		u.FallbackDownRate = JustInt64(p.FallbackDownRate)
+	}
+	if u.NextResetTime == nil {
+		u.NextResetTime = JustInt64(p.nextReset(now, now))
+	}
+}
+
+// below tells whether any of the credits the user is checked against has fallen below percent of the plan's quota
+func (p Plan) below(uinfo UserInfo, percent int32) bool {
+	if uinfo.TotalCredit != nil {
+		return below(*uinfo.TotalCredit, p.TotalCredit, percent)
+	}
+	return below(valueOf(uinfo.UpCredit), p.UpCredit, percent) || below(valueOf(uinfo.DownCredit), p.DownCredit, percent)
+}
+
+// below tells whether credit has fallen below percent of quota
+func below(credit, quota int64, percent int32) bool {
+	return quota > 0 && percent > 0 && credit*100 < quota*int64(percent)
+}
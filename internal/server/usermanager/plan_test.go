@@ -0,0 +1,169 @@
+package usermanager
+
+import (
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/common"
+	"github.com/stretchr/testify/assert"
+)
+
+var mockPlan = Plan{
+	Name:             "basic",
+	SessionsCap:      4,
+	UpRate:           1000,
+	DownRate:         10000,
+	UpCredit:         1000,
+	DownCredit:       10000,
+	ResetPeriod:      ResetMonthly,
+	WarnBelow:        20,
+	ThrottleBelow:    10,
+	ThrottleUpRate:   10,
+	ThrottleDownRate: 100,
+}
+
+func TestPlan_DueReset(t *testing.T) {
+	jan31 := time.Date(2024, 1, 31, 0, 0, 0, 0, time.UTC).Unix()
+	next := mockPlan.nextReset(jan31, jan31)
+	assert.Equal(t, time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC).Unix(), next, "Feb 31 should be clamped to Feb 29")
+
+	_, due := mockPlan.dueReset(jan31, next, next-1)
+	assert.False(t, due)
+
+	// resets go back to the end of the month rather than drifting into the next one
+	for _, want := range []time.Time{
+		time.Date(2024, 3, 31, 0, 0, 0, 0, time.UTC),
+		time.Date(2024, 4, 30, 0, 0, 0, 0, time.UTC),
+		time.Date(2024, 5, 31, 0, 0, 0, 0, time.UTC),
+	} {
+		var due bool
+		next, due = mockPlan.dueReset(jan31, next, next)
+		assert.True(t, due)
+		assert.Equal(t, want.Unix(), next)
+	}
+
+	// the server was down for two periods
+	later := time.Date(2024, 8, 10, 0, 0, 0, 0, time.UTC).Unix()
+	after, due := mockPlan.dueReset(jan31, next, later)
+	assert.True(t, due)
+	assert.Equal(t, time.Date(2024, 8, 31, 0, 0, 0, 0, time.UTC).Unix(), after)
+
+	_, due = Plan{}.dueReset(jan31, next, later)
+	assert.False(t, due, "a plan without ResetPeriod is never reset")
+}
+
+func TestPlan_ApplyTo(t *testing.T) {
+	u := UserInfo{UID: mockUID, UpRate: JustInt64(5)}
+	mockPlan.applyTo(&u, 0)
+	assert.EqualValues(t, 5, *u.UpRate, "fields written along with the plan take precedence")
+	assert.EqualValues(t, mockPlan.DownRate, *u.DownRate)
+	assert.EqualValues(t, mockPlan.SessionsCap, *u.SessionsCap)
+	assert.EqualValues(t, mockPlan.UpCredit, *u.UpCredit)
+	assert.Nil(t, u.ExpiryTime)
+	assert.Equal(t, mockPlan.nextReset(0, 0), *u.NextResetTime)
+}
+
+func TestPlan_Below(t *testing.T) {
+	uinfo := UserInfo{UpCredit: JustInt64(500), DownCredit: JustInt64(500)}
+	assert.True(t, mockPlan.below(uinfo, 10), "DownCredit is below 10% of its quota")
+	assert.False(t, mockPlan.below(uinfo, 1))
+
+	plan := mockPlan
+	plan.TotalCredit = 1000
+	uinfo.TotalCredit = JustInt64(500)
+	assert.False(t, plan.below(uinfo, 10), "only TotalCredit is checked")
+	assert.True(t, plan.below(uinfo, 60))
+}
+
+func TestPlan_Validate(t *testing.T) {
+	assert.NoError(t, mockPlan.validate())
+	assert.Error(t, Plan{}.validate())
+	assert.Error(t, Plan{Name: "a", ResetPeriod: "yearly"}.validate())
+	assert.Error(t, Plan{Name: "a", ThrottleBelow: 10}.validate())
+	assert.Error(t, Plan{Name: "a", WarnBelow: 101}.validate())
+}
+
+// testPlans checks plan storage, assignment and credit resets of the UserManager made by makeManager
+func testPlans(t *testing.T, makeManager func(world common.WorldState) UserManager) {
+	now := time.Date(2024, 1, 15, 0, 0, 0, 0, time.UTC)
+	mgr := makeManager(common.WorldState{Rand: rand.Reader, Now: func() time.Time { return now }})
+
+	assert.Equal(t, ErrPlanNotFound, mgr.WriteUserInfo(UserInfo{UID: mockUID, Plan: JustString("basic")}))
+
+	assert.NoError(t, mgr.WritePlan(mockPlan))
+	plans, err := mgr.ListPlans()
+	assert.NoError(t, err)
+	assert.Equal(t, []Plan{mockPlan}, plans)
+
+	assert.NoError(t, mgr.WriteUserInfo(UserInfo{
+		UID:        mockUID,
+		Plan:       JustString("basic"),
+		ExpiryTime: JustInt64(now.AddDate(1, 0, 0).Unix()),
+	}))
+	got, err := mgr.GetUserInfo(mockUID)
+	assert.NoError(t, err)
+	assert.Equal(t, "basic", *got.Plan)
+	assert.EqualValues(t, mockPlan.UpCredit, *got.UpCredit)
+	assert.EqualValues(t, mockPlan.SessionsCap, *got.SessionsCap)
+	assert.Equal(t, time.Date(2024, 2, 15, 0, 0, 0, 0, time.UTC).Unix(), *got.NextResetTime)
+
+	resps, err := mgr.UploadStatus([]StatusUpdate{{UID: mockUID, UpUsage: 950}})
+	assert.NoError(t, err)
+	if assert.Len(t, resps, 1) {
+		assert.Equal(t, THROTTLE, resps[0].Action)
+	}
+	resps, _ = mgr.UploadStatus([]StatusUpdate{{UID: mockUID, UpUsage: 100}})
+	if assert.Len(t, resps, 1) {
+		assert.Equal(t, TERMINATE, resps[0].Action)
+	}
+	_, _, err = mgr.AuthenticateUser(mockUID)
+	assert.Equal(t, ErrNoUpCredit, err)
+
+	now = now.AddDate(0, 1, 0)
+	_, _, err = mgr.AuthenticateUser(mockUID)
+	assert.NoError(t, err, "credits should have been reset")
+	got, _ = mgr.GetUserInfo(mockUID)
+	assert.EqualValues(t, mockPlan.UpCredit, *got.UpCredit)
+	assert.Equal(t, time.Date(2024, 3, 15, 0, 0, 0, 0, time.UTC).Unix(), *got.NextResetTime)
+
+	assert.NoError(t, mgr.WriteUserInfo(UserInfo{UID: mockUID, Plan: JustString("")}))
+	got, _ = mgr.GetUserInfo(mockUID)
+	assert.Nil(t, got.Plan)
+
+	assert.NoError(t, mgr.WriteUserInfo(UserInfo{UID: mockUID, Plan: JustString("basic")}))
+	assert.NoError(t, mgr.DeletePlan("basic"))
+	got, _ = mgr.GetUserInfo(mockUID)
+	assert.Nil(t, got.Plan, "users should be taken off a deleted plan")
+	assert.EqualValues(t, mockPlan.UpCredit, *got.UpCredit, "users should keep their limits")
+	assert.Equal(t, ErrPlanNotFound, mgr.DeletePlan("basic"))
+	_, err = mgr.GetPlan("basic")
+	assert.Equal(t, ErrPlanNotFound, err)
+
+	testMonthEndResets(t, makeManager)
+}
+
+// testMonthEndResets checks that a user assigned a monthly plan on Jan 31 is reset on the last day of each month
+func testMonthEndResets(t *testing.T, makeManager func(world common.WorldState) UserManager) {
+	now := time.Date(2024, 1, 31, 12, 0, 0, 0, time.UTC)
+	mgr := makeManager(common.WorldState{Rand: rand.Reader, Now: func() time.Time { return now }})
+	assert.NoError(t, mgr.WritePlan(mockPlan))
+	assert.NoError(t, mgr.WriteUserInfo(UserInfo{
+		UID:        mockUID,
+		Plan:       JustString("basic"),
+		ExpiryTime: JustInt64(now.AddDate(1, 0, 0).Unix()),
+	}))
+	for _, reset := range []time.Time{
+		time.Date(2024, 2, 29, 12, 0, 0, 0, time.UTC),
+		time.Date(2024, 3, 31, 12, 0, 0, 0, time.UTC),
+		time.Date(2024, 4, 30, 12, 0, 0, 0, time.UTC),
+		time.Date(2024, 5, 31, 12, 0, 0, 0, time.UTC),
+	} {
+		got, err := mgr.GetUserInfo(mockUID)
+		assert.NoError(t, err)
+		assert.Equal(t, reset.Unix(), *got.NextResetTime)
+		now = reset
+		_, _, err = mgr.AuthenticateUser(mockUID)
+		assert.NoError(t, err)
+	}
+}
@@ -2,6 +2,9 @@ package usermanager
 
 import (
 	"errors"
+	"fmt"
+	"math"
+	"strings"
 )
 
 type StatusUpdate struct {
@@ -16,6 +19,7 @@ type StatusUpdate struct {
 
 type MaybeInt32 *int32
 type MaybeInt64 *int64
+type MaybeString *string
 
 type UserInfo struct {
 	UID         []byte
@@ -25,16 +29,101 @@ type UserInfo struct {
 	UpCredit    MaybeInt64
 	DownCredit  MaybeInt64
 	ExpiryTime  MaybeInt64
+
+	// AllowedProxyMethods restricts the proxy methods the user can use. A user without it can use all of them.
+	// When written, nil leaves it unchanged and an empty list removes the restriction
+	AllowedProxyMethods []string
+	// ProxyEndpoints are the user's own proxy endpoints in the same format as ProxyBook, taking precedence over the
+	// ProxyBook entries of the same names. When written, nil leaves them unchanged and an empty map removes them all
+	ProxyEndpoints map[string][]string
+
+	// Plan is the name of the Plan the user is on. Writing it assigns the plan to the user, and writing an empty
+	// name takes the user off its plan
+	Plan MaybeString
+	// NextResetTime is the unix time at which the user's credits are next reset to the quotas of its plan
+	NextResetTime MaybeInt64
+
+	// FallbackUpRate and FallbackDownRate are the rates a user is throttled to when it runs out of credit. A user
+	// without both of them is disconnected instead. Writing Cleared removes them
+	FallbackUpRate   MaybeInt64
+	FallbackDownRate MaybeInt64
+
+	// TotalCredit is a credit shared by both directions. A user with it has its upload and download usage both taken
+	// from it, and is only out of credit when TotalCredit is used up. UpCredit and DownCredit keep counting down but
+	// are no longer checked. Writing Cleared removes it
+	TotalCredit MaybeInt64
+}
+
+// Cleared is written to a field that a user can go without, such as TotalCredit or a fallback rate, to remove it from the user. The
+// admin API takes a JSON null for it. Since TotalCredit goes below zero when it's overused, the smallest int64 is used
+// rather than -1 so that no value that can be read back is taken for it
+const Cleared int64 = math.MinInt64
+
+// isCleared tells whether v asks for its field to be removed
+func isCleared(v MaybeInt64) bool {
+	return v != nil && *v == Cleared
+}
+
+// validate checks the fields that can't be checked by their types alone
+func (u UserInfo) validate() error {
+	if len(u.UID) == 0 {
+		return errors.New("UID cannot be empty")
+	}
+	for method, endpoint := range u.ProxyEndpoints {
+		if _, err := ParseProxyEndpoint(method, endpoint); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ProxyEndpoint is a parsed entry of ProxyBook or of a user's ProxyEndpoints
+type ProxyEndpoint struct {
+	// Network is tcp, udp or unix
+	Network string
+	Address string
+	// ProxyProtocol asks for connections to the endpoint to start with a PROXY protocol header
+	ProxyProtocol bool
+}
+
+// ParseProxyEndpoint parses the entry of method, a pair of network and address optionally followed by
+// "ProxyProtocol". The address itself is left to be resolved by the caller
+func ParseProxyEndpoint(method string, entry []string) (ProxyEndpoint, error) {
+	if len(entry) != 2 && len(entry) != 3 {
+		return ProxyEndpoint{}, fmt.Errorf("invalid proxy endpoint and address pair for %v: %v", method, entry)
+	}
+	endpoint := ProxyEndpoint{Network: strings.ToLower(entry[0]), Address: entry[1]}
+	if len(entry) == 3 {
+		if !strings.EqualFold(entry[2], "ProxyProtocol") {
+			return ProxyEndpoint{}, fmt.Errorf("unknown option %v for %v", entry[2], method)
+		}
+		endpoint.ProxyProtocol = true
+	}
+	switch endpoint.Network {
+	case "tcp", "unix":
+	case "udp":
+		if endpoint.ProxyProtocol {
+			return ProxyEndpoint{}, fmt.Errorf("PROXY protocol isn't supported over udp for %v", method)
+		}
+	default:
+		return ProxyEndpoint{}, fmt.Errorf("invalid network for proxy endpoint %v: %v", method, entry[0])
+	}
+	return endpoint, nil
 }
 
 func JustInt32(v int32) MaybeInt32 { return &v }
 
 func JustInt64(v int64) MaybeInt64 { return &v }
 
+func JustString(v string) MaybeString { return &v }
+
 type StatusResponse struct {
 	UID     []byte
 	Action  int
 	Message string
+	// UpRate and DownRate are the rates a THROTTLE response lowers the user to
+	UpRate   int64
+	DownRate int64
 }
 
 type AuthorisationInfo struct {
@@ -43,14 +132,21 @@ type AuthorisationInfo struct {
 
 const (
 	TERMINATE = iota + 1
+	// WARN is given to a user whose quota is nearly exhausted
+	WARN
+	// THROTTLE is given to a user whose rates should be lowered until it no longer gets THROTTLE, either because its
+	// quota is nearly exhausted or because it has run out of credit and has fallback rates
+	THROTTLE
 )
 
 var ErrUserNotFound = errors.New("UID does not correspond to a user")
+var ErrReservedUID = errors.New("UID is reserved by the user database")
 var ErrSessionsCapReached = errors.New("Sessions cap has reached")
 var ErrMangerIsVoid = errors.New("cannot perform operation with user manager as database path is not specified")
 
 var ErrNoUpCredit = errors.New("No upload credit left")
 var ErrNoDownCredit = errors.New("No download credit left")
+var ErrNoCredit = errors.New("No credit left")
 var ErrUserExpired = errors.New("User has expired")
 
 type UserManager interface {
@@ -60,5 +156,11 @@ type UserManager interface {
 	ListAllUsers() ([]UserInfo, error)
 	GetUserInfo(UID []byte) (UserInfo, error)
 	WriteUserInfo(UserInfo) error
+	// WriteUserInfos writes all the UserInfos or, if any of them fails, none of them
+	WriteUserInfos([]UserInfo) error
 	DeleteUser(UID []byte) error
+	ListPlans() ([]Plan, error)
+	GetPlan(name string) (Plan, error)
+	WritePlan(Plan) error
+	DeletePlan(name string) error
 }
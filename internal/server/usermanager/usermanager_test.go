@@ -0,0 +1,39 @@
+package usermanager
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseProxyEndpoint(t *testing.T) {
+	endpoint, err := ParseProxyEndpoint("openvpn", []string{"TCP", "10.0.0.2:1194", "proxyprotocol"})
+	assert.NoError(t, err)
+	assert.Equal(t, ProxyEndpoint{Network: "tcp", Address: "10.0.0.2:1194", ProxyProtocol: true}, endpoint)
+
+	endpoint, err = ParseProxyEndpoint("v2ray", []string{"unix", "/run/v2ray.sock"})
+	assert.NoError(t, err)
+	assert.Equal(t, ProxyEndpoint{Network: "unix", Address: "/run/v2ray.sock"}, endpoint)
+
+	for _, entry := range [][]string{
+		{"tcp"},
+		{"tcp", "10.0.0.2:1194", "ProxyProtocol", "extra"},
+		{"tcp", "10.0.0.2:1194", "unknown"},
+		{"udp", "10.0.0.2:1194", "ProxyProtocol"},
+		{"sctp", "10.0.0.2:1194"},
+	} {
+		_, err := ParseProxyEndpoint("openvpn", entry)
+		assert.Error(t, err, entry)
+	}
+}
+
+func TestUserInfo_validate_ProxyEndpoints(t *testing.T) {
+	uinfo := UserInfo{UID: []byte{1}, ProxyEndpoints: map[string][]string{
+		"openvpn": {"tcp", "10.0.0.2:1194", "ProxyProtocol"},
+		"v2ray":   {"unix", "/run/v2ray.sock"},
+	}}
+	assert.NoError(t, uinfo.validate())
+
+	uinfo.ProxyEndpoints["shadowsocks"] = []string{"udp", "10.0.0.2:8388", "ProxyProtocol"}
+	assert.Error(t, uinfo.validate())
+}
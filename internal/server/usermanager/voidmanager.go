@@ -26,6 +26,26 @@ func (v *Voidmanager) WriteUserInfo(info UserInfo) error {
 	return ErrMangerIsVoid
 }
 
+func (v *Voidmanager) WriteUserInfos(infos []UserInfo) error {
+	return ErrMangerIsVoid
+}
+
 func (v *Voidmanager) DeleteUser(UID []byte) error {
 	return ErrMangerIsVoid
 }
+
+func (v *Voidmanager) ListPlans() ([]Plan, error) {
+	return []Plan{}, ErrMangerIsVoid
+}
+
+func (v *Voidmanager) GetPlan(name string) (Plan, error) {
+	return Plan{}, ErrMangerIsVoid
+}
+
+func (v *Voidmanager) WritePlan(plan Plan) error {
+	return ErrMangerIsVoid
+}
+
+func (v *Voidmanager) DeletePlan(name string) error {
+	return ErrMangerIsVoid
+}
@@ -42,3 +42,18 @@ func Test_Voidmanager_WriteUserInfo(t *testing.T) {
 	err := v.WriteUserInfo(UserInfo{})
 	assert.Equal(t, ErrMangerIsVoid, err)
 }
+
+func Test_Voidmanager_WriteUserInfos(t *testing.T) {
+	err := v.WriteUserInfos([]UserInfo{{}})
+	assert.Equal(t, ErrMangerIsVoid, err)
+}
+
+func Test_Voidmanager_Plans(t *testing.T) {
+	plans, err := v.ListPlans()
+	assert.Equal(t, ErrMangerIsVoid, err)
+	assert.Empty(t, plans)
+	_, err = v.GetPlan("basic")
+	assert.Equal(t, ErrMangerIsVoid, err)
+	assert.Equal(t, ErrMangerIsVoid, v.WritePlan(Plan{Name: "basic"}))
+	assert.Equal(t, ErrMangerIsVoid, v.DeletePlan("basic"))
+}
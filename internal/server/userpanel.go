@@ -1,7 +1,10 @@
 package server
 
 import (
+	"bytes"
 	"encoding/base64"
+	"fmt"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -24,6 +27,10 @@ type userPanel struct {
 	usageUpdateQueue  map[[16]byte]*usagePair
 
 	uploadInterval time.Duration
+
+	// bans and redirects are shown to the admin API. They are nil if the panel isn't part of a server State
+	bans      *authBans
+	redirects *redirLimiter
 }
 
 func MakeUserPanel(manager usermanager.UserManager) *userPanel {
@@ -72,11 +79,20 @@ func (panel *userPanel) GetUser(UID []byte) (*ActiveUser, error) {
 	if err != nil {
 		return nil, err
 	}
+	uinfo, err := panel.Manager.GetUserInfo(UID)
+	if err != nil {
+		return nil, err
+	}
 	valve := mux.MakeValve(upRate, downRate)
 	user := &ActiveUser{
 		panel:    panel,
 		valve:    valve,
 		sessions: make(map[uint32]*mux.Session),
+		upRate:   upRate,
+		downRate: downRate,
+	}
+	if err = user.setProxyRules(uinfo); err != nil {
+		return nil, fmt.Errorf("invalid ProxyEndpoints: %w", err)
 	}
 
 	copy(user.arrUID[:], UID)
@@ -193,7 +209,8 @@ func (panel *userPanel) commitUpdate() error {
 	if err != nil {
 		return err
 	}
-	for _, resp := range responses {
+	quotaStatuses := make(map[[16]byte]*usermanager.StatusResponse)
+	for i, resp := range responses {
 		var arrUID [16]byte
 		copy(arrUID[:], resp.UID)
 		switch resp.Action {
@@ -204,6 +221,22 @@ func (panel *userPanel) commitUpdate() error {
 			if user != nil {
 				panel.TerminateActiveUser(user, resp.Message)
 			}
+		case usermanager.WARN, usermanager.THROTTLE:
+			if prev := quotaStatuses[arrUID]; prev == nil || prev.Action < resp.Action {
+				quotaStatuses[arrUID] = &responses[i]
+			}
+		}
+	}
+	// a user that got neither WARN nor THROTTLE this time is no longer short of quota, e.g. as its credits have been
+	// reset
+	for _, status := range statuses {
+		var arrUID [16]byte
+		copy(arrUID[:], status.UID)
+		panel.activeUsersM.RLock()
+		user := panel.activeUsers[arrUID]
+		panel.activeUsersM.RUnlock()
+		if user != nil {
+			user.setQuotaStatus(quotaStatuses[arrUID])
 		}
 	}
 	return nil
@@ -218,6 +251,146 @@ func (panel *userPanel) regularQueueUpload() {
 			if err != nil {
 				log.Error(err)
 			}
+			// pick up changes made to the user database by something other than the admin API
+			panel.refreshActiveUsers()
 		}()
 	}
 }
+
+// refreshUser applies the current rates, sessions cap and proxy rules of a user in the UserManager to its ActiveUser, and
+// terminates it if it has been deleted
+func (panel *userPanel) refreshUser(user *ActiveUser) {
+	if user.bypass {
+		return
+	}
+	uinfo, err := panel.Manager.GetUserInfo(user.arrUID[:])
+	if err == usermanager.ErrUserNotFound {
+		panel.TerminateActiveUser(user, "User no longer exists")
+		return
+	}
+	if err != nil {
+		log.WithField("UID", base64.StdEncoding.EncodeToString(user.arrUID[:])).Errorf("failed to refresh active user: %v", err)
+		return
+	}
+	// AuthenticateUser gives the fallback rates rather than the user's own if it's out of credit
+	upRate, downRate, err := panel.Manager.AuthenticateUser(user.arrUID[:])
+	switch {
+	case err == usermanager.ErrUserNotFound || err == usermanager.ErrUserExpired || err == usermanager.ErrNoUpCredit ||
+		err == usermanager.ErrNoDownCredit || err == usermanager.ErrNoCredit:
+		panel.TerminateActiveUser(user, err.Error())
+		return
+	case err != nil:
+		// e.g. the database is busy, which shouldn't disconnect everyone online. The current rates are kept
+		log.WithField("UID", base64.StdEncoding.EncodeToString(user.arrUID[:])).Errorf("failed to refresh active user: %v", err)
+		return
+	}
+	user.setRates(upRate, downRate)
+	if uinfo.SessionsCap != nil {
+		user.enforceSessionsCap(int(*uinfo.SessionsCap), "Sessions cap has been lowered")
+	}
+	if err = user.setProxyRules(uinfo); err != nil {
+		log.WithField("UID", base64.StdEncoding.EncodeToString(user.arrUID[:])).Errorf("invalid ProxyEndpoints: %v", err)
+	}
+}
+
+func (panel *userPanel) refreshActiveUsers() {
+	for _, user := range panel.activeUserList() {
+		panel.refreshUser(user)
+	}
+}
+
+// activeUserList returns a snapshot of the active users, so that they can be worked on without holding activeUsersM
+func (panel *userPanel) activeUserList() []*ActiveUser {
+	panel.activeUsersM.RLock()
+	defer panel.activeUsersM.RUnlock()
+	users := make([]*ActiveUser, 0, len(panel.activeUsers))
+	for _, user := range panel.activeUsers {
+		users = append(users, user)
+	}
+	return users
+}
+
+func (panel *userPanel) activeUserOf(UID []byte) *ActiveUser {
+	var arrUID [16]byte
+	copy(arrUID[:], UID)
+	panel.activeUsersM.RLock()
+	defer panel.activeUsersM.RUnlock()
+	return panel.activeUsers[arrUID]
+}
+
+// ListActiveUsers implements usermanager.ActiveUserPanel
+func (panel *userPanel) ListActiveUsers() []usermanager.ActiveUserStatus {
+	users := panel.activeUserList()
+	statuses := make([]usermanager.ActiveUserStatus, 0, len(users))
+	for _, user := range users {
+		statuses = append(statuses, user.status())
+	}
+	sort.Slice(statuses, func(i, j int) bool { return bytes.Compare(statuses[i].UID, statuses[j].UID) < 0 })
+	return statuses
+}
+
+// GetActiveUser implements usermanager.ActiveUserPanel
+func (panel *userPanel) GetActiveUser(UID []byte) (usermanager.ActiveUserStatus, error) {
+	user := panel.activeUserOf(UID)
+	if user == nil {
+		return usermanager.ActiveUserStatus{}, usermanager.ErrUserNotActive
+	}
+	return user.status(), nil
+}
+
+// TerminateUser implements usermanager.ActiveUserPanel
+func (panel *userPanel) TerminateUser(UID []byte, reason string) error {
+	user := panel.activeUserOf(UID)
+	if user == nil {
+		return usermanager.ErrUserNotActive
+	}
+	panel.TerminateActiveUser(user, reason)
+	return nil
+}
+
+// RefreshUser implements usermanager.ActiveUserPanel
+func (panel *userPanel) RefreshUser(UID []byte) {
+	if user := panel.activeUserOf(UID); user != nil {
+		panel.refreshUser(user)
+	}
+}
+
+// CloseSession implements usermanager.ActiveUserPanel
+func (panel *userPanel) CloseSession(UID []byte, sessionID uint32, reason string) error {
+	user := panel.activeUserOf(UID)
+	if user == nil {
+		return usermanager.ErrUserNotActive
+	}
+	user.sessionsM.RLock()
+	_, ok := user.sessions[sessionID]
+	user.sessionsM.RUnlock()
+	if !ok {
+		return usermanager.ErrSessionNotFound
+	}
+	user.CloseSession(sessionID, reason)
+	return nil
+}
+
+func (panel *userPanel) ListBans() []usermanager.Ban {
+	if panel.bans == nil {
+		return []usermanager.Ban{}
+	}
+	return panel.bans.list()
+}
+
+func (panel *userPanel) ClearBan(subnet string) error {
+	if panel.bans == nil {
+		return usermanager.ErrBanNotFound
+	}
+	return panel.bans.clear(subnet)
+}
+
+func (panel *userPanel) RedirectStats() usermanager.RedirectStats {
+	return panel.redirects.stats()
+}
+
+func (panel *userPanel) ClearBans() {
+	if panel.bans != nil {
+		panel.bans.clearAll()
+	}
+}
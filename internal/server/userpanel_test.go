@@ -2,13 +2,16 @@ package server
 
 import (
 	"encoding/base64"
+	"errors"
 	"io/ioutil"
 	"os"
 	"testing"
 	"time"
 
 	"github.com/cbeuw/Cloak/internal/common"
+	mux "github.com/cbeuw/Cloak/internal/multiplex"
 	"github.com/cbeuw/Cloak/internal/server/usermanager"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestUserPanel_BypassUser(t *testing.T) {
@@ -188,3 +191,197 @@ func TestUserPanel_UpdateUsageQueue(t *testing.T) {
 		}
 	})
 }
+
+func TestUserPanel_ActiveUserPanel(t *testing.T) {
+	var tmpDB, _ = ioutil.TempFile("", "ck_user_info")
+	defer os.Remove(tmpDB.Name())
+	mgr, err := usermanager.MakeLocalManager(tmpDB.Name(), mockWorldState)
+	if err != nil {
+		t.Fatal(err)
+	}
+	panel := MakeUserPanel(mgr)
+	_ = mgr.WriteUserInfo(validUserInfo)
+
+	user, err := panel.GetUser(validUserInfo.UID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sesh0, _, _ := user.GetSession(0, getSeshConfig(false))
+	sesh1, _, _ := user.GetSession(1, getSeshConfig(false))
+	user.valve.AddRx(10)
+
+	statuses := panel.ListActiveUsers()
+	if assert.Len(t, statuses, 1) {
+		assert.Equal(t, validUserInfo.UID, statuses[0].UID)
+		assert.EqualValues(t, 10, statuses[0].RxBytes)
+		if assert.Len(t, statuses[0].Sessions, 2) {
+			assert.EqualValues(t, 0, statuses[0].Sessions[0].SessionID)
+			assert.EqualValues(t, 1, statuses[0].Sessions[1].SessionID)
+		}
+	}
+
+	_, err = panel.GetActiveUser(make([]byte, 16))
+	assert.Equal(t, usermanager.ErrUserNotActive, err)
+
+	assert.Equal(t, usermanager.ErrSessionNotFound, panel.CloseSession(validUserInfo.UID, 2, "kicked"))
+	assert.NoError(t, panel.CloseSession(validUserInfo.UID, 0, "kicked"))
+	assert.True(t, sesh0.IsClosed())
+	status, err := panel.GetActiveUser(validUserInfo.UID)
+	if assert.NoError(t, err) {
+		assert.Len(t, status.Sessions, 1)
+	}
+
+	assert.NoError(t, panel.TerminateUser(validUserInfo.UID, "kicked"))
+	assert.True(t, sesh1.IsClosed())
+	assert.False(t, panel.isActive(validUserInfo.UID))
+	assert.Equal(t, usermanager.ErrUserNotActive, panel.TerminateUser(validUserInfo.UID, "kicked"))
+}
+
+// flakyManager fails AuthenticateUser with err
+type flakyManager struct {
+	usermanager.UserManager
+	err error
+}
+
+func (m flakyManager) AuthenticateUser(UID []byte) (int64, int64, error) { return 0, 0, m.err }
+
+func TestUserPanel_RefreshUser(t *testing.T) {
+	var tmpDB, _ = ioutil.TempFile("", "ck_user_info")
+	defer os.Remove(tmpDB.Name())
+	mgr, err := usermanager.MakeLocalManager(tmpDB.Name(), mockWorldState)
+	if err != nil {
+		t.Fatal(err)
+	}
+	panel := MakeUserPanel(mgr)
+	_ = mgr.WriteUserInfo(validUserInfo)
+
+	user, err := panel.GetUser(validUserInfo.UID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sessions []*mux.Session
+	for i := uint32(0); i < 3; i++ {
+		sesh, _, _ := user.GetSession(i, getSeshConfig(false))
+		sessions = append(sessions, sesh)
+	}
+	_ = mgr.WriteUserInfo(usermanager.UserInfo{
+		UID:         validUserInfo.UID,
+		SessionsCap: usermanager.JustInt32(1),
+		UpRate:      usermanager.JustInt64(200),
+		DownRate:    usermanager.JustInt64(2000),
+	})
+	panel.RefreshUser(validUserInfo.UID)
+
+	assert.Equal(t, 1, user.NumSession())
+
+	panel.Manager = flakyManager{mgr, errors.New("database is locked")}
+	panel.RefreshUser(validUserInfo.UID)
+	assert.True(t, panel.isActive(validUserInfo.UID), "a database error shouldn't disconnect the user")
+	panel.Manager = flakyManager{mgr, usermanager.ErrUserExpired}
+	panel.RefreshUser(validUserInfo.UID)
+	assert.False(t, panel.isActive(validUserInfo.UID))
+	panel.Manager = mgr
+
+	user, err = panel.GetUser(validUserInfo.UID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sesh, _, err := user.GetSession(0, getSeshConfig(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessions = []*mux.Session{sesh}
+	_ = mgr.DeleteUser(validUserInfo.UID)
+	panel.RefreshUser(validUserInfo.UID)
+	assert.False(t, panel.isActive(validUserInfo.UID))
+	for _, sesh := range sessions {
+		assert.True(t, sesh.IsClosed())
+	}
+}
+
+func TestUserPanel_QuotaStatus(t *testing.T) {
+	var tmpDB, _ = ioutil.TempFile("", "ck_user_info")
+	defer os.Remove(tmpDB.Name())
+	mgr, err := usermanager.MakeLocalManager(tmpDB.Name(), mockWorldState)
+	if err != nil {
+		t.Fatal(err)
+	}
+	panel := MakeUserPanel(mgr)
+	_ = mgr.WritePlan(usermanager.Plan{
+		Name:             "basic",
+		UpCredit:         *validUserInfo.UpCredit,
+		DownCredit:       *validUserInfo.DownCredit,
+		WarnBelow:        50,
+		ThrottleBelow:    10,
+		ThrottleUpRate:   10,
+		ThrottleDownRate: 100,
+	})
+	withPlan := validUserInfo
+	withPlan.Plan = usermanager.JustString("basic")
+	_ = mgr.WriteUserInfo(withPlan)
+
+	user, err := panel.GetUser(validUserInfo.UID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user.valve.AddRx(*validUserInfo.UpCredit * 6 / 10)
+	panel.updateUsageQueue()
+	assert.NoError(t, panel.commitUpdate())
+	if assert.NotNil(t, user.quota) {
+		assert.Equal(t, usermanager.WARN, user.quota.Action)
+	}
+
+	user.valve.AddRx(*validUserInfo.UpCredit * 35 / 100)
+	panel.updateUsageQueue()
+	assert.NoError(t, panel.commitUpdate())
+	if assert.NotNil(t, user.quota) {
+		assert.Equal(t, usermanager.THROTTLE, user.quota.Action)
+	}
+	assert.True(t, panel.isActive(validUserInfo.UID), "a throttled user shouldn't be terminated")
+
+	_ = mgr.WriteUserInfo(usermanager.UserInfo{UID: validUserInfo.UID, UpCredit: validUserInfo.UpCredit})
+	panel.updateUsageQueue()
+	assert.NoError(t, panel.commitUpdate())
+	assert.Nil(t, user.quota)
+}
+
+func TestUserPanel_FallbackRates(t *testing.T) {
+	var tmpDB, _ = ioutil.TempFile("", "ck_user_info")
+	defer os.Remove(tmpDB.Name())
+	mgr, err := usermanager.MakeLocalManager(tmpDB.Name(), mockWorldState)
+	if err != nil {
+		t.Fatal(err)
+	}
+	panel := MakeUserPanel(mgr)
+	withFallback := validUserInfo
+	withFallback.FallbackUpRate = usermanager.JustInt64(10)
+	withFallback.FallbackDownRate = usermanager.JustInt64(100)
+	_ = mgr.WriteUserInfo(withFallback)
+
+	user, err := panel.GetUser(validUserInfo.UID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user.valve.AddRx(*validUserInfo.UpCredit)
+	panel.updateUsageQueue()
+	assert.NoError(t, panel.commitUpdate())
+	assert.True(t, panel.isActive(validUserInfo.UID), "a user with fallback rates shouldn't be terminated")
+	if assert.NotNil(t, user.quota) {
+		assert.Equal(t, usermanager.THROTTLE, user.quota.Action)
+		assert.EqualValues(t, 10, user.quota.UpRate)
+		assert.EqualValues(t, 100, user.quota.DownRate)
+	}
+
+	panel.RefreshUser(validUserInfo.UID)
+	assert.True(t, panel.isActive(validUserInfo.UID))
+	assert.EqualValues(t, 10, user.upRate)
+
+	_ = mgr.WriteUserInfo(usermanager.UserInfo{UID: validUserInfo.UID, UpCredit: validUserInfo.UpCredit})
+	panel.RefreshUser(validUserInfo.UID)
+	assert.Equal(t, *validUserInfo.UpRate, user.upRate)
+	panel.updateUsageQueue()
+	assert.NoError(t, panel.commitUpdate())
+	assert.Nil(t, user.quota)
+}
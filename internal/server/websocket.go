@@ -19,7 +19,7 @@ type WebSocket struct{}
 
 func (WebSocket) String() string { return "WebSocket" }
 
-func (WebSocket) processFirstPacket(reqPacket []byte, privateKey crypto.PrivateKey) (fragments authFragments, respond Responder, err error) {
+func (WebSocket) processFirstPacket(reqPacket []byte, privateKey crypto.PrivateKey, _ *serverHelloMimic) (fragments authFragments, respond Responder, err error) {
 	var req *http.Request
 	req, err = http.ReadRequest(bufio.NewReader(bytes.NewBuffer(reqPacket)))
 	if err != nil {
@@ -41,7 +41,7 @@ func (WebSocket) processFirstPacket(reqPacket []byte, privateKey crypto.PrivateK
 }
 
 func (WebSocket) makeResponder(reqPacket []byte, sharedSecret [32]byte) Responder {
-	respond := func(originalConn net.Conn, sessionKey [32]byte, randSource io.Reader) (preparedConn net.Conn, err error) {
+	respond := func(originalConn net.Conn, _ ClientInfo, sessionKey [32]byte, randSource io.Reader) (preparedConn net.Conn, err error) {
 		handler := newWsHandshakeHandler()
 
 		// For an explanation of the following 3 lines, see the comments in websocketAux.go
@@ -207,7 +207,7 @@ func establishSession(lcc client.LocalConnConfig, rcc client.RemoteConnConfig, a
 	} else {
 		var proxyToCkClientL *connutil.PipeListener
 		proxyToCkClientD, proxyToCkClientL = connutil.DialerListener(10 * 1024)
-		go client.RouteTCP(proxyToCkClientL, lcc.Timeout, rcc.Singleplex, clientSeshMaker)
+		go client.RouteTCP(proxyToCkClientL, lcc.Timeout, mux.DefaultStreamWeight, rcc.Singleplex, clientSeshMaker)
 	}
 
 	// set up server
@@ -443,6 +443,46 @@ func TestTCPMultiplex(t *testing.T) {
 	})
 }
 
+func TestExtraLocalPorts(t *testing.T) {
+	log.SetLevel(log.ErrorLevel)
+	worldState := common.WorldOfTime(time.Unix(10, 0))
+
+	lcc, rcc, ai := generateClientConfigs(basicTCPConfig, worldState)
+	sta := basicServerState(worldState)
+
+	_, proxyFromCkServerL, netToCkServerD, _, err := establishSession(lcc, rcc, ai, sta)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// listeners with different weights sharing a session, the way ck-client sets up ExtraLocalPorts
+	var sessions []*mux.Session
+	seshMaker := client.SharedSession(func() *mux.Session {
+		sesh := client.MakeSession(rcc, ai, netToCkServerD)
+		sessions = append(sessions, sesh)
+		return sesh
+	})
+	bulkD, bulkL := connutil.DialerListener(10 * 1024)
+	interactiveD, interactiveL := connutil.DialerListener(10 * 1024)
+	go client.RouteTCP(bulkL, lcc.Timeout, 1, rcc.Singleplex, seshMaker)
+	go client.RouteTCP(interactiveL, lcc.Timeout, 255, rcc.Singleplex, seshMaker)
+
+	go serveTCPEcho(proxyFromCkServerL)
+	var conns []net.Conn
+	for _, d := range []*connutil.PipeDialer{bulkD, interactiveD} {
+		conn, err := d.Dial("", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, conn)
+	}
+	runEchoTest(t, conns, 16384)
+
+	if assert.Len(t, sessions, 1, "the listeners should share a session") {
+		assert.Equal(t, 2, sessions[0].NumStreams())
+	}
+}
+
 func TestClosingStreamsFromProxy(t *testing.T) {
 	log.SetLevel(log.ErrorLevel)
 	worldState := common.WorldOfTime(time.Unix(10, 0))